@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"errors"
+	"os"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+type cancelCmdVars struct {
+	reason string
+}
+
+var cnlvs cancelCmdVars
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel <job-id>...",
+	Short: "cancel jobs",
+	Long:  "cancel submitted jobs which are not yet finished",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stdout)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		ids := []uuid.UUID{}
+		for _, arg := range args {
+			id, err := uuid.Parse(arg)
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Str("job_id", arg).Msg("invalid job ID")
+				os.Exit(1)
+			}
+			ids = append(ids, id)
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		failures := 0
+		for _, id := range ids {
+			stat, err := client.CancelJob(id, cnlvs.reason)
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Str("job_id", id.String()).Msg("could not cancel job")
+				failures++
+				continue
+			}
+
+			if stat.Status != "ok" {
+				cvmfs.Log.Error().
+					Err(errors.New(stat.Reason)).
+					Str("job_id", id.String()).
+					Msg("could not cancel job")
+				failures++
+			} else {
+				cvmfs.Log.Info().Str("job_id", id.String()).Msg("job cancelled")
+			}
+
+			for _, dep := range stat.FailedDependents {
+				cvmfs.Log.Info().
+					Str("job_id", dep.String()).
+					Str("dependency", id.String()).
+					Msg("dependent job failed")
+			}
+		}
+
+		if failures > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	cancelCmd.Flags().StringVarP(&cnlvs.reason, "reason", "m", "", "reason for the cancellation, recorded with the jobs")
+}
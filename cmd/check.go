@@ -62,16 +62,32 @@ var checkCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		cvmfs.Log.Info().Msg("completed jobs:")
+		cvmfs.Log.Info().Msg("job status:")
+		found := map[uuid.UUID]bool{}
 		if chkvs.fullStatus {
 			for _, j := range stats.Jobs {
+				found[j.ID] = true
 				printStatus(j.ID, j)
 			}
 		} else {
 			for _, j := range stats.IDs {
+				found[j.ID] = true
 				printStatus(j.ID, j)
 			}
 		}
+
+		// Jobs which were never submitted, or which predate job states and were not
+		// processed, are unknown to the server
+		unknown := []string{}
+		for _, id := range chkvs.ids {
+			if parsed, err := uuid.Parse(id); err != nil || !found[parsed] {
+				unknown = append(unknown, id)
+			}
+		}
+		if len(unknown) > 0 {
+			cvmfs.Log.Error().Strs("job_ids", unknown).Msg("unknown jobs")
+			os.Exit(1)
+		}
 	},
 }
 
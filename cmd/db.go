@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/spf13/cobra"
+)
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "manage the job database",
+	Long:  "create and update the schema of the job database of the server",
+}
+
+var dbInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "create the database schema",
+	Long:  "create the schema of an empty job database, at the latest version",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := readDBConfig(cmd)
+
+		if err := cvmfs.InitDatabase(&cfg.Backend); err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not initialize database")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().Int("version", cvmfs.SchemaVersion).Msg("database initialized")
+	},
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "update the database schema",
+	Long:  "apply the pending migrations to the schema of the job database",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := readDBConfig(cmd)
+
+		if err := cvmfs.MigrateDatabase(&cfg.Backend); err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not migrate database")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().Int("version", cvmfs.SchemaVersion).Msg("database schema is up to date")
+	},
+}
+
+var dbStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show the database schema version",
+	Long:  "show the current schema version of the job database and the pending migrations",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := readDBConfig(cmd)
+
+		status, err := cvmfs.GetSchemaStatus(&cfg.Backend)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not get database schema status")
+			os.Exit(1)
+		}
+
+		fmt.Printf("Current version: %v\n", status.CurrentVersion)
+		fmt.Printf("Latest version:  %v\n\n", status.LatestVersion)
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tAPPLIED\tVALID FROM\tVALID TO\tDESCRIPTION")
+		for _, v := range status.Versions {
+			applied := "no"
+			if v.Applied {
+				applied = "yes"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n",
+				v.Version, applied, formatTime(v.ValidFrom), formatTime(v.ValidTo), v.Description)
+		}
+		tw.Flush()
+
+		if status.CurrentVersion != status.LatestVersion {
+			os.Exit(1)
+		}
+	},
+}
+
+type dbPruneCmdVars struct {
+	dryRun bool
+}
+
+var dbprvs dbPruneCmdVars
+
+var dbPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "delete expired jobs",
+	Long:  "delete the finished jobs which have expired according to the retention policy",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := readDBConfig(cmd)
+
+		if cfg.Retention.KeepDays == 0 {
+			cvmfs.Log.Info().Msg("no retention period configured, nothing to prune")
+			return
+		}
+
+		result, err := cvmfs.PruneJobs(cfg, dbprvs.dryRun)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not prune jobs")
+			os.Exit(1)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "REPOSITORY\tJOBS")
+		for repo, n := range result.Pruned {
+			if n > 0 {
+				fmt.Fprintf(tw, "%v\t%v\n", repo, n)
+			}
+		}
+		tw.Flush()
+
+		if dbprvs.dryRun {
+			cvmfs.Log.Info().Int("jobs", result.Total()).Msg("jobs would be pruned (dry run)")
+		} else {
+			cvmfs.Log.Info().
+				Int("jobs", result.Total()).
+				Str("archive", result.Archive).
+				Msg("jobs pruned")
+		}
+	},
+}
+
+// readDBConfig reads the configuration of the job database, which is part of the
+// server configuration
+func readDBConfig(cmd *cobra.Command) *cvmfs.Config {
+	cvmfs.InitLogging(os.Stderr)
+
+	cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ServerProfile)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("config error")
+		os.Exit(1)
+	}
+
+	cvmfs.ConfigLogging(cfg)
+
+	return cfg
+}
+
+func init() {
+	dbCmd.AddCommand(dbInitCmd)
+	dbCmd.AddCommand(dbMigrateCmd)
+	dbCmd.AddCommand(dbStatusCmd)
+	dbCmd.AddCommand(dbPruneCmd)
+
+	dbPruneCmd.Flags().BoolVarP(&dbprvs.dryRun, "dry-run", "n", false, "only count the jobs which would be pruned")
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+var depsCmd = &cobra.Command{
+	Use:   "deps <job-id>",
+	Short: "show the dependency tree of a job",
+	Long:  "show the jobs which a job depends on, and the jobs which depend on it, with their state",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stderr)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		id, err := uuid.Parse(args[0])
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("job_id", args[0]).Msg("invalid job ID")
+			os.Exit(1)
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		reply, err := client.GetJobDependencies(id)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not get job dependencies")
+			os.Exit(1)
+		}
+
+		if reply.Status != "ok" {
+			cvmfs.Log.Error().
+				Err(errors.New(reply.Reason)).
+				Str("job_id", id.String()).
+				Msg("could not get job dependencies")
+			os.Exit(1)
+		}
+
+		printDependencyTrees(os.Stdout, id, reply)
+	},
+}
+
+// printDependencyTrees prints the ancestors of a job, followed by its descendants, as
+// indented trees. Jobs reachable through several paths are printed once for each path
+func printDependencyTrees(w io.Writer, id uuid.UUID, reply *cvmfs.GetJobDependenciesReply) {
+	jobs := map[uuid.UUID]*cvmfs.ProcessedJob{}
+	for i := range reply.Jobs {
+		jobs[reply.Jobs[i].ID] = &reply.Jobs[i]
+	}
+	dependents := map[uuid.UUID][]uuid.UUID{}
+	for job, deps := range reply.Dependencies {
+		for _, dep := range deps {
+			dependents[dep] = append(dependents[dep], job)
+		}
+	}
+
+	printDependencyNode(w, jobs, id, 0)
+	fmt.Fprintln(w, "\nDepends on:")
+	printDependencyTree(w, jobs, reply.Dependencies, id, 1)
+	fmt.Fprintln(w, "\nRequired by:")
+	printDependencyTree(w, jobs, dependents, id, 1)
+}
+
+func printDependencyTree(
+	w io.Writer, jobs map[uuid.UUID]*cvmfs.ProcessedJob, children map[uuid.UUID][]uuid.UUID,
+	id uuid.UUID, depth int) {
+	for _, child := range children[id] {
+		printDependencyNode(w, jobs, child, depth)
+		printDependencyTree(w, jobs, children, child, depth+1)
+	}
+}
+
+func printDependencyNode(
+	w io.Writer, jobs map[uuid.UUID]*cvmfs.ProcessedJob, id uuid.UUID, depth int) {
+	name, state := "-", "unknown"
+	if j, ok := jobs[id]; ok {
+		name, state = j.JobName, j.State
+	}
+	fmt.Fprintf(w, "%v%v  %v  [%v]\n", strings.Repeat("  ", depth), id, name, state)
+}
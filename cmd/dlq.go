@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/spf13/cobra"
+)
+
+type dlqCmdVars struct {
+	all bool
+}
+
+var dlqvs dlqCmdVars
+
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "manage the dead-letter queue",
+	Long: "inspect, requeue and purge the job messages which were rejected by the workers " +
+		"or delivered too many times",
+}
+
+var dlqListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the dead-lettered jobs",
+	Long:  "list the job messages in the dead-letter queue",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newDeadLetterClient(cmd)
+		defer client.Close()
+
+		letters, err := client.List()
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not list dead-letter queue")
+			os.Exit(1)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tREPOSITORY\tLEASE PATH\tREASON\tFAILED DELIVERIES\tDEAD-LETTERED")
+		for _, l := range letters {
+			id := l.Job.ID.String()
+			if l.Error != "" {
+				id = "-"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n",
+				id, l.Job.Repository, l.Job.LeasePath, l.Reason, l.FailedDeliveries,
+				formatTime(l.Time))
+		}
+		tw.Flush()
+	},
+}
+
+var dlqShowCmd = &cobra.Command{
+	Use:   "show <job-id>",
+	Short: "show a dead-lettered job",
+	Long:  "show the job description and the dead-lettering details of a message in the dead-letter queue",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newDeadLetterClient(cmd)
+		defer client.Close()
+
+		letters, err := client.List()
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not list dead-letter queue")
+			os.Exit(1)
+		}
+
+		found := false
+		for _, l := range letters {
+			if l.Job.ID.String() != args[0] {
+				continue
+			}
+			found = true
+			buf, err := json.MarshalIndent(&l, "", "  ")
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Msg("JSON serialization error")
+				os.Exit(1)
+			}
+			fmt.Println(string(buf))
+		}
+
+		if !found {
+			cvmfs.Log.Error().Str("job_id", args[0]).Msg("job not in dead-letter queue")
+			os.Exit(1)
+		}
+	},
+}
+
+var dlqRequeueCmd = &cobra.Command{
+	Use:   "requeue [<job-id>...]",
+	Short: "requeue dead-lettered jobs",
+	Long:  "publish the dead-lettered jobs again to the job queue, and remove them from the dead-letter queue",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkDeadLetterArgs(args)
+
+		client := newDeadLetterClient(cmd)
+		defer client.Close()
+
+		n, err := client.Requeue(args)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Int("requeued", n).Msg("could not requeue jobs")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().Int("jobs", n).Msg("jobs requeued")
+	},
+}
+
+var dlqPurgeCmd = &cobra.Command{
+	Use:   "purge [<job-id>...]",
+	Short: "delete dead-lettered jobs",
+	Long:  "delete job messages from the dead-letter queue",
+	Run: func(cmd *cobra.Command, args []string) {
+		checkDeadLetterArgs(args)
+
+		client := newDeadLetterClient(cmd)
+		defer client.Close()
+
+		n, err := client.Purge(args)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Int("purged", n).Msg("could not purge jobs")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().Int("jobs", n).Msg("jobs purged")
+	},
+}
+
+// checkDeadLetterArgs exits unless either some job IDs or the --all flag are given
+func checkDeadLetterArgs(args []string) {
+	if (len(args) == 0) == !dlqvs.all {
+		cvmfs.InitLogging(os.Stderr)
+		cvmfs.Log.Error().Msg("either job IDs or --all must be given")
+		os.Exit(1)
+	}
+}
+
+// newDeadLetterClient reads the configuration and connects to the dead-letter queue
+func newDeadLetterClient(cmd *cobra.Command) *cvmfs.DeadLetterClient {
+	cvmfs.InitLogging(os.Stderr)
+
+	cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("config error")
+		os.Exit(1)
+	}
+
+	cvmfs.ConfigLogging(cfg)
+
+	client, err := cvmfs.NewDeadLetterClient(cfg)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("could not connect to dead-letter queue")
+		os.Exit(1)
+	}
+
+	return client
+}
+
+func init() {
+	dlqCmd.AddCommand(dlqListCmd)
+	dlqCmd.AddCommand(dlqShowCmd)
+	dlqCmd.AddCommand(dlqRequeueCmd)
+	dlqCmd.AddCommand(dlqPurgeCmd)
+
+	dlqRequeueCmd.Flags().BoolVarP(&dlqvs.all, "all", "a", false, "requeue all the dead-lettered jobs")
+	dlqPurgeCmd.Flags().BoolVarP(&dlqvs.all, "all", "a", false, "delete all the dead-lettered jobs")
+}
@@ -0,0 +1,191 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/spf13/cobra"
+)
+
+type listCmdVars struct {
+	repo           string
+	jobName        string
+	worker         string
+	state          string
+	success        bool
+	leasePrefix    string
+	startedAfter   string
+	startedBefore  string
+	finishedAfter  string
+	finishedBefore string
+	limit          int
+	offset         int
+	all            bool
+	output         string
+}
+
+var lstvs listCmdVars
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list jobs",
+	Long:  "list and search the jobs known to the job server",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stderr)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		if lstvs.output != "table" && lstvs.output != "json" {
+			cvmfs.Log.Error().Msgf("invalid output format: %v", lstvs.output)
+			os.Exit(1)
+		}
+
+		filter, err := makeJobFilter(cmd)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("invalid search criteria")
+			os.Exit(1)
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		jobs := []cvmfs.ProcessedJob{}
+		for {
+			reply, err := client.ListJobs(filter)
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Msg("job listing failed")
+				os.Exit(1)
+			}
+
+			if reply.Status != "ok" {
+				cvmfs.Log.Error().Err(errors.New(reply.Reason)).Msg("job listing failed")
+				os.Exit(1)
+			}
+
+			jobs = append(jobs, reply.Jobs...)
+
+			if reply.NextOffset == 0 {
+				break
+			}
+			if !lstvs.all {
+				cvmfs.Log.Info().
+					Int("next_offset", reply.NextOffset).
+					Msg("more results available")
+				break
+			}
+			filter.Offset = reply.NextOffset
+		}
+
+		if lstvs.output == "json" {
+			for _, j := range jobs {
+				printStatus(j.ID, j)
+			}
+		} else {
+			printJobTable(jobs)
+		}
+	},
+}
+
+func makeJobFilter(cmd *cobra.Command) (*cvmfs.JobFilter, error) {
+	filter := &cvmfs.JobFilter{
+		Repository:      lstvs.repo,
+		JobName:         lstvs.jobName,
+		WorkerName:      lstvs.worker,
+		State:           lstvs.state,
+		LeasePathPrefix: lstvs.leasePrefix,
+		Limit:           lstvs.limit,
+		Offset:          lstvs.offset,
+	}
+
+	if cmd.Flags().Changed("success") {
+		filter.Successful = &lstvs.success
+	}
+
+	times := []struct {
+		flag string
+		arg  string
+		dst  *time.Time
+	}{
+		{"started-after", lstvs.startedAfter, &filter.StartedAfter},
+		{"started-before", lstvs.startedBefore, &filter.StartedBefore},
+		{"finished-after", lstvs.finishedAfter, &filter.FinishedAfter},
+		{"finished-before", lstvs.finishedBefore, &filter.FinishedBefore},
+	}
+	for _, t := range times {
+		if t.arg == "" {
+			continue
+		}
+		v, err := parseTimeArg(t.arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for --%v: %v", t.flag, err)
+		}
+		*t.dst = v
+	}
+
+	return filter, nil
+}
+
+// parseTimeArg accepts an RFC3339 timestamp, a date (YYYY-MM-DD, UTC) or a duration,
+// which is interpreted as the amount of time before now
+func parseTimeArg(arg string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", arg); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return time.Time{}, errors.New("expected an RFC3339 time, a date or a duration")
+	}
+	return time.Now().Add(-d), nil
+}
+
+func printJobTable(jobs []cvmfs.ProcessedJob) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tREPOSITORY\tLEASE PATH\tWORKER\tSTATE\tSUBMITTED\tFINISHED")
+	for _, j := range jobs {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			j.ID, j.JobName, j.Repository, j.LeasePath, j.WorkerName, j.State,
+			formatTime(j.SubmitTime), formatTime(j.FinishTime))
+	}
+	tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func init() {
+	listCmd.Flags().StringVarP(&lstvs.repo, "repo", "r", "", "only list jobs of this repository")
+	listCmd.Flags().StringVarP(&lstvs.jobName, "job-name", "j", "", "only list jobs with this name")
+	listCmd.Flags().StringVarP(&lstvs.worker, "worker", "W", "", "only list jobs processed by this worker")
+	listCmd.Flags().StringVarP(&lstvs.state, "state", "S", "", "only list jobs in this state")
+	listCmd.Flags().BoolVarP(&lstvs.success, "success", "s", false, "only list successful (or with --success=false, failed) jobs")
+	listCmd.Flags().StringVarP(&lstvs.leasePrefix, "lease-prefix", "l", "", "only list jobs with a lease path starting with this prefix")
+	listCmd.Flags().StringVar(&lstvs.startedAfter, "started-after", "", "only list jobs started at or after this time (RFC3339, date or duration ago)")
+	listCmd.Flags().StringVar(&lstvs.startedBefore, "started-before", "", "only list jobs started before this time (RFC3339, date or duration ago)")
+	listCmd.Flags().StringVar(&lstvs.finishedAfter, "finished-after", "", "only list jobs finished at or after this time (RFC3339, date or duration ago)")
+	listCmd.Flags().StringVar(&lstvs.finishedBefore, "finished-before", "", "only list jobs finished before this time (RFC3339, date or duration ago)")
+	listCmd.Flags().IntVar(&lstvs.limit, "limit", 0, "maximum number of jobs per page (server default if unset)")
+	listCmd.Flags().IntVar(&lstvs.offset, "offset", 0, "number of jobs to skip")
+	listCmd.Flags().BoolVarP(&lstvs.all, "all", "a", false, "fetch all the pages of results")
+	listCmd.Flags().StringVarP(&lstvs.output, "output", "o", "table", "output format (table or json)")
+}
@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"errors"
+	"os"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+type logsCmdVars struct {
+	follow bool
+}
+
+var lgsvs logsCmdVars
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <job-id>",
+	Short: "show the log of a job",
+	Long:  "show the output of the transaction script of a job, as captured by the worker",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stderr)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		id, err := uuid.Parse(args[0])
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("job_id", args[0]).Msg("invalid job ID")
+			os.Exit(1)
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		if lgsvs.follow {
+			if err := client.FollowJobLog(id, os.Stdout); err != nil {
+				cvmfs.Log.Error().Err(err).Str("job_id", id.String()).Msg("following job log failed")
+				os.Exit(1)
+			}
+			return
+		}
+
+		reply, err := client.GetJobLog(id, 0, false)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not get job log")
+			os.Exit(1)
+		}
+
+		if reply.Status != "ok" {
+			cvmfs.Log.Error().
+				Err(errors.New(reply.Reason)).
+				Str("job_id", id.String()).
+				Msg("could not get job log")
+			os.Exit(1)
+		}
+
+		os.Stdout.Write(reply.Data)
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&lgsvs.follow, "follow", "f", false, "stream the log until the job is finished")
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+var priorityCmd = &cobra.Command{
+	Use:   "priority <job-id> <priority>",
+	Short: "change the priority of a job",
+	Long: "change the priority of a job which is not yet running. " +
+		"Jobs with a higher priority (up to 9) are processed first",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stdout)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		id, err := uuid.Parse(args[0])
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("job_id", args[0]).Msg("invalid job ID")
+			os.Exit(1)
+		}
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("priority", args[1]).Msg("invalid job priority")
+			os.Exit(1)
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		stat, err := client.SetJobPriority(id, priority)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("job_id", id.String()).Msg("could not change job priority")
+			os.Exit(1)
+		}
+
+		if stat.Status != "ok" {
+			cvmfs.Log.Error().
+				Err(errors.New(stat.Reason)).
+				Str("job_id", id.String()).
+				Msg("could not change job priority")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().
+			Str("job_id", id.String()).
+			Int("priority", priority).
+			Msg("job priority changed")
+	},
+}
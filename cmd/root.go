@@ -37,8 +37,17 @@ func init() {
 		"log-timestamps",
 		false,
 		"include timestamps in logging output")
+	rootCmd.AddCommand(cancelCmd)
 	rootCmd.AddCommand(checkCmd)
+	rootCmd.AddCommand(dbCmd)
+	rootCmd.AddCommand(depsCmd)
+	rootCmd.AddCommand(dlqCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(priorityCmd)
+	rootCmd.AddCommand(scheduleCmd)
 	rootCmd.AddCommand(serverCmd)
+	rootCmd.AddCommand(statsCmd)
 	rootCmd.AddCommand(submitCmd)
 	rootCmd.AddCommand(workerCmd)
 }
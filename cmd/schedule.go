@@ -0,0 +1,180 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+type scheduleCmdVars struct {
+	cron       string
+	jobName    string
+	repo       string
+	payload    string
+	leasePath  string
+	priority   int
+	missedRuns string
+}
+
+var schvs scheduleCmdVars
+
+var scheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "manage the recurring jobs",
+	Long: "create, list and delete the schedules of the recurring jobs, which are submitted " +
+		"by the job server at the times given by cron expressions",
+}
+
+var scheduleAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "create a job schedule",
+	Long: "create a schedule submitting a job at each time matching the cron expression, " +
+		"in the time zone of the job server",
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newScheduleClient(cmd)
+
+		schedule := cvmfs.JobSchedule{
+			Name: args[0],
+			Cron: schvs.cron,
+			Job: cvmfs.JobSpecification{
+				JobName:    schvs.jobName,
+				Repository: schvs.repo,
+				Payload:    schvs.payload,
+				LeasePath:  schvs.leasePath,
+				Priority:   schvs.priority,
+			},
+			MissedRuns: schvs.missedRuns,
+		}
+
+		stat, err := client.PostSchedule(&schedule)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Str("schedule", args[0]).Msg("could not create job schedule")
+			os.Exit(1)
+		}
+
+		if stat.Status != "ok" {
+			cvmfs.Log.Error().
+				Err(errors.New(stat.Reason)).
+				Str("schedule", args[0]).
+				Msg("could not create job schedule")
+			os.Exit(1)
+		}
+
+		cvmfs.Log.Info().
+			Str("schedule", args[0]).
+			Str("cron", schvs.cron).
+			Msg("job schedule created")
+	},
+}
+
+var scheduleListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the job schedules",
+	Long:  "list the job schedules, with their last run and the next scheduled run",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newScheduleClient(cmd)
+
+		stat, err := client.ListSchedules()
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not list job schedules")
+			os.Exit(1)
+		}
+
+		if stat.Status != "ok" {
+			cvmfs.Log.Error().Err(errors.New(stat.Reason)).Msg("could not list job schedules")
+			os.Exit(1)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCRON\tREPOSITORY\tLEASE PATH\tSOURCE\tLAST RUN\tLAST JOB\tNEXT RUN")
+		for _, s := range stat.Schedules {
+			lastJob := "-"
+			if s.LastJobID != uuid.Nil {
+				lastJob = s.LastJobID.String()
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+				s.Name, s.Cron, s.Job.Repository, s.Job.LeasePath, s.Source,
+				formatTime(s.LastRun), lastJob, formatTime(s.NextRun))
+		}
+		tw.Flush()
+	},
+}
+
+var scheduleRmCmd = &cobra.Command{
+	Use:   "rm <name>...",
+	Short: "delete job schedules",
+	Long: "delete job schedules created with \"conveyor schedule add\". The jobs already " +
+		"submitted are not affected",
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := newScheduleClient(cmd)
+
+		failed := false
+		for _, name := range args {
+			stat, err := client.DeleteSchedule(name)
+			if err == nil && stat.Status != "ok" {
+				err = errors.New(stat.Reason)
+			}
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Str("schedule", name).Msg("could not delete job schedule")
+				failed = true
+				continue
+			}
+			cvmfs.Log.Info().Str("schedule", name).Msg("job schedule deleted")
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// newScheduleClient reads the configuration and creates a job client
+func newScheduleClient(cmd *cobra.Command) *cvmfs.JobClient {
+	cvmfs.InitLogging(os.Stderr)
+
+	cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("config error")
+		os.Exit(1)
+	}
+
+	cvmfs.ConfigLogging(cfg)
+
+	client, err := cvmfs.NewJobClient(cfg)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("could not start job client")
+		os.Exit(1)
+	}
+
+	return client
+}
+
+func init() {
+	scheduleCmd.AddCommand(scheduleAddCmd)
+	scheduleCmd.AddCommand(scheduleListCmd)
+	scheduleCmd.AddCommand(scheduleRmCmd)
+
+	scheduleAddCmd.Flags().StringVarP(
+		&schvs.cron, "cron", "c", "", "cron expression of the run times (e.g. \"0 3 * * *\")")
+	scheduleAddCmd.Flags().StringVarP(
+		&schvs.jobName, "job-name", "j", "", "name of the jobs (default: name of the schedule)")
+	scheduleAddCmd.Flags().StringVarP(&schvs.repo, "repo", "r", "", "target CVMFS repository")
+	scheduleAddCmd.Flags().StringVarP(&schvs.payload, "payload", "p", "", "payload URL")
+	scheduleAddCmd.Flags().StringVarP(
+		&schvs.leasePath, "lease-path", "l", "/", "leased path inside the repository")
+	scheduleAddCmd.Flags().IntVarP(
+		&schvs.priority, "priority", "P", 0, "priority of the jobs, from 0 to 9")
+	scheduleAddCmd.Flags().StringVar(
+		&schvs.missedRuns, "missed-runs", cvmfs.MissedRunsSkip,
+		"runs missed while the server was stopped: \"skip\" them, or \"run-once\"")
+	scheduleAddCmd.MarkFlagRequired("cron")
+	scheduleAddCmd.MarkFlagRequired("repo")
+}
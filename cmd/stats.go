@@ -0,0 +1,164 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/spf13/cobra"
+)
+
+type statsCmdVars struct {
+	from    string
+	to      string
+	repo    string
+	groupBy string
+	output  string
+}
+
+var sttvs statsCmdVars
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show job statistics",
+	Long:  "show the publication statistics of the jobs finished in a time window, by repository or by worker",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		cvmfs.InitLogging(os.Stderr)
+
+		cfg, err := cvmfs.ReadConfig(cmd, cvmfs.ClientProfile)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("config error")
+			os.Exit(1)
+		}
+
+		cvmfs.ConfigLogging(cfg)
+
+		if sttvs.output != "table" && sttvs.output != "json" {
+			cvmfs.Log.Error().Msgf("invalid output format: %v", sttvs.output)
+			os.Exit(1)
+		}
+
+		filter := &cvmfs.StatsFilter{Repository: sttvs.repo, GroupBy: sttvs.groupBy}
+		times := []struct {
+			flag string
+			arg  string
+			dst  *time.Time
+		}{
+			{"from", sttvs.from, &filter.From},
+			{"to", sttvs.to, &filter.To},
+		}
+		for _, t := range times {
+			if t.arg == "" {
+				continue
+			}
+			v, err := parseTimeArg(t.arg)
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Msgf("invalid value for --%v", t.flag)
+				os.Exit(1)
+			}
+			*t.dst = v
+		}
+
+		client, err := cvmfs.NewJobClient(cfg)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not start job client")
+			os.Exit(1)
+		}
+
+		reply, err := client.GetStats(filter)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("could not get job statistics")
+			os.Exit(1)
+		}
+
+		if reply.Status != "ok" {
+			cvmfs.Log.Error().Err(errors.New(reply.Reason)).Msg("could not get job statistics")
+			os.Exit(1)
+		}
+
+		if sttvs.output == "json" {
+			buf, err := json.Marshal(reply)
+			if err != nil {
+				cvmfs.Log.Error().Err(err).Msg("job statistics JSON serialization error")
+				os.Exit(1)
+			}
+			fmt.Println(string(buf))
+		} else {
+			printStatsTables(reply)
+		}
+	},
+}
+
+func printStatsTables(reply *cvmfs.GetStatsReply) {
+	fmt.Printf("Jobs finished from %v to %v\n\n", formatTime(reply.From), formatTime(reply.To))
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v\tJOBS\tSUCCEEDED\tFAILED\tCANCELLED\tMEDIAN TIME\tP95 TIME\tMEDIAN WAIT\tP95 WAIT\n",
+		statsGroupHeader(reply.GroupBy))
+	for _, s := range reply.Stats {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			statsGroupName(s.Group), s.Jobs, s.Succeeded, s.Failed, s.Cancelled,
+			formatSeconds(s.MedianDuration), formatSeconds(s.P95Duration),
+			formatSeconds(s.MedianWait), formatSeconds(s.P95Wait))
+	}
+	tw.Flush()
+
+	fmt.Println("\nFailures by worker:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v\tWORKER\tFAILED\n", statsGroupHeader(reply.GroupBy))
+	for _, s := range reply.Stats {
+		workers := make([]string, 0, len(s.FailuresByWorker))
+		for w := range s.FailuresByWorker {
+			workers = append(workers, w)
+		}
+		sort.Strings(workers)
+		for _, w := range workers {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n",
+				statsGroupName(s.Group), statsGroupName(w), s.FailuresByWorker[w])
+		}
+	}
+	tw.Flush()
+
+	fmt.Println("\nBusiest lease paths:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v\tLEASE PATH\tJOBS\n", statsGroupHeader(reply.GroupBy))
+	for _, s := range reply.Stats {
+		for _, p := range s.BusiestLeasePaths {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", statsGroupName(s.Group), p.LeasePath, p.Jobs)
+		}
+	}
+	tw.Flush()
+}
+
+func statsGroupHeader(groupBy string) string {
+	if groupBy == cvmfs.StatsGroupByWorker {
+		return "WORKER"
+	}
+	return "REPOSITORY"
+}
+
+// Jobs which were never processed have no worker
+func statsGroupName(name string) string {
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Second).String()
+}
+
+func init() {
+	statsCmd.Flags().StringVar(&sttvs.from, "from", "", "start of the time window (RFC3339, date or duration ago). Defaults to one week before the end")
+	statsCmd.Flags().StringVar(&sttvs.to, "to", "", "end of the time window (RFC3339, date or duration ago). Defaults to now")
+	statsCmd.Flags().StringVarP(&sttvs.repo, "repo", "r", "", "only include jobs of this repository")
+	statsCmd.Flags().StringVarP(&sttvs.groupBy, "group-by", "g", cvmfs.StatsGroupByRepository, "group the statistics by repository or by worker")
+	statsCmd.Flags().StringVarP(&sttvs.output, "output", "o", "table", "output format (table or json)")
+}
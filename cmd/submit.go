@@ -3,8 +3,10 @@ package commands
 import (
 	"errors"
 	"os"
+	"time"
 
 	"github.com/cvmfs/conveyor/internal/cvmfs"
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
@@ -14,7 +16,12 @@ type submitCmdVars struct {
 	payload   string
 	leasePath string
 	deps      []string
+	priority  int
+	notBefore string
+	delay     time.Duration
+	file      string
 	wait      bool
+	follow    bool
 }
 
 var subvs submitCmdVars
@@ -22,7 +29,7 @@ var subvs submitCmdVars
 var submitCmd = &cobra.Command{
 	Use:   "submit",
 	Short: "Submit a job",
-	Long:  "Submit a publishing job to a queue",
+	Long:  "Submit a publishing job, or a batch of jobs described in a manifest file, to a queue",
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		cvmfs.InitLogging(os.Stdout)
@@ -35,11 +42,16 @@ var submitCmd = &cobra.Command{
 
 		cvmfs.ConfigLogging(cfg)
 
-		spec := &cvmfs.JobSpecification{
-			JobName: subvs.jobName, Repository: subvs.repo, Payload: subvs.payload,
-			LeasePath: subvs.leasePath, Dependencies: subvs.deps}
+		if subvs.file == "" && subvs.repo == "" {
+			cvmfs.Log.Error().Msg("either --repo or --file must be given")
+			os.Exit(1)
+		}
 
-		spec.Prepare()
+		notBefore, err := parseNotBefore(subvs.notBefore, subvs.delay)
+		if err != nil {
+			cvmfs.Log.Error().Err(err).Msg("invalid start time")
+			os.Exit(1)
+		}
 
 		client, err := cvmfs.NewJobClient(cfg)
 		if err != nil {
@@ -47,64 +59,197 @@ var submitCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		stat, err := client.PostNewJob(spec)
-		if err != nil {
-			cvmfs.Log.Error().Err(err).Msg("could not post new job")
-			os.Exit(1)
+		var ids []uuid.UUID
+		if subvs.file != "" {
+			ids = submitBatch(client, notBefore)
+		} else {
+			ids = []uuid.UUID{submitJob(client, notBefore)}
 		}
 
-		if stat.Status != "ok" {
-			cvmfs.Log.Error().
-				Err(errors.New(stat.Reason)).
-				Msg("job failed")
-			os.Exit(1)
+		// Optionally stream the logs of the jobs while they are running
+		if subvs.follow {
+			followJobs(client, ids)
 		}
 
-		id := stat.ID
-
-		cvmfs.Log.Info().Str("job_id", id.String()).Msg("job submitted successfully")
-
-		// Optionally wait for completion of the job
-		if subvs.wait {
-			stats, err := client.WaitForJobs([]string{id.String()}, cfg.JobWaitTimeout)
-			if err != nil {
-				cvmfs.Log.Error().
-					Err(err).
-					Msg("waiting for job completion failed")
-				os.Exit(1)
-			}
-
-			if stats[0].Successful {
-				cvmfs.Log.Info().
-					Str("job_id", id.String()).
-					Bool("success", stats[0].Successful).
-					Msg("job finished")
-			} else {
-				quit := make(chan struct{})
-				st, err := client.GetJobStatus([]string{id.String()}, true, quit)
-				if err != nil {
-					cvmfs.Log.Error().Err(err).Msg("job status check failed")
-					os.Exit(1)
-				}
-				job := st.Jobs[0]
-				cvmfs.Log.Error().
-					Str("job_id", id.String()).
-					Bool("success", job.Successful).
-					Str("error", job.ErrorMessage).
-					Msg("job finished")
-				os.Exit(1)
-			}
+		// Optionally wait for completion of the jobs
+		if subvs.wait || subvs.follow {
+			waitForJobs(client, cfg, ids)
 		}
 	},
 }
 
+// submitJob submits the job described by the command-line flags
+func submitJob(client *cvmfs.JobClient, notBefore time.Time) uuid.UUID {
+	spec := &cvmfs.JobSpecification{
+		JobName: subvs.jobName, Repository: subvs.repo, Payload: subvs.payload,
+		LeasePath: subvs.leasePath, Dependencies: subvs.deps, Priority: subvs.priority,
+		NotBefore: notBefore}
+
+	spec.Prepare()
+
+	stat, err := client.PostNewJob(spec)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("could not post new job")
+		os.Exit(1)
+	}
+
+	if stat.Status != "ok" {
+		cvmfs.Log.Error().
+			Err(errors.New(stat.Reason)).
+			Msg("job failed")
+		os.Exit(1)
+	}
+
+	id := stat.ID
+
+	cvmfs.Log.Info().Str("job_id", id.String()).Msg("job submitted successfully")
+
+	return id
+}
+
+// submitBatch submits the jobs described in the manifest file. The repository given
+// on the command line is used for the jobs which don't specify one, and the start time
+// for all the jobs
+func submitBatch(client *cvmfs.JobClient, notBefore time.Time) []uuid.UUID {
+	batch, err := cvmfs.ReadJobManifest(subvs.file, subvs.repo)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("invalid job manifest")
+		os.Exit(1)
+	}
+	for i := range batch.Jobs {
+		batch.Jobs[i].NotBefore = notBefore
+	}
+
+	stat, err := client.PostJobBatch(batch)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("could not post job batch")
+		os.Exit(1)
+	}
+
+	if stat.Status != "ok" {
+		cvmfs.Log.Error().
+			Err(errors.New(stat.Reason)).
+			Interface("job_ids", stat.IDs).
+			Msg("job batch failed")
+		os.Exit(1)
+	}
+
+	ids := make([]uuid.UUID, 0, len(batch.Jobs))
+	for _, j := range batch.Jobs {
+		ids = append(ids, stat.IDs[j.Name])
+	}
+
+	cvmfs.Log.Info().Interface("job_ids", stat.IDs).Msg("jobs submitted successfully")
+
+	return ids
+}
+
+// parseNotBefore returns the time before which the submitted jobs must not start, given
+// either as an RFC3339 time (seconds may be omitted) or as a delay from now. The zero
+// time is returned if neither is given
+func parseNotBefore(notBefore string, delay time.Duration) (time.Time, error) {
+	switch {
+	case notBefore != "" && delay != 0:
+		return time.Time{}, errors.New("--not-before and --delay are mutually exclusive")
+	case delay < 0:
+		return time.Time{}, errors.New("negative delay")
+	case delay > 0:
+		return time.Now().Add(delay), nil
+	case notBefore == "":
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00"} {
+		if t, err := time.Parse(layout, notBefore); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("expected an RFC3339 time, such as 2019-03-01T02:00Z")
+}
+
+// followJobs streams the logs of the submitted jobs, one job after the other
+func followJobs(client *cvmfs.JobClient, ids []uuid.UUID) {
+	for _, id := range ids {
+		if len(ids) > 1 {
+			cvmfs.Log.Info().Str("job_id", id.String()).Msg("following job log")
+		}
+		if err := client.FollowJobLog(id, os.Stdout); err != nil {
+			cvmfs.Log.Error().Err(err).Str("job_id", id.String()).Msg("following job log failed")
+			os.Exit(1)
+		}
+	}
+}
+
+// waitForJobs waits for the completion of the submitted jobs and reports their status.
+// Exits with an error if any of the jobs failed
+func waitForJobs(client *cvmfs.JobClient, cfg *cvmfs.Config, ids []uuid.UUID) {
+	strIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		strIDs = append(strIDs, id.String())
+	}
+
+	stats, err := client.WaitForJobs(strIDs, cfg.JobWaitTimeout)
+	if err != nil {
+		cvmfs.Log.Error().
+			Err(err).
+			Msg("waiting for job completion failed")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, st := range stats {
+		if !st.Successful {
+			failed = true
+		}
+	}
+
+	if !failed && len(stats) == len(ids) {
+		for _, st := range stats {
+			cvmfs.Log.Info().
+				Str("job_id", st.ID.String()).
+				Bool("success", st.Successful).
+				Msg("job finished")
+		}
+		return
+	}
+
+	// Waiting stops at the first failed job; report the status of all the jobs
+	quit := make(chan struct{})
+	st, err := client.GetJobStatus(strIDs, true, quit)
+	if err != nil {
+		cvmfs.Log.Error().Err(err).Msg("job status check failed")
+		os.Exit(1)
+	}
+	for _, job := range st.Jobs {
+		ev := cvmfs.Log.Info()
+		if !job.Successful {
+			ev = cvmfs.Log.Error()
+		}
+		ev.Str("job_id", job.ID.String()).
+			Str("state", job.State).
+			Bool("success", job.Successful).
+			Str("error", job.ErrorMessage).
+			Msg("job finished")
+	}
+	os.Exit(1)
+}
+
 func init() {
 	submitCmd.Flags().StringVarP(&subvs.jobName, "job-name", "j", "", "name of the job")
-	submitCmd.Flags().StringVarP(&subvs.repo, "repo", "r", "", "target CVMFS repository")
-	submitCmd.MarkFlagRequired("repo")
+	submitCmd.Flags().StringVarP(&subvs.repo, "repo", "r", "", "target CVMFS repository (default repository for --file)")
 	submitCmd.Flags().StringVarP(&subvs.payload, "payload", "p", "", "payload URL")
 	submitCmd.Flags().StringVarP(&subvs.leasePath, "lease-path", "l", "/", "leased path inside the repository")
 	submitCmd.Flags().StringSliceVarP(
 		&subvs.deps, "deps", "d", []string{}, "comma-separated list of job dependency UUIDs")
-	submitCmd.Flags().BoolVarP(&subvs.wait, "wait", "w", false, "wait for completion of the submitted job")
+	submitCmd.Flags().IntVarP(
+		&subvs.priority, "priority", "P", 0, "priority of the job, from 0 (default) to 9 (highest)")
+	submitCmd.Flags().StringVar(
+		&subvs.notBefore, "not-before", "", "do not start the jobs before this time (RFC3339, e.g. 2019-03-01T02:00Z)")
+	submitCmd.Flags().DurationVar(
+		&subvs.delay, "delay", 0, "do not start the jobs before this delay from now (e.g. 30m)")
+	submitCmd.Flags().StringVarP(
+		&subvs.file, "file", "f", "", "manifest file (YAML or JSON) describing a batch of jobs")
+	submitCmd.Flags().BoolVarP(&subvs.wait, "wait", "w", false, "wait for completion of the submitted jobs")
+	submitCmd.Flags().BoolVarP(
+		&subvs.follow, "follow", "F", false, "stream the logs of the submitted jobs until they finish (implies --wait)")
 }
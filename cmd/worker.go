@@ -8,9 +8,10 @@ import (
 )
 
 type workerCmdVars struct {
-	name    string
-	retries int
-	tempDir string
+	name        string
+	retries     int
+	tempDir     string
+	metricsPort int
 }
 
 var wrkvs workerCmdVars
@@ -37,6 +38,9 @@ var workerCmd = &cobra.Command{
 		if cmd.Flags().Changed("temp-dir") {
 			cfg.Worker.TempDir = wrkvs.tempDir
 		}
+		if cmd.Flags().Changed("metrics-port") {
+			cfg.Worker.MetricsPort = wrkvs.metricsPort
+		}
 
 		cvmfs.ConfigLogging(cfg)
 
@@ -69,4 +73,5 @@ func init() {
 	workerCmd.Flags().StringVarP(&wrkvs.name, "worker-name", "n", "", "name of the worker daemon")
 	workerCmd.Flags().IntVarP(&wrkvs.retries, "job-retries", "R", 0, "number of times the transaction script should be retried")
 	workerCmd.Flags().StringVarP(&wrkvs.tempDir, "temp-dir", "T", "", "temporary directory used by the worker daemon")
+	workerCmd.Flags().IntVar(&wrkvs.metricsPort, "metrics-port", 0, "port of the Prometheus metrics listener (disabled if unset)")
 }
@@ -2,12 +2,14 @@ package cvmfs
 
 import (
 	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,7 +26,7 @@ const queryRetryDelay = 30
 
 // JobClient offers functionality for interacting with the job server
 type JobClient struct {
-	sharedKey string
+	keys      *keyStore
 	endpoints HTTPEndpoints
 	qcl       *QueueClient
 }
@@ -32,11 +34,18 @@ type JobClient struct {
 // NewJobClient constructs a new JobClient object using a configuration object and a set
 // of keys
 func NewJobClient(cfg *Config) (*JobClient, error) {
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signing keys")
+	}
+	if err := configureHTTPClient(&cfg.Server); err != nil {
+		return nil, errors.Wrap(err, "could not configure HTTP client")
+	}
 	q, err := NewQueueClient(&cfg.Queue, consumerConnection)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not create queue connection")
 	}
-	return &JobClient{cfg.SharedKey, cfg.HTTPEndpoints(), q}, nil
+	return &JobClient{keys, cfg.HTTPEndpoints(), q}, nil
 }
 
 // Close all the internal connections of the object
@@ -44,16 +53,74 @@ func (c *JobClient) Close() {
 	c.qcl.Close()
 }
 
-// SubscribeNewJobs returns a channel with new job messages coming from the conveyor
-// server
-func (c *JobClient) SubscribeNewJobs(keyID string) (<-chan amqp.Delivery, error) {
-	ch, err := c.qcl.Chan.Consume(
-		c.qcl.NewJobQueue.Name, "", false, false, false, false, nil)
+// SubscribeNewJobs returns a channel with the new job messages of a set of repositories
+// coming from the conveyor server. Each repository has its own job queue. The
+// subscriptions are resumed when the connection to the queue is restored
+func (c *JobClient) SubscribeNewJobs(repositories []string) (<-chan amqp.Delivery, error) {
+	jobs := make(chan amqp.Delivery)
+	var wg sync.WaitGroup
+	for _, repo := range repositories {
+		ch, err := c.qcl.consume(c.qcl.declareJobQueue(repo), false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not start consuming jobs of %v", repo)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range ch {
+				jobs <- m
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(jobs)
+	}()
+
+	return jobs, nil
+}
+
+// SubscribeCancellations returns a channel with the IDs of the jobs which are cancelled
+// from now on. Cancellations published while the connection to the queue is lost are
+// not received
+func (c *JobClient) SubscribeCancellations() (<-chan uuid.UUID, error) {
+	// Declare and bind a queue for cancellation notifications (one-to-all). The queue
+	// is exclusive, non durable and auto-deleted, and is declared again on reconnection
+	declare := func(ch amqpChannel) (string, error) {
+		q, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return "", errors.Wrap(err, "could not declare cancellation queue")
+		}
+
+		if err := ch.QueueBind(
+			q.Name, cancelledKey, c.qcl.completedJobExchange, false, nil); err != nil {
+			return "", errors.Wrap(err, "could not bind cancellation queue")
+		}
+
+		return q.Name, nil
+	}
+
+	msgs, err := c.qcl.consume(declare, true)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not start consuming jobs")
+		return nil, errors.Wrap(err, "could not start consuming cancellations")
 	}
 
-	return ch, nil
+	ids := make(chan uuid.UUID)
+	go func() {
+		for m := range msgs {
+			var stat JobStatus
+			if err := json.Unmarshal(m.Body, &stat); err != nil {
+				Log.Error().Err(err).Msg("cancellation message deserialization error")
+				continue
+			}
+			ids <- stat.ID
+		}
+		close(ids)
+	}()
+
+	return ids, nil
 }
 
 // WaitForJobs waits for the completion of a set of jobs referenced through theirs
@@ -129,45 +196,76 @@ L:
 func (c *JobClient) GetJobStatus(
 	ids []string, full bool, quit <-chan struct{}) (*GetJobStatusReply, error) {
 
-	req, err := http.NewRequest("GET", c.endpoints.CompletedJobs(true), nil)
-	if err != nil {
-		errors.Wrap(err, "Could not create GET request")
-	}
-	q := req.URL.Query()
+	q := url.Values{}
 	q["id"] = ids
 	if full {
 		q.Set("full", "true")
 	} else {
 		q.Set("full", "false")
 	}
-	req.URL.RawQuery = q.Encode()
-
-	// Compute message HMAC
-	buf := []byte(req.URL.RawQuery)
-	hmac := base64.StdEncoding.EncodeToString(computeHMAC(buf, c.sharedKey))
-	req.Header.Add("Authorization", fmt.Sprintf("%v", hmac))
 
-	resp, err := makeRequest(req, quit)
+	buf2, err := c.getMsg(c.endpoints.CompletedJobs(true), q, quit)
 	if err != nil {
 		return nil, errors.Wrap(err, "Getting job status from server failed")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET request failed: %v", resp.Status)
+	var status GetJobStatusReply
+	if err := json.Unmarshal(buf2, &status); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
 	}
 
-	buf2, err := ioutil.ReadAll(resp.Body)
+	return &status, nil
+}
+
+// ListJobs queries the server for the jobs matching a filter
+func (c *JobClient) ListJobs(filter *JobFilter) (*ListJobsReply, error) {
+	quit := make(chan struct{})
+	buf2, err := c.getMsg(c.endpoints.Jobs(true), filter.Values(), quit)
 	if err != nil {
-		return nil, errors.Wrap(err, "Reading reply body failed")
+		return nil, errors.Wrap(err, "Listing jobs from server failed")
 	}
 
-	var status GetJobStatusReply
-	if err := json.Unmarshal(buf2, &status); err != nil {
+	var jobs ListJobsReply
+	if err := json.Unmarshal(buf2, &jobs); err != nil {
 		return nil, errors.Wrap(err, "JSON decoding of reply failed")
 	}
 
-	return &status, nil
+	return &jobs, nil
+}
+
+// GetJobDependencies queries the dependency graph of a job from the server
+func (c *JobClient) GetJobDependencies(id uuid.UUID) (*GetJobDependenciesReply, error) {
+	q := url.Values{}
+	q.Set("id", id.String())
+
+	quit := make(chan struct{})
+	buf2, err := c.getMsg(c.endpoints.JobDependencies(true), q, quit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting job dependencies from server failed")
+	}
+
+	var deps GetJobDependenciesReply
+	if err := json.Unmarshal(buf2, &deps); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &deps, nil
+}
+
+// GetStats queries the job statistics from the server
+func (c *JobClient) GetStats(filter *StatsFilter) (*GetStatsReply, error) {
+	quit := make(chan struct{})
+	buf2, err := c.getMsg(c.endpoints.Stats(true), filter.Values(), quit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting job statistics from server failed")
+	}
+
+	var stats GetStatsReply
+	if err := json.Unmarshal(buf2, &stats); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stats, nil
 }
 
 // PostNewJob posts a new unprocessed job to the server
@@ -178,7 +276,7 @@ func (c *JobClient) PostNewJob(job *JobSpecification) (*PostNewJobReply, error)
 	}
 
 	quit := make(chan struct{})
-	reply, err := c.postMsg(buf, job.Repository, c.endpoints.NewJobs(true), quit)
+	reply, err := c.postMsg(buf, c.endpoints.NewJobs(true), quit, job.Repository)
 	if err != nil {
 		return nil, errors.Wrap(err, "POST request failed")
 	}
@@ -191,6 +289,27 @@ func (c *JobClient) PostNewJob(job *JobSpecification) (*PostNewJobReply, error)
 	return &stat, nil
 }
 
+// PostJobBatch posts a batch of new jobs to the server
+func (c *JobClient) PostJobBatch(batch *JobBatch) (*PostJobBatchReply, error) {
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of job batch failed")
+	}
+
+	quit := make(chan struct{})
+	reply, err := c.postMsg(buf, c.endpoints.JobBatch(true), quit, batch.repositories()...)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat PostJobBatchReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
 // PostJobStatus posts the status of a completed job to the server
 func (c *JobClient) PostJobStatus(job *ProcessedJob) (*PostJobStatusReply, error) {
 	buf, err := json.Marshal(job)
@@ -199,7 +318,7 @@ func (c *JobClient) PostJobStatus(job *ProcessedJob) (*PostJobStatusReply, error
 	}
 
 	quit := make(chan struct{})
-	reply, err := c.postMsg(buf, job.Repository, c.endpoints.CompletedJobs(true), quit)
+	reply, err := c.postMsg(buf, c.endpoints.CompletedJobs(true), quit, job.Repository)
 	if err != nil {
 		return nil, errors.Wrap(err, "POST request failed")
 	}
@@ -212,26 +331,242 @@ func (c *JobClient) PostJobStatus(job *ProcessedJob) (*PostJobStatusReply, error
 	return &stat, nil
 }
 
-// postMsg makes a POST request to the conveyor server located at "url" with the body
-// provided in the "msg" slice. The message is signed with the key corresponding to
-// "repository"
-func (c *JobClient) postMsg(
-	msg []byte, repository, url string, quit <-chan struct{}) ([]byte, error) {
+// PostJobState posts a state transition of a job to the server
+func (c *JobClient) PostJobState(update *JobStateUpdate, repository string) (*PostJobStateReply, error) {
+	buf, err := json.Marshal(update)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of job state failed")
+	}
 
-	// Compute message HMAC
-	hmac := base64.StdEncoding.EncodeToString(computeHMAC(msg, c.sharedKey))
+	quit := make(chan struct{})
+	reply, err := c.postMsg(buf, c.endpoints.JobState(true), quit, repository)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
 
-	rdr := bytes.NewReader(msg)
+	var stat PostJobStateReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
 
-	// Post processed job status to the job server
-	req, err := http.NewRequest("POST", url, rdr)
+	return &stat, nil
+}
+
+// CancelJob requests the cancellation of a job. The request is signed with a key valid for
+// the repository of the job
+func (c *JobClient) CancelJob(id uuid.UUID, reason string) (*CancelJobReply, error) {
+	buf, err := json.Marshal(&CancelJobRequest{ID: id, Reason: reason})
 	if err != nil {
-		errors.Wrap(err, "could not create POST request")
+		return nil, errors.Wrap(err, "JSON encoding of cancellation request failed")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("%v", hmac))
-	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := makeRequest(req, quit)
+	quit := make(chan struct{})
+	repositories := []string{}
+	if st, err := c.GetJobStatus(
+		[]string{id.String()}, true, quit); err == nil && len(st.Jobs) > 0 {
+		repositories = append(repositories, st.Jobs[0].Repository)
+	}
+
+	reply, err := c.postMsg(buf, c.endpoints.CancelJob(true), quit, repositories...)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat CancelJobReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
+// SetJobPriority requests a change of the priority of a queued job. The request is
+// signed with a key valid for the repository of the job
+func (c *JobClient) SetJobPriority(id uuid.UUID, priority int) (*JobPriorityReply, error) {
+	buf, err := json.Marshal(&JobPriorityRequest{ID: id, Priority: priority})
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of priority request failed")
+	}
+
+	quit := make(chan struct{})
+	repositories := []string{}
+	if st, err := c.GetJobStatus(
+		[]string{id.String()}, true, quit); err == nil && len(st.Jobs) > 0 {
+		repositories = append(repositories, st.Jobs[0].Repository)
+	}
+
+	reply, err := c.postMsg(buf, c.endpoints.JobPriority(true), quit, repositories...)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat JobPriorityReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
+// ListSchedules returns the job schedules of the server
+func (c *JobClient) ListSchedules() (*ListSchedulesReply, error) {
+	quit := make(chan struct{})
+	buf, err := c.getMsg(c.endpoints.Schedules(true), url.Values{}, quit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting job schedules from server failed")
+	}
+
+	var schedules ListSchedulesReply
+	if err := json.Unmarshal(buf, &schedules); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &schedules, nil
+}
+
+// PostSchedule posts a new job schedule to the server
+func (c *JobClient) PostSchedule(schedule *JobSchedule) (*PostScheduleReply, error) {
+	buf, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of job schedule failed")
+	}
+
+	quit := make(chan struct{})
+	reply, err := c.postMsg(
+		buf, c.endpoints.Schedules(true), quit, schedule.Job.Repository)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat PostScheduleReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
+// DeleteSchedule requests the deletion of a job schedule. The request is signed with a
+// key valid for the repository of the schedule
+func (c *JobClient) DeleteSchedule(name string) (*DeleteScheduleReply, error) {
+	buf, err := json.Marshal(&DeleteScheduleRequest{Name: name})
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of schedule deletion request failed")
+	}
+
+	repositories := []string{}
+	if st, err := c.ListSchedules(); err == nil {
+		for _, s := range st.Schedules {
+			if s.Name == name {
+				repositories = append(repositories, s.Job.Repository)
+			}
+		}
+	}
+
+	quit := make(chan struct{})
+	reply, err := c.postMsg(buf, c.endpoints.DeleteSchedule(true), quit, repositories...)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat DeleteScheduleReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
+// PostJobLog posts a chunk of the log of a job to the server
+func (c *JobClient) PostJobLog(chunk *JobLogChunk, repository string) (*PostJobLogReply, error) {
+	buf, err := json.Marshal(chunk)
+	if err != nil {
+		return nil, errors.Wrap(err, "JSON encoding of job log failed")
+	}
+
+	quit := make(chan struct{})
+	reply, err := c.postMsg(buf, c.endpoints.JobLogs(true), quit, repository)
+	if err != nil {
+		return nil, errors.Wrap(err, "POST request failed")
+	}
+
+	var stat PostJobLogReply
+	if err := json.Unmarshal(reply, &stat); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &stat, nil
+}
+
+// GetJobLog queries the log of a job from the server, starting at offset. With "follow",
+// the server waits for new output of an unfinished job before replying
+func (c *JobClient) GetJobLog(id uuid.UUID, offset int64, follow bool) (*GetJobLogReply, error) {
+	q := url.Values{}
+	q.Set("id", id.String())
+	q.Set("offset", strconv.FormatInt(offset, 10))
+	if follow {
+		q.Set("follow", "true")
+	}
+
+	quit := make(chan struct{})
+	buf2, err := c.getMsg(c.endpoints.JobLogs(true), q, quit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Getting job log from server failed")
+	}
+
+	var log GetJobLogReply
+	if err := json.Unmarshal(buf2, &log); err != nil {
+		return nil, errors.Wrap(err, "JSON decoding of reply failed")
+	}
+
+	return &log, nil
+}
+
+// FollowJobLog writes the log of a job to "out" as it is produced, until the job is
+// finished
+func (c *JobClient) FollowJobLog(id uuid.UUID, out io.Writer) error {
+	var offset int64
+	for {
+		reply, err := c.GetJobLog(id, offset, true)
+		if err != nil {
+			return errors.Wrap(err, "could not get job log")
+		}
+		if reply.Status != "ok" {
+			return fmt.Errorf("could not get job log: %v", reply.Reason)
+		}
+
+		if _, err := out.Write(reply.Data); err != nil {
+			return errors.Wrap(err, "could not write job log")
+		}
+		offset = reply.NextOffset
+
+		// The log of a finished job is returned in full
+		if reply.Finished {
+			return nil
+		}
+	}
+}
+
+// postMsg makes a POST request to the conveyor server located at "endpoint" with the body
+// provided in the "msg" slice. The message is signed with a key valid for all the
+// repositories
+func (c *JobClient) postMsg(
+	msg []byte, endpoint string, quit <-chan struct{}, repositories ...string) ([]byte, error) {
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(msg))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create POST request")
+		}
+		req.Header.Add("Content-Type", "application/json")
+		// Compute message HMAC
+		if err := c.sign(req, msg, repositories...); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	resp, err := makeRequest(newRequest, quit)
 	if err != nil {
 		return nil, errors.Wrap(err, "Posting job status to server failed")
 	}
@@ -249,6 +584,51 @@ func (c *JobClient) postMsg(
 	return buf2, nil
 }
 
+// getMsg makes a GET request to the conveyor server located at "endpoint" with the
+// query string built from "query", and returns the body of the reply. The query string
+// is signed with a key valid for all the repositories
+func (c *JobClient) getMsg(
+	endpoint string, query url.Values, quit <-chan struct{},
+	repositories ...string) ([]byte, error) {
+
+	rawQuery := query.Encode()
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create GET request")
+		}
+		req.URL.RawQuery = rawQuery
+		// Compute message HMAC
+		if err := c.sign(req, []byte(rawQuery), repositories...); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+
+	resp, err := makeRequest(newRequest, quit)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET request failed: %v", resp.Status)
+	}
+
+	buf2, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading reply body failed")
+	}
+
+	return buf2, nil
+}
+
+// sign adds the signature of a request, computed with a key valid for all the
+// repositories, to its headers. The payload of GET requests is the query string
+func (c *JobClient) sign(req *http.Request, payload []byte, repositories ...string) error {
+	return signRequest(req, payload, c.keys.keyFor(repositories...))
+}
+
 // RequestCancelled is an error value that signals a cancelled HTTP request
 type RequestCancelled struct{}
 
@@ -256,9 +636,12 @@ func (c RequestCancelled) Error() string {
 	return "Request cancelled"
 }
 
-// Helper function to perform an HTTP request with retries, backoff and cancellation
+// Helper function to perform an HTTP request with retries, backoff and cancellation.
+// The request is created again by "newRequest" for each attempt, so that its body can be
+// read again and its signature uses a fresh timestamp and nonce.
 // On return, "err" is of type "RequestCancelled" if the request was cancelled
-func makeRequest(req *http.Request, quit <-chan struct{}) (*http.Response, error) {
+func makeRequest(
+	newRequest func() (*http.Request, error), quit <-chan struct{}) (*http.Response, error) {
 	w := DefaultWaiter()
 	var resp *http.Response
 	var err error
@@ -270,7 +653,12 @@ L:
 			break L
 		default:
 		}
-		resp, err = http.DefaultClient.Do(req)
+		var req *http.Request
+		req, err = newRequest()
+		if err != nil {
+			break L
+		}
+		resp, err = httpClient.Do(req)
 		if err == nil {
 			break L
 		}
@@ -290,8 +678,24 @@ func listen(
 	notifications chan<- JobStatus,
 	quit <-chan struct{}) error {
 
-	jobs, err := q.Chan.Consume(
-		q.CompletedJobQueue.Name, "", false, false, false, false, nil)
+	// Declare and bind a queue for finished job notifications (one-to-all)
+	// This queue has an automatically generated name and is exclusive to
+	// a single consumer. It is not durable and is auto-deleted
+	declare := func(ch amqpChannel) (string, error) {
+		queue, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return "", errors.Wrap(err, "could not declare completed job queue")
+		}
+
+		if err := ch.QueueBind(
+			queue.Name, "#", q.completedJobExchange, false, nil); err != nil {
+			return "", errors.Wrap(err, "could not bind completed job queue")
+		}
+
+		return queue.Name, nil
+	}
+
+	jobs, err := q.consume(declare, false)
 	if err != nil {
 		return errors.Wrap(err, "could not start consuming jobs")
 	}
@@ -300,12 +704,16 @@ func listen(
 	L:
 		for {
 			select {
-			case j := <-jobs:
+			case j, ok := <-jobs:
+				if !ok {
+					break L
+				}
 				var stat JobStatus
 				if err := json.Unmarshal(j.Body, &stat); err != nil {
+					// Malformed notifications are dropped
 					Log.Error().Err(err).Msg("job status deserialization error")
 					j.Nack(false, false)
-					os.Exit(1) // Is there a better way to handle this than restarting?
+					continue
 				}
 				id := stat.ID.String()
 				_, pres := ids[id]
@@ -355,8 +763,11 @@ func query(
 					err, fmt.Sprintf("Getting job status failed: %s", reply.Reason))
 			}
 
+			// Jobs which are known to the server but not yet finished are skipped
 			for _, j := range reply.IDs {
-				results <- j
+				if j.State == "" || isFinalState(j.State) {
+					results <- j
+				}
 			}
 
 			time.Sleep(queryRetryDelay * time.Second)
@@ -2,6 +2,7 @@ package cvmfs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
@@ -21,12 +22,14 @@ const (
 
 // BackendConfig - database backend configuration for the conveyor job server DB backend
 type BackendConfig struct {
-	Type     string
-	Database string
-	Username string
-	Password string
-	Host     string
-	Port     int
+	Type        string
+	Database    string
+	Username    string
+	Password    string
+	Host        string
+	Port        int
+	Path        string
+	AutoMigrate bool `mapstructure:"auto_migrate"`
 }
 
 // QueueConfig - configuration of message queue (RabbitMQ)
@@ -39,30 +42,89 @@ type QueueConfig struct {
 	NewJobExchange       string `mapstructure:"new_job_exchange"`
 	NewJobQueue          string `mapstructure:"new_job_queue"`
 	CompletedJobExchange string `mapstructure:"completed_job_exchange"`
+	DeadLetterExchange   string `mapstructure:"dead_letter_exchange"`
+	DeadLetterQueue      string `mapstructure:"dead_letter_queue"`
+	MaxDeliveries        int    `mapstructure:"max_deliveries"`
+	TLS                  bool
+	CAFile               string `mapstructure:"ca_file"`
+	CertFile             string `mapstructure:"cert_file"`
+	KeyFile              string `mapstructure:"key_file"`
+	ServerName           string `mapstructure:"server_name"`
 }
 
 // WorkerConfig - configuration of the Conveyor worker daemon
 type WorkerConfig struct {
-	Name       string
-	JobRetries int    `mapstructure:"job_retries"`
-	TempDir    string `mapstructure:"temp_dir"`
+	Name         string
+	JobRetries   int      `mapstructure:"job_retries"`
+	TempDir      string   `mapstructure:"temp_dir"`
+	MaxLogSize   int      `mapstructure:"max_log_size"`
+	MetricsPort  int      `mapstructure:"metrics_port"`
+	Repositories []string `mapstructure:"repositories"`
 }
 
+// Directory holding the configuration of the repositories of a CernVM-FS publisher
+const cvmfsRepositoriesDir = "/etc/cvmfs/repositories.d"
+
 // ServerConfig - configuration of the Conveyor jov server
 type ServerConfig struct {
-	Host string
-	Port int
+	Host               string
+	Port               int
+	LogDir             string `mapstructure:"log_dir"`
+	EnableMetrics      bool   `mapstructure:"enable_metrics"`
+	CertFile           string `mapstructure:"cert_file"`
+	KeyFile            string `mapstructure:"key_file"`
+	CAFile             string `mapstructure:"ca_file"`
+	AcceptV1Signatures bool   `mapstructure:"accept_v1_signatures"`
+	MaxClockSkew       int    `mapstructure:"max_clock_skew"`
+}
+
+// RetentionConfig - retention policy of the finished jobs recorded by the job server.
+// Durations are in days; zero values disable the corresponding rule
+type RetentionConfig struct {
+	KeepDays       int    `mapstructure:"keep_days"`
+	KeepFailedDays int    `mapstructure:"keep_failed_days"`
+	KeepLast       int    `mapstructure:"keep_last"`
+	PruneInterval  int    `mapstructure:"prune_interval"`
+	ArchiveDir     string `mapstructure:"archive_dir"`
+}
+
+// KeyConfig - a key used to sign the requests to the job server, valid for a set of
+// repositories ("*" for all the repositories). MaxPriority is the highest priority of
+// the jobs submitted with the key
+type KeyConfig struct {
+	ID           string
+	Secret       string
+	Repositories []string
+	MaxPriority  int `mapstructure:"max_priority"`
+}
+
+// ScheduleConfig - a recurring job defined in the configuration of the job server. A job
+// is submitted at each time matching the cron expression; MissedRuns is the policy for
+// the runs missed while the server was stopped ("skip" or "run-once")
+type ScheduleConfig struct {
+	Name       string
+	Cron       string
+	Repository string
+	Payload    string
+	LeasePath  string `mapstructure:"lease_path"`
+	JobName    string `mapstructure:"job_name"`
+	Priority   int
+	MissedRuns string `mapstructure:"missed_runs"`
 }
 
 // Config - main configuration object
 type Config struct {
 	SharedKey      string `mapstructure:"shared_key"`
+	KeyID          string `mapstructure:"key_id"`
 	JobWaitTimeout int    `mapstructure:"job_wait_timeout"`
 	Debug          bool
 	LogTimestamps  bool `mapstructure:"log_timestamps"`
+	Keys           []KeyConfig
+	Schedules      []ScheduleConfig
 	Server         ServerConfig
 	Queue          QueueConfig
 	Backend        BackendConfig
+	Retention      RetentionConfig
 	Worker         WorkerConfig
 }
 
@@ -92,6 +154,16 @@ func (o HTTPEndpoints) NewJobs(withBase bool) string {
 	return pt
 }
 
+// JobBatch returns the endpoint for batches of new jobs. If "withBase" is true, the base
+// URL is prepended
+func (o HTTPEndpoints) JobBatch(withBase bool) string {
+	pt := "/jobs/batch"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
 // CompletedJobs returns the endpoint for completed jobs.  If "withBase" is true, the
 // base URL is prepended
 func (o HTTPEndpoints) CompletedJobs(withBase bool) string {
@@ -102,6 +174,106 @@ func (o HTTPEndpoints) CompletedJobs(withBase bool) string {
 	return pt
 }
 
+// JobState returns the endpoint for job state transitions.  If "withBase" is true, the
+// base URL is prepended
+func (o HTTPEndpoints) JobState(withBase bool) string {
+	pt := "/jobs/state"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// CancelJob returns the endpoint for job cancellation.  If "withBase" is true, the base
+// URL is prepended
+func (o HTTPEndpoints) CancelJob(withBase bool) string {
+	pt := "/jobs/cancel"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// JobPriority returns the endpoint for changing the priority of jobs.  If "withBase" is
+// true, the base URL is prepended
+func (o HTTPEndpoints) JobPriority(withBase bool) string {
+	pt := "/jobs/priority"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// Schedules returns the endpoint for listing and creating the job schedules.  If
+// "withBase" is true, the base URL is prepended
+func (o HTTPEndpoints) Schedules(withBase bool) string {
+	pt := "/schedules"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// DeleteSchedule returns the endpoint for deleting job schedules.  If "withBase" is
+// true, the base URL is prepended
+func (o HTTPEndpoints) DeleteSchedule(withBase bool) string {
+	pt := "/schedules/delete"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// JobLogs returns the endpoint for job logs.  If "withBase" is true, the base URL
+// is prepended
+func (o HTTPEndpoints) JobLogs(withBase bool) string {
+	pt := "/jobs/logs"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// Metrics returns the endpoint for the metrics of the server.  If "withBase" is true,
+// the base URL is prepended
+func (o HTTPEndpoints) Metrics(withBase bool) string {
+	pt := "/metrics"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// Jobs returns the endpoint for listing jobs.  If "withBase" is true, the base URL
+// is prepended
+func (o HTTPEndpoints) Jobs(withBase bool) string {
+	pt := "/jobs"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// JobDependencies returns the endpoint for the dependency graph of a job. If "withBase" is
+// true, the base URL is prepended
+func (o HTTPEndpoints) JobDependencies(withBase bool) string {
+	pt := "/jobs/dependencies"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
+// Stats returns the endpoint for the job statistics. If "withBase" is true, the base URL
+// is prepended
+func (o HTTPEndpoints) Stats(withBase bool) string {
+	pt := "/stats"
+	if withBase {
+		return o.base + pt
+	}
+	return pt
+}
+
 // HTTPEndpoints constructs an HTTPEndpoints object
 func (c *Config) HTTPEndpoints() HTTPEndpoints {
 	return newHTTPEndpoints(c.Server.Host, c.Server.Port)
@@ -148,6 +320,12 @@ func readConfigFromViper(v *viper.Viper, cmd *cobra.Command, profile int) (*Conf
 				return nil, errors.Wrap(err, "could not read db configuration")
 			}
 		}
+		retention := v.Sub("retention")
+		if retention != nil {
+			if err := retention.Unmarshal(&cfg.Retention); err != nil {
+				return nil, errors.Wrap(err, "could not read retention configuration")
+			}
+		}
 	}
 
 	if profile == WorkerProfile {
@@ -157,6 +335,15 @@ func readConfigFromViper(v *viper.Viper, cmd *cobra.Command, profile int) (*Conf
 				return nil, errors.Wrap(err, "could not read worker configuration")
 			}
 		}
+
+		// The worker serves all the repositories of the publisher by default
+		if len(cfg.Worker.Repositories) == 0 {
+			repos, err := publisherRepositories(cvmfsRepositoriesDir)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not list the repositories of the publisher")
+			}
+			cfg.Worker.Repositories = repos
+		}
 	}
 
 	// Apply overrides from environment variables (for credentials)
@@ -173,6 +360,26 @@ func readConfigFromViper(v *viper.Viper, cmd *cobra.Command, profile int) (*Conf
 	return cfg, nil
 }
 
+// publisherRepositories returns the names of the repositories configured in a directory,
+// each in its own subdirectory. No repository is returned if the directory doesn't exist
+func publisherRepositories(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	repos := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			repos = append(repos, e.Name())
+		}
+	}
+	return repos, nil
+}
+
 func defaultName() (string, error) {
 	name, err := os.Hostname()
 	if err != nil {
@@ -192,15 +399,28 @@ func newConfig() (*Config, error) {
 	cfg.LogTimestamps = false
 
 	cfg.Server.Port = 8080
+	cfg.Server.LogDir = "/var/lib/conveyor/logs"
+	cfg.Server.EnableMetrics = true
+	cfg.Server.AcceptV1Signatures = true
+	cfg.Server.MaxClockSkew = 300
 
 	cfg.Queue.Port = 5672
 	cfg.Queue.VHost = "/cvmfs/"
 	cfg.Queue.NewJobExchange = "jobs.new"
 	cfg.Queue.NewJobQueue = "jobs.new"
 	cfg.Queue.CompletedJobExchange = "jobs.done"
+	cfg.Queue.DeadLetterExchange = "jobs.dead"
+	cfg.Queue.DeadLetterQueue = "jobs.dead"
+
+	// number of deliveries of a job message to the workers before it is dead-lettered
+	cfg.Queue.MaxDeliveries = 5
 
 	cfg.Backend.Port = 5432
 
+	// finished jobs are kept forever, unless a retention period is set; the
+	// retention policy is applied every hour
+	cfg.Retention.PruneInterval = 3600
+
 	// worker name defaults to the hostname
 	name, err := defaultName()
 	if err != nil {
@@ -215,11 +435,18 @@ func newConfig() (*Config, error) {
 	// and recording it as a failed job
 	cfg.Worker.JobRetries = 3
 
+	// maximum size in bytes of the captured output of a job
+	cfg.Worker.MaxLogSize = 1024 * 1024
+
+	// port of the metrics listener; the listener is disabled when unset
+	cfg.Worker.MetricsPort = 0
+
 	return &cfg, nil
 }
 
 func overrideWithEnvVars(cfg *Config, profile int) {
 	setFromEnvVar(&cfg.SharedKey, "CONVEYOR_SHARED_KEY")
+	setFromEnvVar(&cfg.KeyID, "CONVEYOR_KEY_ID")
 	setFromEnvVar(&cfg.Queue.Username, "CONVEYOR_QUEUE_USER")
 	setFromEnvVar(&cfg.Queue.Password, "CONVEYOR_QUEUE_PASS")
 	if profile == ServerProfile {
@@ -240,8 +467,8 @@ func overrideWithFlags(cfg *Config, cmd *cobra.Command) {
 }
 
 func validateConfig(cfg *Config, profile int) error {
-	if isUnset(cfg.SharedKey) {
-		return errors.New("shared API key is unset")
+	if _, err := newKeyStore(cfg); err != nil {
+		return errors.Wrap(err, "invalid signing keys")
 	}
 
 	if isUnset(cfg.Queue.Username) {
@@ -254,27 +481,83 @@ func validateConfig(cfg *Config, profile int) error {
 		return errors.New("RabbitMQ hostname is unset")
 	}
 
+	if (cfg.Queue.CertFile == "") != (cfg.Queue.KeyFile == "") {
+		return errors.New("RabbitMQ client certificate and key files must be set together")
+	}
+	if !cfg.Queue.TLS && (cfg.Queue.CAFile != "" || cfg.Queue.CertFile != "") {
+		return errors.New("RabbitMQ TLS options are set, but TLS is disabled")
+	}
+	if cfg.Queue.MaxDeliveries <= 0 {
+		return errors.New("maximum number of deliveries of a job must be positive")
+	}
+
 	if profile == ServerProfile {
-		if isUnset(cfg.Backend.Type) {
-			return errors.New("Database type is unset")
+		if (cfg.Server.CertFile == "") != (cfg.Server.KeyFile == "") {
+			return errors.New("server certificate and key files must be set together")
 		}
-		if isUnset(cfg.Backend.Database) {
-			return errors.New("Database name is unset")
+		if cfg.Server.MaxClockSkew <= 0 {
+			return errors.New("maximum clock skew of signed requests must be positive")
 		}
-		if isUnset(cfg.Backend.Username) {
-			return errors.New("Database username is unset")
+		if err := validateBackendConfig(&cfg.Backend); err != nil {
+			return err
 		}
-		if isUnset(cfg.Backend.Password) {
-			return errors.New("Database password is unset")
+		if cfg.Retention.KeepDays < 0 || cfg.Retention.KeepFailedDays < 0 ||
+			cfg.Retention.KeepLast < 0 {
+			return errors.New("job retention periods and counts can't be negative")
 		}
-		if isUnset(cfg.Backend.Host) {
-			return errors.New("Database hostname is unset")
+		if cfg.Retention.PruneInterval <= 0 {
+			return errors.New("job pruning interval must be positive")
 		}
+		names := map[string]bool{}
+		for i := range cfg.Schedules {
+			s := cfg.Schedules[i].schedule()
+			if err := s.validate(); err != nil {
+				return errors.Wrapf(err, "invalid job schedule %q", s.Name)
+			}
+			if names[s.Name] {
+				return fmt.Errorf("job schedule %q is defined twice", s.Name)
+			}
+			names[s.Name] = true
+		}
+	}
+
+	if profile == WorkerProfile && len(cfg.Worker.Repositories) == 0 {
+		return errors.New("worker repositories are unset, and none was found on the publisher")
 	}
 
 	return nil
 }
 
+// validateBackendConfig checks the database settings. A SQLite database only needs the
+// path of its file
+func validateBackendConfig(cfg *BackendConfig) error {
+	if isUnset(cfg.Type) {
+		return errors.New("Database type is unset")
+	}
+	if cfg.Type == memoryBackendType {
+		return nil
+	}
+	if cfg.Type == "sqlite" {
+		if isUnset(cfg.Path) {
+			return errors.New("Database path is unset")
+		}
+		return nil
+	}
+	if isUnset(cfg.Database) {
+		return errors.New("Database name is unset")
+	}
+	if isUnset(cfg.Username) {
+		return errors.New("Database username is unset")
+	}
+	if isUnset(cfg.Password) {
+		return errors.New("Database password is unset")
+	}
+	if isUnset(cfg.Host) {
+		return errors.New("Database hostname is unset")
+	}
+	return nil
+}
+
 func isUnset(v string) bool {
 	return (v == "UNSET" || v == "")
 }
@@ -2,6 +2,9 @@ package cvmfs
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -81,6 +84,7 @@ completed_job_exchange = "cje"
 name = "jeff"
 job_retries = 11
 temp_dir = "/tmp/dir"
+repositories = ["sft.cern.ch", "alice.cern.ch"]
 `
 
 const partialConfig = `
@@ -92,6 +96,27 @@ host = "job.service.host.name"
 port = 1111
 `
 
+const keysConfig = `
+[[keys]]
+id = "sft-2019"
+secret = "secret1"
+repositories = ["sft.cern.ch", "sft-nightlies.cern.ch"]
+
+[[keys]]
+id = "admin"
+secret = "secret2"
+repositories = ["*"]
+
+[server]
+host = "job.service.host.name"
+port = 1111
+
+[queue]
+username = "quser"
+password = "qpass"
+host = "queue.host.name"
+`
+
 const incompleteConfig = `
 # Queue configuration is used by conveyor server
 [queue]
@@ -162,6 +187,25 @@ func TestReadServerConfig(t *testing.T) {
 	}
 }
 
+func TestValidateBackendConfig(t *testing.T) {
+	sqlite := BackendConfig{Type: "sqlite", Path: "/var/lib/conveyor/jobs.db"}
+	if err := validateBackendConfig(&sqlite); err != nil {
+		t.Errorf("SQLite config without connection settings rejected: %v", err)
+	}
+	sqlite.Path = ""
+	if err := validateBackendConfig(&sqlite); err == nil {
+		t.Errorf("SQLite config without path accepted")
+	}
+	postgres := BackendConfig{Type: "postgres", Path: "/var/lib/conveyor/jobs.db"}
+	if err := validateBackendConfig(&postgres); err == nil {
+		t.Errorf("Postgres config without connection settings accepted")
+	}
+	memory := BackendConfig{Type: "memory"}
+	if err := validateBackendConfig(&memory); err != nil {
+		t.Errorf("in-memory config rejected: %v", err)
+	}
+}
+
 func TestReadWorkerConfig(t *testing.T) {
 	v, err := PrepareViperHelper(t, workerConfig)
 	if err != nil {
@@ -183,6 +227,93 @@ func TestReadWorkerConfig(t *testing.T) {
 	if cfg.Worker.JobRetries != 11 {
 		t.Errorf("Invalid max job retries: %v\n", cfg.Worker.JobRetries)
 	}
+
+	if len(cfg.Worker.Repositories) != 2 || cfg.Worker.Repositories[1] != "alice.cern.ch" {
+		t.Errorf("Invalid worker repositories: %v\n", cfg.Worker.Repositories)
+	}
+}
+
+func TestPublisherRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, repo := range []string{"sft.cern.ch", "alice.cern.ch"} {
+		if err := os.Mkdir(filepath.Join(dir, repo), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := publisherRepositories(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 2 || repos[0] != "alice.cern.ch" || repos[1] != "sft.cern.ch" {
+		t.Errorf("Invalid repositories: %v\n", repos)
+	}
+
+	if repos, err := publisherRepositories(filepath.Join(dir, "missing")); err != nil || len(repos) != 0 {
+		t.Errorf("Repositories found in a missing directory: %v, %v\n", repos, err)
+	}
+}
+
+func TestReadKeysConfig(t *testing.T) {
+	v, err := PrepareViperHelper(t, keysConfig)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	cfg, err := readConfigFromViper(v, nil, ClientProfile)
+	if err != nil {
+		t.Fatalf("Could not read config from Viper object: %v", err)
+	}
+
+	if len(cfg.Keys) != 2 {
+		t.Fatalf("Invalid number of keys: %v\n", len(cfg.Keys))
+	}
+	if cfg.Keys[0].ID != "sft-2019" || cfg.Keys[0].Secret != "secret1" ||
+		len(cfg.Keys[0].Repositories) != 2 {
+		t.Errorf("Invalid key: %+v\n", cfg.Keys[0])
+	}
+}
+
+func TestValidateScheduleConfig(t *testing.T) {
+	v, err := PrepareViperHelper(t, serverConfig+`
+[[schedules]]
+name = "nightly"
+cron = "0 3 * * *"
+repository = "sft.cern.ch"
+lease_path = "/lcg_95"
+missed_runs = "run-once"
+`)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+	cfg, err := readConfigFromViper(v, nil, ServerProfile)
+	if err != nil {
+		t.Fatalf("Could not read config from Viper object: %v", err)
+	}
+	if len(cfg.Schedules) != 1 || cfg.Schedules[0].LeasePath != "/lcg_95" ||
+		cfg.Schedules[0].MissedRuns != MissedRunsRunOnce {
+		t.Fatalf("Invalid schedules: %+v\n", cfg.Schedules)
+	}
+	if err := validateConfig(cfg, ServerProfile); err != nil {
+		t.Errorf("Valid schedule rejected: %v", err)
+	}
+
+	cfg.Schedules = append(cfg.Schedules, cfg.Schedules[0])
+	if err := validateConfig(cfg, ServerProfile); err == nil {
+		t.Errorf("Schedule defined twice accepted")
+	}
+	cfg.Schedules = cfg.Schedules[:1]
+	cfg.Schedules[0].Cron = "0 3 * *"
+	if err := validateConfig(cfg, ServerProfile); err == nil {
+		t.Errorf("Schedule with an invalid cron expression accepted")
+	}
 }
 
 func TestHTTPEndpoints(t *testing.T) {
@@ -0,0 +1,189 @@
+package cvmfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronSearchYears bounds the search for the next time matching a cron expression, for
+// the expressions which match rarely (or never, like "0 0 30 2 *")
+const cronSearchYears = 5
+
+// cronMacros are the shorthands accepted in place of the five fields of a cron expression
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// cronExpr is a parsed cron expression, with the five standard fields: minute, hour, day
+// of month, month and day of week. Each field is the set of the values it matches, as a
+// bit set. As in cron, when both day fields are restricted, a day matching either of them
+// matches the expression
+type cronExpr struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// parseCron parses a cron expression: five fields separated by spaces, each a list of
+// values, ranges ("1-5"), or "*", optionally with a step ("*/15", "0-30/10"). Months and
+// days of the week may be given by name ("jan", "mon"), and Sunday is either 0 or 7. The
+// macros @yearly, @monthly, @weekly, @daily and @hourly are accepted too
+func parseCron(expr string) (*cronExpr, error) {
+	if m, ok := cronMacros[strings.ToLower(strings.TrimSpace(expr))]; ok {
+		expr = m
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q doesn't have 5 fields", expr)
+	}
+
+	var c cronExpr
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrap(err, "invalid minute field")
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrap(err, "invalid hour field")
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrap(err, "invalid day of month field")
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, errors.Wrap(err, "invalid month field")
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, errors.Wrap(err, "invalid day of week field")
+	}
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = strings.HasPrefix(fields[2], "*")
+	c.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return &c, nil
+}
+
+// parseCronField parses a field of a cron expression into the set of values it matches,
+// between min and max
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if v, ok := names[strings.ToLower(s)]; ok {
+			return v, nil
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		if v < min || v > max {
+			return 0, fmt.Errorf("value %v is not between %v and %v", v, min, max)
+		}
+		return v, nil
+	}
+
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = s
+		}
+
+		var lo, hi int
+		switch {
+		case rng == "*":
+			lo, hi = min, max
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if lo, err = value(rng[:i]); err != nil {
+				return 0, err
+			}
+			if hi, err = value(rng[i+1:]); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		default:
+			v, err := value(rng)
+			if err != nil {
+				return 0, err
+			}
+			// A single value with a step ("5/15") starts a range up to the maximum
+			lo, hi = v, v
+			if step > 1 {
+				hi = max
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// next returns the first time strictly after t matching the expression, in the time zone
+// of t, or the zero time if there is none in the next few years
+func (c *cronExpr) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !c.has(c.month, int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchDay(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !c.has(c.hour, t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !c.has(c.minute, t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matchDay returns true if the day of t matches the day of month and day of week fields
+func (c *cronExpr) matchDay(t time.Time) bool {
+	dom := c.has(c.dom, t.Day())
+	dow := c.has(c.dow, int(t.Weekday()))
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *cronExpr) has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
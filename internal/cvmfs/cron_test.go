@@ -0,0 +1,70 @@
+package cvmfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// Friday 2019-03-01 10:17
+	t0 := time.Date(2019, 3, 1, 10, 17, 30, 0, time.UTC)
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2019, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", at(3, 1, 10, 18)},
+		{"*/15 * * * *", at(3, 1, 10, 30)},
+		{"5/20 * * * *", at(3, 1, 10, 25)},
+		{"0 3 * * *", at(3, 2, 3, 0)},
+		{"30 9-17 * * *", at(3, 1, 10, 30)},
+		{"0 0,12 * * *", at(3, 1, 12, 0)},
+		{"0 0 * * mon", at(3, 4, 0, 0)},
+		{"0 0 * * 7", at(3, 3, 0, 0)},
+		{"0 0 * * 1-5/2", at(3, 4, 0, 0)},
+		{"0 0 15 * *", at(3, 15, 0, 0)},
+		{"0 0 1 JAN *", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// With both day fields restricted, either one matches
+		{"0 0 10 * sat", at(3, 2, 0, 0)},
+		{"0 0 31 * *", at(3, 31, 0, 0)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", at(3, 1, 11, 0)},
+		{"@daily", at(3, 2, 0, 0)},
+		{"@weekly", at(3, 3, 0, 0)},
+		{"@monthly", at(4, 1, 0, 0)},
+		{"@yearly", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// No match within the search window
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, c := range cases {
+		expr, err := parseCron(c.expr)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		if next := expr.next(t0); !next.Equal(c.next) {
+			t.Errorf("%q: next run at %v, expected %v", c.expr, next, c.next)
+		}
+	}
+
+	// The next run is strictly after the given time
+	expr, _ := parseCron("0 3 * * *")
+	if next := expr.next(at(3, 2, 3, 0)); !next.Equal(at(3, 3, 3, 0)) {
+		t.Errorf("unexpected run after a run: %v", next)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "x * * * *",
+		"* * * foo *", "@never",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("invalid cron expression %q accepted", expr)
+		}
+	}
+}
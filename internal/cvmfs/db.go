@@ -2,16 +2,58 @@ package cvmfs
 
 import (
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+// jobColumns is the list of columns of the Jobs table, in the order expected by scanRow
+const jobColumns = "ID, JobName, Repository, Payload, LeasePath, Dependencies, " +
+	"WorkerName, StartTime, FinishTime, Successful, ErrorMessage, State, SubmitTime, Priority, NotBefore"
+
+// jobAttemptColumns is the list of columns of the JobAttempts table, in the order expected
+// by scanAttemptRow
+const jobAttemptColumns = "JobID, Attempt, WorkerName, StartTime, FinishTime, Successful, " +
+	"Phase, ErrorMessage, ExitCode"
+
+// scheduleColumns is the list of columns of the Schedules table, in the order expected by
+// scanScheduleRow
+const scheduleColumns = "Name, Cron, Job, MissedRuns, Source, CreateTime, LastRun, LastJobID"
+
 type databaseAdapter interface {
 	driverName() string
-	dataSourceName(user, pass, host string, port int, database string) string
+	dataSourceName(cfg *BackendConfig) string
 	schemaVersionQuery() string
+	migrations() []migration
+	createSchemaVersionTableStatement() string
+	schemaHistoryQuery() string
+	currentSchemaVersionQuery() string
+	closeSchemaVersionStatement() string
+	insertSchemaVersionStatement() string
 	jobStatusQuery(numIds int) string
+	listJobsQuery(f *JobFilter) (string, []interface{})
+	insertJobStatement() string
+	updateJobStateStatement() string
+	finishJobStatement() string
+	updateJobPriorityStatement() string
+	pendingDependentsQuery() string
 	insertOrUpdateJobStatement() string
+	insertJobDependencyStatement() string
+	jobDependenciesQuery() string
+	jobDependentsQuery() string
+	repositoriesQuery() string
+	recentJobsQuery() string
+	expiredJobsQuery() string
+	deleteJobStatement() string
+	lastJobAttemptQuery() string
+	insertJobAttemptStatement() string
+	jobAttemptsQuery(numIds int) string
+	jobStatsQuery(f *StatsFilter) (string, []interface{})
+	putScheduleStatement() string
+	schedulesQuery() string
+	deleteScheduleStatement() string
+	updateScheduleRunStatement() string
 }
 
 func newDatabaseAdapter(dbtype string) (databaseAdapter, error) {
@@ -20,6 +62,8 @@ func newDatabaseAdapter(dbtype string) (databaseAdapter, error) {
 		return &mySQLAdapter{}, nil
 	case "postgres":
 		return &postgresAdapter{}, nil
+	case "sqlite":
+		return &sqliteAdapter{}, nil
 	default:
 		return nil, errors.New("unknown database type")
 	}
@@ -33,16 +77,45 @@ func (a *postgresAdapter) driverName() string {
 	return "pgx"
 }
 
-func (a *postgresAdapter) dataSourceName(user, pass, host string, port int, database string) string {
-	return fmt.Sprintf("postgres://%s:%s@%s:%v/%s?sslmode=disable", user, pass, host, port, database)
+func (a *postgresAdapter) dataSourceName(cfg *BackendConfig) string {
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s:%v/%s?sslmode=disable",
+		cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
 }
 
 func (a *postgresAdapter) schemaVersionQuery() string {
 	return "SELECT VersionNumber FROM SchemaVersion WHERE SchemaVersion.ValidTo IS NULL"
 }
 
+func (a *postgresAdapter) migrations() []migration {
+	return postgresMigrations
+}
+
+func (a *postgresAdapter) createSchemaVersionTableStatement() string {
+	return "CREATE TABLE IF NOT EXISTS SchemaVersion (" +
+		"VersionNumber int NOT NULL UNIQUE PRIMARY KEY, " +
+		"ValidFrom timestamp NOT NULL, " +
+		"ValidTo timestamp);"
+}
+
+func (a *postgresAdapter) schemaHistoryQuery() string {
+	return "SELECT VersionNumber, ValidFrom, ValidTo FROM SchemaVersion ORDER BY VersionNumber;"
+}
+
+func (a *postgresAdapter) currentSchemaVersionQuery() string {
+	return "SELECT MAX(VersionNumber) FROM SchemaVersion WHERE ValidTo IS NULL;"
+}
+
+func (a *postgresAdapter) closeSchemaVersionStatement() string {
+	return "UPDATE SchemaVersion SET ValidTo = $1 WHERE ValidTo IS NULL;"
+}
+
+func (a *postgresAdapter) insertSchemaVersionStatement() string {
+	return "INSERT INTO SchemaVersion (VersionNumber, ValidFrom) VALUES ($1, $2);"
+}
+
 func (a *postgresAdapter) jobStatusQuery(numIds int) string {
-	queryStr := "SELECT * FROM Jobs WHERE Jobs.ID IN ("
+	queryStr := "SELECT " + jobColumns + " FROM Jobs WHERE Jobs.ID IN ("
 	for i := 0; i < numIds-1; i++ {
 		queryStr += fmt.Sprintf("$%v, ", i+1)
 	}
@@ -50,15 +123,127 @@ func (a *postgresAdapter) jobStatusQuery(numIds int) string {
 	return queryStr
 }
 
+func (a *postgresAdapter) listJobsQuery(f *JobFilter) (string, []interface{}) {
+	return buildListJobsQuery(f, func(i int) string { return fmt.Sprintf("$%v", i) }, "")
+}
+
+func (a *postgresAdapter) jobStatsQuery(f *StatsFilter) (string, []interface{}) {
+	return buildJobStatsQuery(
+		f, func(i int) string { return fmt.Sprintf("$%v", i) },
+		func(from, to string) string {
+			return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM (%v - %v)) AS double precision)", to, from)
+		})
+}
+
+func (a *postgresAdapter) insertJobStatement() string {
+	return "INSERT INTO Jobs (" + jobColumns + ") " +
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15);"
+}
+
+func (a *postgresAdapter) updateJobStateStatement() string {
+	return "UPDATE Jobs SET State = $1, WorkerName = $2, StartTime = COALESCE($3, StartTime) " +
+		"WHERE ID = $4 AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *postgresAdapter) finishJobStatement() string {
+	return "UPDATE Jobs SET State = $1, Successful = $2, FinishTime = $3, ErrorMessage = $4 " +
+		"WHERE ID = $5 AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *postgresAdapter) updateJobPriorityStatement() string {
+	return "UPDATE Jobs SET Priority = $1 WHERE ID = $2 " +
+		"AND State IN ('submitted', 'waiting-for-dependencies', 'scheduled');"
+}
+
+func (a *postgresAdapter) pendingDependentsQuery() string {
+	return "SELECT Jobs.ID FROM JobDependencies JOIN Jobs ON Jobs.ID = JobDependencies.JobID " +
+		"WHERE JobDependencies.DependencyID = $1 " +
+		"AND Jobs.State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+// The submission time is never overwritten, since it is only known to the server
 func (a *postgresAdapter) insertOrUpdateJobStatement() string {
-	return "INSERT INTO Jobs (ID, JobName, Repository, Payload, LeasePath, Dependencies, " +
-		"WorkerName, StartTime, FinishTime, Successful, ErrorMessage) " +
-		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) " +
+	return "INSERT INTO Jobs (" + jobColumns + ") " +
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15) " +
 		"ON CONFLICT (ID) DO UPDATE " +
 		"SET ID = EXCLUDED.ID, JobName = EXCLUDED.JobName, Repository = EXCLUDED.Repository, " +
 		"Payload = EXCLUDED.Payload, LeasePath = EXCLUDED.LeasePath, Dependencies = EXCLUDED.Dependencies, " +
 		"WorkerName = EXCLUDED.WorkerName, StartTime = EXCLUDED.StartTime, FinishTime = EXCLUDED.FinishTime, " +
-		"Successful = EXCLUDED.Successful, ErrorMessage = EXCLUDED.ErrorMessage;"
+		"Successful = EXCLUDED.Successful, ErrorMessage = EXCLUDED.ErrorMessage, State = EXCLUDED.State, " +
+		"Priority = EXCLUDED.Priority, NotBefore = EXCLUDED.NotBefore;"
+}
+
+// Dependencies on unknown jobs are skipped, and recording a dependency twice is a no-op
+func (a *postgresAdapter) insertJobDependencyStatement() string {
+	return "INSERT INTO JobDependencies (JobID, DependencyID) " +
+		"SELECT CAST($1 AS char(36)), ID FROM Jobs WHERE ID = $2 ON CONFLICT DO NOTHING;"
+}
+
+func (a *postgresAdapter) jobDependenciesQuery() string {
+	return "SELECT DependencyID FROM JobDependencies WHERE JobID = $1;"
+}
+
+func (a *postgresAdapter) jobDependentsQuery() string {
+	return "SELECT JobID FROM JobDependencies WHERE DependencyID = $1;"
+}
+
+func (a *postgresAdapter) repositoriesQuery() string {
+	return "SELECT DISTINCT Repository FROM Jobs;"
+}
+
+// Jobs recorded by workers which predate job states may have no submission time
+func (a *postgresAdapter) recentJobsQuery() string {
+	return "SELECT ID FROM Jobs WHERE Repository = $1 " +
+		"ORDER BY COALESCE(SubmitTime, FinishTime) DESC, ID LIMIT $2;"
+}
+
+func (a *postgresAdapter) expiredJobsQuery() string {
+	return "SELECT " + jobColumns + " FROM Jobs WHERE Repository = $1 " +
+		"AND ((State IN ('succeeded', 'cancelled') AND FinishTime < $2) " +
+		"OR (State = 'failed' AND FinishTime < $3)) " +
+		"ORDER BY FinishTime, ID LIMIT $4 OFFSET $5;"
+}
+
+func (a *postgresAdapter) deleteJobStatement() string {
+	return "DELETE FROM Jobs WHERE ID = $1;"
+}
+
+func (a *postgresAdapter) lastJobAttemptQuery() string {
+	return "SELECT COALESCE(MAX(Attempt), 0) FROM JobAttempts WHERE JobID = $1;"
+}
+
+func (a *postgresAdapter) insertJobAttemptStatement() string {
+	return "INSERT INTO JobAttempts (" + jobAttemptColumns + ") " +
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9);"
+}
+
+func (a *postgresAdapter) jobAttemptsQuery(numIds int) string {
+	queryStr := "SELECT " + jobAttemptColumns + " FROM JobAttempts WHERE JobID IN ("
+	for i := 0; i < numIds-1; i++ {
+		queryStr += fmt.Sprintf("$%v, ", i+1)
+	}
+	queryStr += fmt.Sprintf("$%v) ORDER BY JobID, Attempt;", numIds)
+	return queryStr
+}
+
+// The last run of an existing schedule is kept
+func (a *postgresAdapter) putScheduleStatement() string {
+	return "INSERT INTO Schedules (" + scheduleColumns + ") " +
+		"VALUES ($1,$2,$3,$4,$5,$6,$7,$8) " +
+		"ON CONFLICT (Name) DO UPDATE " +
+		"SET Cron = EXCLUDED.Cron, Job = EXCLUDED.Job, MissedRuns = EXCLUDED.MissedRuns;"
+}
+
+func (a *postgresAdapter) schedulesQuery() string {
+	return "SELECT " + scheduleColumns + " FROM Schedules ORDER BY Name;"
+}
+
+func (a *postgresAdapter) deleteScheduleStatement() string {
+	return "DELETE FROM Schedules WHERE Name = $1;"
+}
+
+func (a *postgresAdapter) updateScheduleRunStatement() string {
+	return "UPDATE Schedules SET LastRun = $1, LastJobID = $2 WHERE Name = $3;"
 }
 
 // MySQLAdapter provides adapted queries and configuration strings for the Postgres driver:
@@ -69,16 +254,47 @@ func (a *mySQLAdapter) driverName() string {
 	return "mysql"
 }
 
-func (a *mySQLAdapter) dataSourceName(user, pass, host string, port int, database string) string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%v)/%s?parseTime=true", user, pass, host, port, database)
+func (a *mySQLAdapter) dataSourceName(cfg *BackendConfig) string {
+	// Found (rather than changed) rows are reported as affected by UPDATE statements,
+	// as with the other drivers
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%v)/%s?parseTime=true&clientFoundRows=true",
+		cfg.Username, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
 }
 
 func (a *mySQLAdapter) schemaVersionQuery() string {
 	return "SELECT VersionNumber FROM SchemaVersion WHERE SchemaVersion.ValidTo IS NULL"
 }
 
+func (a *mySQLAdapter) migrations() []migration {
+	return mySQLMigrations
+}
+
+func (a *mySQLAdapter) createSchemaVersionTableStatement() string {
+	return "CREATE TABLE IF NOT EXISTS SchemaVersion (" +
+		"VersionNumber int NOT NULL UNIQUE PRIMARY KEY, " +
+		"ValidFrom datetime(6) NOT NULL, " +
+		"ValidTo datetime(6) NULL);"
+}
+
+func (a *mySQLAdapter) schemaHistoryQuery() string {
+	return "SELECT VersionNumber, ValidFrom, ValidTo FROM SchemaVersion ORDER BY VersionNumber;"
+}
+
+func (a *mySQLAdapter) currentSchemaVersionQuery() string {
+	return "SELECT MAX(VersionNumber) FROM SchemaVersion WHERE ValidTo IS NULL;"
+}
+
+func (a *mySQLAdapter) closeSchemaVersionStatement() string {
+	return "UPDATE SchemaVersion SET ValidTo = ? WHERE ValidTo IS NULL;"
+}
+
+func (a *mySQLAdapter) insertSchemaVersionStatement() string {
+	return "INSERT INTO SchemaVersion (VersionNumber, ValidFrom) VALUES (?, ?);"
+}
+
 func (a *mySQLAdapter) jobStatusQuery(numIds int) string {
-	queryStr := "SELECT * FROM Jobs WHERE Jobs.ID IN ("
+	queryStr := "SELECT " + jobColumns + " FROM Jobs WHERE Jobs.ID IN ("
 	for i := 0; i < numIds-1; i++ {
 		queryStr += "?, "
 	}
@@ -86,6 +302,419 @@ func (a *mySQLAdapter) jobStatusQuery(numIds int) string {
 	return queryStr
 }
 
+func (a *mySQLAdapter) listJobsQuery(f *JobFilter) (string, []interface{}) {
+	return buildListJobsQuery(f, func(i int) string { return "?" }, "")
+}
+
+func (a *mySQLAdapter) jobStatsQuery(f *StatsFilter) (string, []interface{}) {
+	return buildJobStatsQuery(
+		f, func(i int) string { return "?" },
+		func(from, to string) string {
+			return fmt.Sprintf("TIMESTAMPDIFF(MICROSECOND, %v, %v) / 1000000.0", from, to)
+		})
+}
+
+func (a *mySQLAdapter) insertJobStatement() string {
+	return "INSERT INTO Jobs (" + jobColumns + ") VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);"
+}
+
+func (a *mySQLAdapter) updateJobStateStatement() string {
+	return "UPDATE Jobs SET State = ?, WorkerName = ?, StartTime = COALESCE(?, StartTime) " +
+		"WHERE ID = ? AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *mySQLAdapter) finishJobStatement() string {
+	return "UPDATE Jobs SET State = ?, Successful = ?, FinishTime = ?, ErrorMessage = ? " +
+		"WHERE ID = ? AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *mySQLAdapter) updateJobPriorityStatement() string {
+	return "UPDATE Jobs SET Priority = ? WHERE ID = ? " +
+		"AND State IN ('submitted', 'waiting-for-dependencies', 'scheduled');"
+}
+
+func (a *mySQLAdapter) pendingDependentsQuery() string {
+	return "SELECT Jobs.ID FROM JobDependencies JOIN Jobs ON Jobs.ID = JobDependencies.JobID " +
+		"WHERE JobDependencies.DependencyID = ? " +
+		"AND Jobs.State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+// The submission time is never overwritten, since it is only known to the server
 func (a *mySQLAdapter) insertOrUpdateJobStatement() string {
-	return "REPLACE INTO Jobs VALUES (?,?,?,?,?,?,?,?,?,?,?);"
+	return "INSERT INTO Jobs (" + jobColumns + ") VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) " +
+		"ON DUPLICATE KEY UPDATE " +
+		"JobName = VALUES(JobName), Repository = VALUES(Repository), " +
+		"Payload = VALUES(Payload), LeasePath = VALUES(LeasePath), Dependencies = VALUES(Dependencies), " +
+		"WorkerName = VALUES(WorkerName), StartTime = VALUES(StartTime), FinishTime = VALUES(FinishTime), " +
+		"Successful = VALUES(Successful), ErrorMessage = VALUES(ErrorMessage), State = VALUES(State), " +
+		"Priority = VALUES(Priority), NotBefore = VALUES(NotBefore);"
+}
+
+// Dependencies on unknown jobs are skipped, and recording a dependency twice is a no-op
+func (a *mySQLAdapter) insertJobDependencyStatement() string {
+	return "INSERT IGNORE INTO JobDependencies (JobID, DependencyID) " +
+		"SELECT ?, ID FROM Jobs WHERE ID = ?;"
+}
+
+func (a *mySQLAdapter) jobDependenciesQuery() string {
+	return "SELECT DependencyID FROM JobDependencies WHERE JobID = ?;"
+}
+
+func (a *mySQLAdapter) jobDependentsQuery() string {
+	return "SELECT JobID FROM JobDependencies WHERE DependencyID = ?;"
+}
+
+func (a *mySQLAdapter) repositoriesQuery() string {
+	return "SELECT DISTINCT Repository FROM Jobs;"
+}
+
+// Jobs recorded by workers which predate job states may have no submission time
+func (a *mySQLAdapter) recentJobsQuery() string {
+	return "SELECT ID FROM Jobs WHERE Repository = ? " +
+		"ORDER BY COALESCE(SubmitTime, FinishTime) DESC, ID LIMIT ?;"
+}
+
+func (a *mySQLAdapter) expiredJobsQuery() string {
+	return "SELECT " + jobColumns + " FROM Jobs WHERE Repository = ? " +
+		"AND ((State IN ('succeeded', 'cancelled') AND FinishTime < ?) " +
+		"OR (State = 'failed' AND FinishTime < ?)) " +
+		"ORDER BY FinishTime, ID LIMIT ? OFFSET ?;"
+}
+
+func (a *mySQLAdapter) deleteJobStatement() string {
+	return "DELETE FROM Jobs WHERE ID = ?;"
+}
+
+func (a *mySQLAdapter) lastJobAttemptQuery() string {
+	return "SELECT COALESCE(MAX(Attempt), 0) FROM JobAttempts WHERE JobID = ?;"
+}
+
+func (a *mySQLAdapter) insertJobAttemptStatement() string {
+	return "INSERT INTO JobAttempts (" + jobAttemptColumns + ") " +
+		"VALUES (?,?,?,?,?,?,?,?,?);"
+}
+
+func (a *mySQLAdapter) jobAttemptsQuery(numIds int) string {
+	queryStr := "SELECT " + jobAttemptColumns + " FROM JobAttempts WHERE JobID IN ("
+	for i := 0; i < numIds-1; i++ {
+		queryStr += "?, "
+	}
+	queryStr += "?) ORDER BY JobID, Attempt;"
+	return queryStr
+}
+
+// The last run of an existing schedule is kept
+func (a *mySQLAdapter) putScheduleStatement() string {
+	return "INSERT INTO Schedules (" + scheduleColumns + ") " +
+		"VALUES (?,?,?,?,?,?,?,?) " +
+		"ON DUPLICATE KEY UPDATE " +
+		"Cron = VALUES(Cron), Job = VALUES(Job), MissedRuns = VALUES(MissedRuns);"
+}
+
+func (a *mySQLAdapter) schedulesQuery() string {
+	return "SELECT " + scheduleColumns + " FROM Schedules ORDER BY Name;"
+}
+
+func (a *mySQLAdapter) deleteScheduleStatement() string {
+	return "DELETE FROM Schedules WHERE Name = ?;"
+}
+
+func (a *mySQLAdapter) updateScheduleRunStatement() string {
+	return "UPDATE Schedules SET LastRun = ?, LastJobID = ? WHERE Name = ?;"
+}
+
+// sqliteAdapter provides adapted queries and configuration strings for the SQLite driver:
+// https://github.com/mattn/go-sqlite3
+// The driver is only registered in builds with the "sqlite" tag, since it requires cgo
+type sqliteAdapter struct{}
+
+func (a *sqliteAdapter) driverName() string {
+	return "sqlite3"
+}
+
+// Writers wait for each other instead of failing when the database is locked, and
+// transactions take the write lock when they begin, so that concurrent transactions
+// can't deadlock when upgrading their lock. Foreign keys are only enforced on request
+func (a *sqliteAdapter) dataSourceName(cfg *BackendConfig) string {
+	return fmt.Sprintf(
+		"file:%s?_busy_timeout=10000&_journal_mode=WAL&_txlock=immediate&_foreign_keys=1",
+		cfg.Path)
+}
+
+func (a *sqliteAdapter) schemaVersionQuery() string {
+	return "SELECT VersionNumber FROM SchemaVersion WHERE SchemaVersion.ValidTo IS NULL"
+}
+
+func (a *sqliteAdapter) migrations() []migration {
+	return sqliteMigrations
+}
+
+func (a *sqliteAdapter) createSchemaVersionTableStatement() string {
+	return "CREATE TABLE IF NOT EXISTS SchemaVersion (" +
+		"VersionNumber integer NOT NULL UNIQUE PRIMARY KEY, " +
+		"ValidFrom timestamp NOT NULL, " +
+		"ValidTo timestamp);"
+}
+
+func (a *sqliteAdapter) schemaHistoryQuery() string {
+	return "SELECT VersionNumber, ValidFrom, ValidTo FROM SchemaVersion ORDER BY VersionNumber;"
+}
+
+func (a *sqliteAdapter) currentSchemaVersionQuery() string {
+	return "SELECT MAX(VersionNumber) FROM SchemaVersion WHERE ValidTo IS NULL;"
+}
+
+func (a *sqliteAdapter) closeSchemaVersionStatement() string {
+	return "UPDATE SchemaVersion SET ValidTo = ? WHERE ValidTo IS NULL;"
+}
+
+func (a *sqliteAdapter) insertSchemaVersionStatement() string {
+	return "INSERT INTO SchemaVersion (VersionNumber, ValidFrom) VALUES (?, ?);"
+}
+
+func (a *sqliteAdapter) jobStatusQuery(numIds int) string {
+	queryStr := "SELECT " + jobColumns + " FROM Jobs WHERE Jobs.ID IN ("
+	for i := 0; i < numIds-1; i++ {
+		queryStr += "?, "
+	}
+	queryStr += "?);"
+	return queryStr
+}
+
+// SQLite has no default escape character for LIKE patterns
+func (a *sqliteAdapter) listJobsQuery(f *JobFilter) (string, []interface{}) {
+	return buildListJobsQuery(f, func(i int) string { return "?" }, ` ESCAPE '\'`)
+}
+
+func (a *sqliteAdapter) jobStatsQuery(f *StatsFilter) (string, []interface{}) {
+	return buildJobStatsQuery(
+		f, func(i int) string { return "?" },
+		func(from, to string) string {
+			return fmt.Sprintf("(julianday(%v) - julianday(%v)) * 86400.0", to, from)
+		})
+}
+
+func (a *sqliteAdapter) insertJobStatement() string {
+	return "INSERT INTO Jobs (" + jobColumns + ") VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?);"
+}
+
+func (a *sqliteAdapter) updateJobStateStatement() string {
+	return "UPDATE Jobs SET State = ?, WorkerName = ?, StartTime = COALESCE(?, StartTime) " +
+		"WHERE ID = ? AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *sqliteAdapter) finishJobStatement() string {
+	return "UPDATE Jobs SET State = ?, Successful = ?, FinishTime = ?, ErrorMessage = ? " +
+		"WHERE ID = ? AND State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+func (a *sqliteAdapter) updateJobPriorityStatement() string {
+	return "UPDATE Jobs SET Priority = ? WHERE ID = ? " +
+		"AND State IN ('submitted', 'waiting-for-dependencies', 'scheduled');"
+}
+
+func (a *sqliteAdapter) pendingDependentsQuery() string {
+	return "SELECT Jobs.ID FROM JobDependencies JOIN Jobs ON Jobs.ID = JobDependencies.JobID " +
+		"WHERE JobDependencies.DependencyID = ? " +
+		"AND Jobs.State NOT IN ('succeeded', 'failed', 'cancelled');"
+}
+
+// The submission time is never overwritten, since it is only known to the server
+func (a *sqliteAdapter) insertOrUpdateJobStatement() string {
+	return "INSERT INTO Jobs (" + jobColumns + ") VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?) " +
+		"ON CONFLICT (ID) DO UPDATE " +
+		"SET JobName = excluded.JobName, Repository = excluded.Repository, " +
+		"Payload = excluded.Payload, LeasePath = excluded.LeasePath, Dependencies = excluded.Dependencies, " +
+		"WorkerName = excluded.WorkerName, StartTime = excluded.StartTime, FinishTime = excluded.FinishTime, " +
+		"Successful = excluded.Successful, ErrorMessage = excluded.ErrorMessage, State = excluded.State, " +
+		"Priority = excluded.Priority, NotBefore = excluded.NotBefore;"
+}
+
+// Dependencies on unknown jobs are skipped, and recording a dependency twice is a no-op
+func (a *sqliteAdapter) insertJobDependencyStatement() string {
+	return "INSERT OR IGNORE INTO JobDependencies (JobID, DependencyID) " +
+		"SELECT ?, ID FROM Jobs WHERE ID = ?;"
+}
+
+func (a *sqliteAdapter) jobDependenciesQuery() string {
+	return "SELECT DependencyID FROM JobDependencies WHERE JobID = ?;"
+}
+
+func (a *sqliteAdapter) jobDependentsQuery() string {
+	return "SELECT JobID FROM JobDependencies WHERE DependencyID = ?;"
+}
+
+func (a *sqliteAdapter) repositoriesQuery() string {
+	return "SELECT DISTINCT Repository FROM Jobs;"
+}
+
+// Jobs recorded by workers which predate job states may have no submission time
+func (a *sqliteAdapter) recentJobsQuery() string {
+	return "SELECT ID FROM Jobs WHERE Repository = ? " +
+		"ORDER BY COALESCE(SubmitTime, FinishTime) DESC, ID LIMIT ?;"
+}
+
+func (a *sqliteAdapter) expiredJobsQuery() string {
+	return "SELECT " + jobColumns + " FROM Jobs WHERE Repository = ? " +
+		"AND ((State IN ('succeeded', 'cancelled') AND FinishTime < ?) " +
+		"OR (State = 'failed' AND FinishTime < ?)) " +
+		"ORDER BY FinishTime, ID LIMIT ? OFFSET ?;"
+}
+
+func (a *sqliteAdapter) deleteJobStatement() string {
+	return "DELETE FROM Jobs WHERE ID = ?;"
+}
+
+func (a *sqliteAdapter) lastJobAttemptQuery() string {
+	return "SELECT COALESCE(MAX(Attempt), 0) FROM JobAttempts WHERE JobID = ?;"
+}
+
+func (a *sqliteAdapter) insertJobAttemptStatement() string {
+	return "INSERT INTO JobAttempts (" + jobAttemptColumns + ") " +
+		"VALUES (?,?,?,?,?,?,?,?,?);"
+}
+
+func (a *sqliteAdapter) jobAttemptsQuery(numIds int) string {
+	queryStr := "SELECT " + jobAttemptColumns + " FROM JobAttempts WHERE JobID IN ("
+	for i := 0; i < numIds-1; i++ {
+		queryStr += "?, "
+	}
+	queryStr += "?) ORDER BY JobID, Attempt;"
+	return queryStr
+}
+
+// The last run of an existing schedule is kept
+func (a *sqliteAdapter) putScheduleStatement() string {
+	return "INSERT INTO Schedules (" + scheduleColumns + ") " +
+		"VALUES (?,?,?,?,?,?,?,?) " +
+		"ON CONFLICT (Name) DO UPDATE " +
+		"SET Cron = excluded.Cron, Job = excluded.Job, MissedRuns = excluded.MissedRuns;"
+}
+
+func (a *sqliteAdapter) schedulesQuery() string {
+	return "SELECT " + scheduleColumns + " FROM Schedules ORDER BY Name;"
+}
+
+func (a *sqliteAdapter) deleteScheduleStatement() string {
+	return "DELETE FROM Schedules WHERE Name = ?;"
+}
+
+func (a *sqliteAdapter) updateScheduleRunStatement() string {
+	return "UPDATE Schedules SET LastRun = ?, LastJobID = ? WHERE Name = ?;"
+}
+
+// buildListJobsQuery creates the job listing query corresponding to a filter, together
+// with its parameters. The "placeholder" function returns the driver-specific
+// placeholder for the i-th (1-based) query parameter. "likeEscape" is appended to the
+// LIKE conditions, for the databases without a default escape character. One row more
+// than the page size is requested, to find out if there are more results
+func buildListJobsQuery(
+	f *JobFilter, placeholder func(i int) string, likeEscape string) (string, []interface{}) {
+
+	conditions := []string{}
+	params := []interface{}{}
+	add := func(condition string, param interface{}) {
+		params = append(params, param)
+		conditions = append(conditions, fmt.Sprintf(condition, placeholder(len(params))))
+	}
+
+	if f.Repository != "" {
+		add("Repository = %v", f.Repository)
+	}
+	if f.JobName != "" {
+		add("JobName = %v", f.JobName)
+	}
+	if f.WorkerName != "" {
+		add("WorkerName = %v", f.WorkerName)
+	}
+	if f.State != "" {
+		add("State = %v", f.State)
+	}
+	if f.Successful != nil {
+		add("Successful = %v", *f.Successful)
+	}
+	if f.LeasePathPrefix != "" {
+		add("LeasePath LIKE %v"+likeEscape, escapeLikePattern(f.LeasePathPrefix)+"%")
+	}
+	if !f.StartedAfter.IsZero() {
+		add("StartTime >= %v", f.StartedAfter)
+	}
+	if !f.StartedBefore.IsZero() {
+		add("StartTime < %v", f.StartedBefore)
+	}
+	if !f.FinishedAfter.IsZero() {
+		add("FinishTime >= %v", f.FinishedAfter)
+	}
+	if !f.FinishedBefore.IsZero() {
+		add("FinishTime < %v", f.FinishedBefore)
+	}
+
+	queryStr := "SELECT " + jobColumns + " FROM Jobs"
+	if len(conditions) > 0 {
+		queryStr += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	queryStr += fmt.Sprintf(
+		" ORDER BY SubmitTime DESC, ID LIMIT %v OFFSET %v;", f.Limit+1, f.Offset)
+
+	return queryStr, params
+}
+
+// buildJobStatsQuery creates the query returning the jobs finished in the time window
+// of a filter, with their group key, run time and queue wait time (in seconds, NULL when
+// unknown), together with its parameters. "seconds" returns the driver-specific
+// expression of the number of seconds between two timestamp columns
+func buildJobStatsQuery(
+	f *StatsFilter, placeholder func(i int) string,
+	seconds func(from, to string) string) (string, []interface{}) {
+
+	groupColumn := "Repository"
+	if f.GroupBy == StatsGroupByWorker {
+		groupColumn = "WorkerName"
+	}
+
+	params := []interface{}{f.From, f.To}
+	queryStr := fmt.Sprintf(
+		"SELECT %v, State, WorkerName, LeasePath, %v, %v FROM Jobs "+
+			"WHERE FinishTime >= %v AND FinishTime < %v",
+		groupColumn, seconds("StartTime", "FinishTime"), seconds("SubmitTime", "StartTime"),
+		placeholder(1), placeholder(2))
+	if f.Repository != "" {
+		params = append(params, f.Repository)
+		queryStr += fmt.Sprintf(" AND Repository = %v", placeholder(len(params)))
+	}
+	queryStr += ";"
+
+	return queryStr, params
+}
+
+// escapeLikePattern escapes the wildcard characters of a LIKE pattern
+func escapeLikePattern(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return r.Replace(s)
+}
+
+// nullTime scans a nullable timestamp column into a time.Time; NULL values are
+// mapped to the zero time
+type nullTime struct {
+	t *time.Time
+}
+
+func (n nullTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*n.t = time.Time{}
+	case time.Time:
+		*n.t = v
+	default:
+		return fmt.Errorf("cannot scan %T into a timestamp", value)
+	}
+	return nil
+}
+
+// timeOrNull maps the zero time to a NULL column value
+func timeOrNull(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
 }
@@ -0,0 +1,96 @@
+package cvmfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListJobsQuery(t *testing.T) {
+	t.Run("no filter", func(t *testing.T) {
+		a := &postgresAdapter{}
+		q, params := a.listJobsQuery(&JobFilter{Limit: 10})
+		expected := "SELECT " + jobColumns + " FROM Jobs ORDER BY SubmitTime DESC, ID LIMIT 11 OFFSET 0;"
+		if q != expected {
+			t.Errorf("invalid query: %v", q)
+		}
+		if len(params) != 0 {
+			t.Errorf("unexpected query parameters: %v", params)
+		}
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		a := &postgresAdapter{}
+		success := false
+		f := JobFilter{
+			Repository:      "sft.cern.ch",
+			Successful:      &success,
+			LeasePathPrefix: "/lcg_95",
+			FinishedAfter:   time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+			Limit:           50,
+			Offset:          100,
+		}
+		q, params := a.listJobsQuery(&f)
+		expected := "SELECT " + jobColumns + " FROM Jobs WHERE Repository = $1 AND Successful = $2 " +
+			"AND LeasePath LIKE $3 AND FinishTime >= $4 " +
+			"ORDER BY SubmitTime DESC, ID LIMIT 51 OFFSET 100;"
+		if q != expected {
+			t.Errorf("invalid query: %v", q)
+		}
+		if len(params) != 4 {
+			t.Fatalf("invalid number of query parameters: %v", len(params))
+		}
+		if params[2] != `/lcg\_95%` {
+			t.Errorf("invalid lease path pattern: %v", params[2])
+		}
+	})
+
+	t.Run("mysql", func(t *testing.T) {
+		a := &mySQLAdapter{}
+		f := JobFilter{WorkerName: "publisher1", JobName: "nightly", Limit: 5}
+		q, params := a.listJobsQuery(&f)
+		expected := "SELECT " + jobColumns + " FROM Jobs WHERE JobName = ? AND WorkerName = ? " +
+			"ORDER BY SubmitTime DESC, ID LIMIT 6 OFFSET 0;"
+		if q != expected {
+			t.Errorf("invalid query: %v", q)
+		}
+		if len(params) != 2 || params[0] != "nightly" || params[1] != "publisher1" {
+			t.Errorf("invalid query parameters: %v", params)
+		}
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		a := &sqliteAdapter{}
+		f := JobFilter{LeasePathPrefix: "/lcg_95", Limit: 5}
+		q, params := a.listJobsQuery(&f)
+		expected := "SELECT " + jobColumns + " FROM Jobs WHERE LeasePath LIKE ? ESCAPE '\\' " +
+			"ORDER BY SubmitTime DESC, ID LIMIT 6 OFFSET 0;"
+		if q != expected {
+			t.Errorf("invalid query: %v", q)
+		}
+		if len(params) != 1 || params[0] != `/lcg\_95%` {
+			t.Errorf("invalid query parameters: %v", params)
+		}
+	})
+}
+
+func TestJobStatsQuery(t *testing.T) {
+	f := StatsFilter{
+		From:       time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2019, 3, 2, 0, 0, 0, 0, time.UTC),
+		Repository: "sft.cern.ch",
+		GroupBy:    StatsGroupByWorker,
+	}
+
+	a := &postgresAdapter{}
+	q, params := a.jobStatsQuery(&f)
+	expected := "SELECT WorkerName, State, WorkerName, LeasePath, " +
+		"CAST(EXTRACT(EPOCH FROM (FinishTime - StartTime)) AS double precision), " +
+		"CAST(EXTRACT(EPOCH FROM (StartTime - SubmitTime)) AS double precision) FROM Jobs " +
+		"WHERE FinishTime >= $1 AND FinishTime < $2 AND Repository = $3;"
+	if q != expected {
+		t.Errorf("invalid query: %v", q)
+	}
+	if len(params) != 3 || params[2] != "sft.cern.ch" {
+		t.Errorf("invalid query parameters: %v", params)
+	}
+}
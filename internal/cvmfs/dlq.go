@@ -0,0 +1,211 @@
+package cvmfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// DeadLetter is a job message in the dead-letter queue
+type DeadLetter struct {
+	Job              UnprocessedJob
+	Exchange         string
+	RoutingKey       string
+	Queue            string
+	Reason           string
+	Count            int64
+	Time             time.Time
+	FailedDeliveries int
+	Error            string `json:",omitempty"`
+}
+
+// DeadLetterClient inspects, requeues and purges the messages of the dead-letter queue
+type DeadLetterClient struct {
+	qcl   *QueueClient
+	queue string
+}
+
+// NewDeadLetterClient connects to the queue to manage the dead-letter queue
+func NewDeadLetterClient(cfg *Config) (*DeadLetterClient, error) {
+	q, err := NewQueueClient(&cfg.Queue, publisherConnection)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create queue connection")
+	}
+	return &DeadLetterClient{qcl: q, queue: cfg.Queue.DeadLetterQueue}, nil
+}
+
+// Close the connection to the queue
+func (c *DeadLetterClient) Close() {
+	c.qcl.Close()
+}
+
+// List returns the messages of the dead-letter queue, which are left in the queue
+func (c *DeadLetterClient) List() ([]DeadLetter, error) {
+	letters := []DeadLetter{}
+	err := c.visit(func(msg *amqp.Delivery, letter *DeadLetter) (bool, error) {
+		letters = append(letters, *letter)
+		return false, nil
+	})
+	return letters, err
+}
+
+// Requeue publishes again the messages of the jobs with the given IDs, or all the
+// messages if no ID is given, to the exchange where they were first published, and
+// removes them from the dead-letter queue. Returns the number of requeued messages
+func (c *DeadLetterClient) Requeue(ids []string) (int, error) {
+	n := 0
+	err := c.visit(func(msg *amqp.Delivery, letter *DeadLetter) (bool, error) {
+		if !matchDeadLetter(letter, ids) {
+			return false, nil
+		}
+
+		// The count of failed deliveries starts again from zero
+		headers := amqp.Table{}
+		for k, v := range msg.Headers {
+			if k != failedDeliveriesHeader {
+				headers[k] = v
+			}
+		}
+		requeued := amqp.Publishing{
+			Headers:      headers,
+			DeliveryMode: amqp.Persistent,
+			Priority:     msg.Priority,
+			Timestamp:    msg.Timestamp,
+			ContentType:  msg.ContentType,
+			Body:         msg.Body,
+		}
+		if err := c.qcl.publishMessage(letter.Exchange, letter.RoutingKey, requeued); err != nil {
+			return false, errors.Wrap(err, "could not requeue job message")
+		}
+		if err := msg.Ack(false); err != nil {
+			return false, errors.Wrap(err, "could not remove job message from dead-letter queue")
+		}
+		n++
+		return true, nil
+	})
+	return n, err
+}
+
+// Purge deletes the messages of the jobs with the given IDs from the dead-letter queue,
+// or all the messages if no ID is given. Returns the number of deleted messages
+func (c *DeadLetterClient) Purge(ids []string) (int, error) {
+	if len(ids) == 0 {
+		c.qcl.mu.Lock()
+		ch := c.qcl.ch
+		c.qcl.mu.Unlock()
+		if ch == nil {
+			return 0, errQueueDisconnected
+		}
+		n, err := ch.QueuePurge(c.queue, false)
+		if err != nil {
+			return 0, errors.Wrap(err, "could not purge dead-letter queue")
+		}
+		return n, nil
+	}
+
+	n := 0
+	err := c.visit(func(msg *amqp.Delivery, letter *DeadLetter) (bool, error) {
+		if !matchDeadLetter(letter, ids) {
+			return false, nil
+		}
+		if err := msg.Ack(false); err != nil {
+			return false, errors.Wrap(err, "could not remove job message from dead-letter queue")
+		}
+		n++
+		return true, nil
+	})
+	return n, err
+}
+
+// visit gets the messages of the dead-letter queue one by one and calls f on each of
+// them. f returns true if it acknowledged the message; the other messages are returned
+// to the queue afterwards
+func (c *DeadLetterClient) visit(
+	f func(msg *amqp.Delivery, letter *DeadLetter) (bool, error)) error {
+	c.qcl.mu.Lock()
+	ch := c.qcl.ch
+	c.qcl.mu.Unlock()
+	if ch == nil {
+		return errQueueDisconnected
+	}
+
+	// The messages which were got are not delivered again until they are rejected. They
+	// are rejected together, up to the last one which was not acknowledged: rejecting an
+	// acknowledged message is a protocol error, which closes the channel
+	var lastUnacked uint64
+	defer func() {
+		if lastUnacked > 0 {
+			if err := ch.Nack(lastUnacked, true, true); err != nil {
+				Log.Error().Err(err).Msg("could not return messages to dead-letter queue")
+			}
+		}
+	}()
+
+	for {
+		msg, ok, err := ch.Get(c.queue, false)
+		if err != nil {
+			return errors.Wrap(err, "could not get message from dead-letter queue")
+		}
+		if !ok {
+			return nil
+		}
+		letter := newDeadLetter(&msg)
+		acked, err := f(&msg, &letter)
+		if !acked {
+			lastUnacked = msg.DeliveryTag
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newDeadLetter decodes a message of the dead-letter queue. The origin of the message
+// and the reason it was dead-lettered are taken from the most recent entry of the
+// "x-death" header added by the broker
+func newDeadLetter(msg *amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		Exchange:         msg.Exchange,
+		RoutingKey:       msg.RoutingKey,
+		FailedDeliveries: failedDeliveries(msg),
+	}
+
+	if deaths, ok := msg.Headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			if v, ok := death["exchange"].(string); ok {
+				letter.Exchange = v
+			}
+			if keys, ok := death["routing-keys"].([]interface{}); ok && len(keys) > 0 {
+				if v, ok := keys[0].(string); ok {
+					letter.RoutingKey = v
+				}
+			}
+			letter.Queue, _ = death["queue"].(string)
+			letter.Reason, _ = death["reason"].(string)
+			letter.Count, _ = death["count"].(int64)
+			letter.Time, _ = death["time"].(time.Time)
+		}
+	}
+
+	if err := json.Unmarshal(msg.Body, &letter.Job); err != nil {
+		letter.Error = "invalid job description: " + err.Error()
+	}
+
+	return letter
+}
+
+// matchDeadLetter returns true if the job of a dead-lettered message is one of the
+// given jobs, or if no job is given
+func matchDeadLetter(letter *DeadLetter, ids []string) bool {
+	if len(ids) == 0 {
+		return true
+	}
+	for _, id := range ids {
+		if letter.Job.ID.String() == id {
+			return true
+		}
+	}
+	return false
+}
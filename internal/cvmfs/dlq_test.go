@@ -0,0 +1,82 @@
+package cvmfs
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+func TestNewDeadLetter(t *testing.T) {
+	job := UnprocessedJob{ID: uuid.New(), JobSpecification: JobSpecification{
+		Repository: "sft.cern.ch", LeasePath: "/lcg_95"}}
+	body, err := json.Marshal(&job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	msg := amqp.Delivery{
+		Exchange:   "jobs.dead",
+		RoutingKey: "",
+		Body:       body,
+		Headers: amqp.Table{
+			failedDeliveriesHeader: int32(4),
+			"x-death": []interface{}{
+				amqp.Table{
+					"exchange":     "jobs.new",
+					"routing-keys": []interface{}{"sft.cern.ch"},
+					"queue":        "jobs.new",
+					"reason":       "rejected",
+					"count":        int64(1),
+					"time":         t0,
+				},
+			},
+		},
+	}
+
+	letter := newDeadLetter(&msg)
+	if letter.Job.ID != job.ID || letter.Job.LeasePath != "/lcg_95" || letter.Error != "" {
+		t.Errorf("invalid job: %+v", letter)
+	}
+	if letter.Exchange != "jobs.new" || letter.RoutingKey != "sft.cern.ch" {
+		t.Errorf("invalid origin of the message: %+v", letter)
+	}
+	if letter.Queue != "jobs.new" || letter.Reason != "rejected" || letter.Count != 1 ||
+		!letter.Time.Equal(t0) || letter.FailedDeliveries != 4 {
+		t.Errorf("invalid dead-lettering details: %+v", letter)
+	}
+
+	if !matchDeadLetter(&letter, nil) || !matchDeadLetter(&letter, []string{job.ID.String()}) {
+		t.Errorf("dead letter not matched")
+	}
+	if matchDeadLetter(&letter, []string{uuid.New().String()}) {
+		t.Errorf("dead letter matched by another job ID")
+	}
+
+	// A message which is not a job description is still listed
+	msg.Body = []byte("not JSON")
+	if letter := newDeadLetter(&msg); letter.Error == "" {
+		t.Errorf("invalid job description not reported")
+	}
+}
+
+func TestFailedDeliveries(t *testing.T) {
+	cases := []struct {
+		headers amqp.Table
+		failed  int
+	}{
+		{nil, 0},
+		{amqp.Table{failedDeliveriesHeader: int32(2)}, 2},
+		{amqp.Table{failedDeliveriesHeader: int64(3)}, 3},
+		{amqp.Table{failedDeliveriesHeader: "x"}, 0},
+	}
+	for _, c := range cases {
+		msg := amqp.Delivery{Headers: c.headers}
+		if n := failedDeliveries(&msg); n != c.failed {
+			t.Errorf("failed deliveries of %v: %v, expected %v", c.headers, n, c.failed)
+		}
+	}
+}
@@ -55,7 +55,8 @@ func downloadFile(destDir, src string, timeoutSec int) error {
 	}
 
 	client := http.Client{
-		Timeout: time.Duration(timeoutSec) * time.Second,
+		Transport: httpClient.Transport,
+		Timeout:   time.Duration(timeoutSec) * time.Second,
 	}
 	rep, err := client.Get(src)
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -25,8 +26,16 @@ func serve(quit <-chan struct{}) <-chan struct{} {
 		Handler: http.HandlerFunc(hd),
 	}
 
+	// Bind the listener before returning, so that the tests don't race the server
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
-		log.Fatal(srv.ListenAndServe())
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
 	wait := make(chan struct{})
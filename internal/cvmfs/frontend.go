@@ -1,6 +1,7 @@
 package cvmfs
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"time"
@@ -11,16 +12,68 @@ import (
 
 // startFrontEnd initializes the HTTP frontend of the job server
 func startFrontEnd(cfg *Config, backend *serverBackend) error {
+	router, err := newRouter(cfg, backend)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:      router,
+		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	if cfg.Server.CertFile == "" {
+		if err := srv.ListenAndServe(); err != nil {
+			return errors.Wrap(err, "front-end server error")
+		}
+		return nil
+	}
+
+	// The certificate is reloaded when its files are modified
+	certs, err := newCertReloader(cfg.Server.CertFile, cfg.Server.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not load server certificate")
+	}
+	srv.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		return errors.Wrap(err, "front-end server error")
+	}
+
+	return nil
+}
+
+// newRouter creates the router of the job server, with all the routes of the API
+func newRouter(cfg *Config, backend *serverBackend) (*mux.Router, error) {
 	endpoints := cfg.HTTPEndpoints()
 
-	router := mux.NewRouter()
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signing keys")
+	}
 
-	// Add the HMAC authorization middleware
-	authz := hmacAuthorization{cfg.SharedKey}
-	router.Use(authz.Middleware)
+	router := mux.NewRouter()
 
 	var r *mux.Route
-	r = router.NewRoute()
+
+	// GET the metrics of the server. The metrics are not protected by the HMAC
+	// authorization, so that they can be collected by Prometheus
+	if cfg.Server.EnableMetrics {
+		r = router.NewRoute()
+		r.Path(endpoints.Metrics(false))
+		r.Methods("GET")
+		r.Handler(metricsHandler(serverRegistry))
+	}
+
+	// The API routes record their latency and require HMAC authorization
+	api := router.NewRoute().Subrouter()
+	api.Use(httpMetrics)
+	authz := hmacAuthorization{newSignatureVerifier(keys, &cfg.Server)}
+	api.Use(authz.Middleware)
+
+	r = api.NewRoute()
 	r.Path("/")
 	r.HandlerFunc(
 		func(w http.ResponseWriter, h *http.Request) {
@@ -31,39 +84,121 @@ func startFrontEnd(cfg *Config, backend *serverBackend) error {
 		})
 
 	// POST a new job
-	r = router.NewRoute()
+	r = api.NewRoute()
 	r.Path(endpoints.NewJobs(false))
 	r.Methods("POST")
 	r.Headers("Content-Type", "application/json")
 	r.Headers("Authorization", "")
 	r.HandlerFunc(makePutNewJobHandler(backend))
 
+	// POST a batch of new jobs
+	r = api.NewRoute()
+	r.Path(endpoints.JobBatch(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makePutJobBatchHandler(backend))
+
 	// GET the status of multiple completed jobs
-	r = router.NewRoute()
+	r = api.NewRoute()
 	r.Path(endpoints.CompletedJobs(false))
 	r.Methods("GET")
 	r.Queries("id", "", "full", "")
 	r.Headers("Authorization", "")
 	r.HandlerFunc(makeGetJobStatusHandler(backend))
 
+	// GET a filtered list of jobs
+	r = api.NewRoute()
+	r.Path(endpoints.Jobs(false))
+	r.Methods("GET")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeListJobsHandler(backend))
+
+	// GET the dependency graph of a job
+	r = api.NewRoute()
+	r.Path(endpoints.JobDependencies(false))
+	r.Methods("GET")
+	r.Queries("id", "")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeGetJobDependenciesHandler(backend))
+
+	// GET the job statistics
+	r = api.NewRoute()
+	r.Path(endpoints.Stats(false))
+	r.Methods("GET")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeGetStatsHandler(backend))
+
 	// POST the completion status of a job
-	r = router.NewRoute()
+	r = api.NewRoute()
 	r.Path(endpoints.CompletedJobs(false))
 	r.Methods("POST")
 	r.Headers("Content-Type", "application/json")
 	r.Headers("Authorization", "")
 	r.HandlerFunc(makePutJobStatusHandler(backend))
 
-	srv := &http.Server{
-		Handler:      router,
-		Addr:         fmt.Sprintf(":%d", cfg.Server.Port),
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
-	}
+	// POST a state transition of a job being processed
+	r = api.NewRoute()
+	r.Path(endpoints.JobState(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makePutJobStateHandler(backend))
 
-	if err := srv.ListenAndServe(); err != nil {
-		return errors.Wrap(err, "front-end server error")
-	}
+	// POST a job cancellation request
+	r = api.NewRoute()
+	r.Path(endpoints.CancelJob(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeCancelJobHandler(backend))
 
-	return nil
+	// POST a change of the priority of a queued job
+	r = api.NewRoute()
+	r.Path(endpoints.JobPriority(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeSetJobPriorityHandler(backend))
+
+	// GET the job schedules
+	r = api.NewRoute()
+	r.Path(endpoints.Schedules(false))
+	r.Methods("GET")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeListSchedulesHandler(backend))
+
+	// POST a new job schedule
+	r = api.NewRoute()
+	r.Path(endpoints.Schedules(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makePostScheduleHandler(backend))
+
+	// POST the deletion of a job schedule
+	r = api.NewRoute()
+	r.Path(endpoints.DeleteSchedule(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeDeleteScheduleHandler(backend))
+
+	// POST a chunk of the log of a job
+	r = api.NewRoute()
+	r.Path(endpoints.JobLogs(false))
+	r.Methods("POST")
+	r.Headers("Content-Type", "application/json")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makePutJobLogHandler(backend))
+
+	// GET the log of a job
+	r = api.NewRoute()
+	r.Path(endpoints.JobLogs(false))
+	r.Methods("GET")
+	r.Queries("id", "")
+	r.Headers("Authorization", "")
+	r.HandlerFunc(makeGetJobLogHandler(backend))
+
+	return router, nil
 }
@@ -2,32 +2,35 @@ package cvmfs
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/pkg/errors"
 )
 
 // hmacAuthorization implements the Middleware interface and checks the HMAC signature of
-// incoming requests
+// incoming requests. The key which signed a request is stored in the request context, for
+// the handlers to check that it is valid for the repositories concerned by the request
 type hmacAuthorization struct {
-	sharedKey string
+	verifier *signatureVerifier
 }
 
+// signingKeyContextKey is the context key of the key which signed a request
+type signingKeyContextKey struct{}
+
 func (m *hmacAuthorization) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		authHeader := req.Header.Get("Authorization")
-		HMAC, err := base64.StdEncoding.DecodeString(authHeader)
-		if err != nil {
-			httpWrapError(err, "Could not base64 decode HMAC", &w, http.StatusBadRequest)
-			return
-		}
-
 		buf := []byte{}
 		if req.Method == "POST" {
 			// For POST requests, the body of the request is used to compute the HMAC
+			var err error
 			buf, err = ioutil.ReadAll(req.Body)
 			if err != nil {
 				httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
@@ -43,12 +46,14 @@ func (m *hmacAuthorization) Middleware(next http.Handler) http.Handler {
 			buf = []byte(req.URL.RawQuery)
 		}
 
-		if !checkHMAC(buf, HMAC, m.sharedKey) {
-			httpWrapError(errors.New("Invalid HMAC"), "Invalid request", &w, http.StatusForbidden)
+		key, err := m.verifier.verify(req, buf)
+		if err != nil {
+			httpWrapError(err, "Invalid request", &w, http.StatusForbidden)
 			return
 		}
 
-		next.ServeHTTP(w, req)
+		ctx := context.WithValue(req.Context(), signingKeyContextKey{}, key)
+		next.ServeHTTP(w, req.WithContext(ctx))
 	})
 }
 
@@ -75,6 +80,75 @@ func makeGetJobStatusHandler(backend *serverBackend) http.HandlerFunc {
 	}
 }
 
+func makeListJobsHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		filter, err := parseJobFilter(req.URL.Query())
+		if err != nil {
+			httpWrapError(err, "invalid job listing query", &w, http.StatusBadRequest)
+			return
+		}
+
+		jobs, err := backend.listJobs(filter)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(jobs)
+		if err != nil {
+			httpWrapError(err, "JSON serialization failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeGetJobDependenciesHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := uuid.Parse(req.URL.Query().Get("id"))
+		if err != nil {
+			httpWrapError(err, "invalid job ID", &w, http.StatusBadRequest)
+			return
+		}
+
+		deps, err := backend.getJobDependencies(id)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(deps)
+		if err != nil {
+			httpWrapError(err, "JSON serialization failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeGetStatsHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		filter, err := parseStatsFilter(req.URL.Query(), time.Now())
+		if err != nil {
+			httpWrapError(err, "invalid statistics query", &w, http.StatusBadRequest)
+			return
+		}
+
+		stats, err := backend.getStats(filter)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(stats)
+		if err != nil {
+			httpWrapError(err, "JSON serialization failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
 func makePutNewJobHandler(backend *serverBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		buf, err := ioutil.ReadAll(req.Body)
@@ -89,6 +163,11 @@ func makePutNewJobHandler(backend *serverBackend) http.HandlerFunc {
 			return
 		}
 
+		if !authorizeRepositories(w, req, job.Repository) ||
+			!authorizePriority(w, req, job.Priority) {
+			return
+		}
+
 		status, err := backend.putNewJob(&job)
 		if err != nil {
 			Log.Error().Err(err).Msg("backend request failed")
@@ -106,6 +185,42 @@ func makePutNewJobHandler(backend *serverBackend) http.HandlerFunc {
 	}
 }
 
+func makePutJobBatchHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var batch JobBatch
+		if err := json.Unmarshal(buf, &batch); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeRepositories(w, req, batch.repositories()...) ||
+			!authorizePriority(w, req, batch.priorities()...) {
+			return
+		}
+
+		status, err := backend.putJobBatch(&batch)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(
+				err, "JSON serialization of reply failed", &w,
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
 func makePutJobStatusHandler(backend *serverBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		buf, err := ioutil.ReadAll(req.Body)
@@ -120,6 +235,11 @@ func makePutJobStatusHandler(backend *serverBackend) http.HandlerFunc {
 			return
 		}
 
+		// The repository recorded for the job, if any, can't be changed
+		if !authorizeJob(w, req, backend, job.ID, job.Repository) {
+			return
+		}
+
 		status, err := backend.putJobStatus(&job)
 		if err != nil {
 			Log.Error().Err(err).Msg("backend request failed")
@@ -135,6 +255,332 @@ func makePutJobStatusHandler(backend *serverBackend) http.HandlerFunc {
 	}
 }
 
+func makePutJobStateHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var update JobStateUpdate
+		if err := json.Unmarshal(buf, &update); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeJob(w, req, backend, update.ID) {
+			return
+		}
+
+		status, err := backend.putJobState(&update)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeCancelJobHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var cancel CancelJobRequest
+		if err := json.Unmarshal(buf, &cancel); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeJob(w, req, backend, cancel.ID) {
+			return
+		}
+
+		status, err := backend.cancelJob(&cancel)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeSetJobPriorityHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var update JobPriorityRequest
+		if err := json.Unmarshal(buf, &update); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeJob(w, req, backend, update.ID) ||
+			!authorizePriority(w, req, update.Priority) {
+			return
+		}
+
+		status, err := backend.setJobPriority(&update)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeListSchedulesHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		schedules, err := backend.listSchedules()
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(schedules)
+		if err != nil {
+			httpWrapError(err, "JSON serialization failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makePostScheduleHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var schedule JobSchedule
+		if err := json.Unmarshal(buf, &schedule); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeRepositories(w, req, schedule.Job.Repository) ||
+			!authorizePriority(w, req, schedule.Job.Priority) {
+			return
+		}
+
+		status, err := backend.putSchedule(&schedule, time.Now())
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeDeleteScheduleHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var del DeleteScheduleRequest
+		if err := json.Unmarshal(buf, &del); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		repo, err := backend.getScheduleRepository(del.Name)
+		if err != nil {
+			httpWrapError(err, "could not query schedule repository", &w, http.StatusInternalServerError)
+			return
+		}
+		if repo != "" && !authorizeRepositories(w, req, repo) {
+			return
+		}
+
+		status, err := backend.deleteSchedule(&del)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makePutJobLogHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		buf, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			httpWrapError(err, "reading request body failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		var chunk JobLogChunk
+		if err := json.Unmarshal(buf, &chunk); err != nil {
+			httpWrapError(err, "JSON deserialization of request failed", &w, http.StatusBadRequest)
+			return
+		}
+
+		if !authorizeJob(w, req, backend, chunk.ID) {
+			return
+		}
+
+		status, err := backend.putJobLog(&chunk)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization of reply failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+func makeGetJobLogHandler(backend *serverBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, err := uuid.Parse(req.URL.Query().Get("id"))
+		if err != nil {
+			httpWrapError(err, "invalid job ID", &w, http.StatusBadRequest)
+			return
+		}
+
+		var offset int64
+		if v := req.URL.Query().Get("offset"); v != "" {
+			offset, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				httpWrapError(err, "invalid log offset", &w, http.StatusBadRequest)
+				return
+			}
+		}
+
+		follow := req.URL.Query().Get("follow") == "true"
+
+		status, err := backend.getJobLog(id, offset, follow)
+		if err != nil {
+			Log.Error().Err(err).Msg("backend request failed")
+		}
+
+		rep, err := json.Marshal(status)
+		if err != nil {
+			httpWrapError(err, "JSON serialization failed", &w, http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(rep)
+	}
+}
+
+// authorizeRepositories checks that the key which signed a request is valid for all the
+// repositories. Otherwise, an error reply is sent and false is returned
+func authorizeRepositories(w http.ResponseWriter, req *http.Request, repositories ...string) bool {
+	key, ok := req.Context().Value(signingKeyContextKey{}).(*signingKey)
+	if !ok {
+		httpWrapError(
+			errors.New("request was not authenticated"), "Invalid request", &w,
+			http.StatusForbidden)
+		return false
+	}
+
+	for _, r := range repositories {
+		if !key.allows(r) {
+			httpWrapError(
+				fmt.Errorf("key %q is not valid for repository %q", key.ID, r),
+				"Key not authorized for repository", &w, http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+// authorizePriority checks that the job priorities are valid, and that the key which
+// signed a request allows them. Otherwise, an error reply is sent and false is returned
+func authorizePriority(w http.ResponseWriter, req *http.Request, priorities ...int) bool {
+	key, ok := req.Context().Value(signingKeyContextKey{}).(*signingKey)
+	if !ok {
+		httpWrapError(
+			errors.New("request was not authenticated"), "Invalid request", &w,
+			http.StatusForbidden)
+		return false
+	}
+
+	for _, p := range priorities {
+		if p < 0 || p > maxJobPriority {
+			httpWrapError(
+				fmt.Errorf("job priority %v is not between 0 and %v", p, maxJobPriority),
+				"Invalid job priority", &w, http.StatusBadRequest)
+			return false
+		}
+		if p > key.MaxPriority {
+			httpWrapError(
+				fmt.Errorf("key %q allows job priorities up to %v, not %v", key.ID, key.MaxPriority, p),
+				"Key not authorized for job priority", &w, http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+// authorizeJob checks that the key which signed a request is valid for the repository of
+// an existing job, and for the additional repositories. Otherwise, an error reply is sent
+// and false is returned
+func authorizeJob(
+	w http.ResponseWriter, req *http.Request, backend *serverBackend, id uuid.UUID,
+	repositories ...string) bool {
+	repo, err := backend.getJobRepository(id)
+	if err != nil {
+		httpWrapError(err, "could not query job repository", &w, http.StatusInternalServerError)
+		return false
+	}
+	if repo != "" {
+		repositories = append(repositories, repo)
+	}
+
+	return authorizeRepositories(w, req, repositories...)
+}
+
 func httpWrapError(err error, msg string, w *http.ResponseWriter, code int) {
 	Log.Error().Err(err).Msg(msg)
 	http.Error(*w, msg, code)
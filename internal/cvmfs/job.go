@@ -1,10 +1,14 @@
 package cvmfs
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,13 +16,57 @@ import (
 	"github.com/pkg/errors"
 )
 
-// JobSpecification contains all the parameters of a new job which is to be submitted
+// The states of a job, from submission to completion
+const (
+	// JobStateSubmitted - the job was accepted by the server and is queued
+	JobStateSubmitted = "submitted"
+	// JobStateWaiting - the job is waiting for the completion of its dependencies
+	JobStateWaiting = "waiting-for-dependencies"
+	// JobStateScheduled - the job is held by the server until its start time
+	JobStateScheduled = "scheduled"
+	// JobStateRunning - the job is being processed by a worker
+	JobStateRunning = "running"
+	// JobStateSucceeded - the job was processed successfully
+	JobStateSucceeded = "succeeded"
+	// JobStateFailed - the job could not be processed
+	JobStateFailed = "failed"
+	// JobStateCancelled - the job was cancelled before completion
+	JobStateCancelled = "cancelled"
+)
+
+// isFinalState returns true if "state" can no longer change
+func isFinalState(state string) bool {
+	return state == JobStateSucceeded || state == JobStateFailed || state == JobStateCancelled
+}
+
+// isQueuedState returns true if a job in "state" is not yet running: it is queued,
+// waiting for its dependencies, or held until its start time
+func isQueuedState(state string) bool {
+	return state == JobStateSubmitted || state == JobStateWaiting || state == JobStateScheduled
+}
+
+// completionState returns the final state of a completed job
+func completionState(successful bool) string {
+	if successful {
+		return JobStateSucceeded
+	}
+	return JobStateFailed
+}
+
+// maxJobPriority is the highest priority of a job. Jobs with a higher priority are
+// consumed first from the job queue of their repository; the default priority is 0
+const maxJobPriority = 9
+
+// JobSpecification contains all the parameters of a new job which is to be submitted.
+// The job is not started before NotBefore, if set
 type JobSpecification struct {
 	JobName      string
 	Repository   string
 	Payload      string
 	LeasePath    string
 	Dependencies []string
+	Priority     int
+	NotBefore    time.Time
 }
 
 // UnprocessedJob describes a job which has been submitted, having been assigned
@@ -29,20 +77,62 @@ type UnprocessedJob struct {
 }
 
 // ProcessedJob describes a completed job. Additional fields with respect to an
-// unprocessed job are related to the execution time of the job and its completion status
+// unprocessed job are related to the execution time of the job and its completion status.
+// Jobs which are not yet completed are also described with this type, in which case
+// the fields which are not yet known have their zero value
 type ProcessedJob struct {
 	UnprocessedJob
 	WorkerName   string
+	SubmitTime   time.Time
 	StartTime    time.Time
 	FinishTime   time.Time
+	State        string
 	Successful   bool
 	ErrorMessage string
+	Attempts     []JobAttempt `json:",omitempty"`
 }
 
-// JobStatus holds a job ID and its completion status
+// The phases of a job transaction, as recorded for a failed attempt
+const (
+	// PhaseStart - opening the CVMFS transaction
+	PhaseStart = "start"
+	// PhaseDownload - downloading the payload of the job
+	PhaseDownload = "download"
+	// PhaseScript - running the transaction script
+	PhaseScript = "script"
+	// PhasePublish - publishing the CVMFS transaction
+	PhasePublish = "publish"
+)
+
+// JobAttempt describes one attempt of a worker at processing a job. Phase, ErrorMessage
+// and ExitCode are only set if the attempt failed; ExitCode is the exit code of the
+// command which failed, if any
+type JobAttempt struct {
+	Attempt      int
+	WorkerName   string
+	StartTime    time.Time
+	FinishTime   time.Time
+	Successful   bool
+	Phase        string `json:",omitempty"`
+	ErrorMessage string `json:",omitempty"`
+	ExitCode     int    `json:",omitempty"`
+}
+
+// JobStatus holds a job ID, its state, its completion status and its priority. The
+// priority is not set in the completion notifications
 type JobStatus struct {
 	ID         uuid.UUID
+	State      string
 	Successful bool
+	Priority   int
+}
+
+// JobStateUpdate is sent by a worker when a job it is processing changes state
+type JobStateUpdate struct {
+	ID         uuid.UUID
+	State      string
+	WorkerName string
+	Time       time.Time
 }
 
 // BasicReply is a status message and optional error cause
@@ -69,21 +159,432 @@ type PostJobStatusReply struct {
 	BasicReply
 }
 
+// JobBatch is a set of jobs which are submitted together
+type JobBatch struct {
+	Jobs []BatchJob
+}
+
+// BatchJob is a job which is part of a batch. Within a batch, a job is identified by
+// a local name. The dependencies of the job can either be local names of jobs of the
+// same batch, or UUIDs of previously submitted jobs
+type BatchJob struct {
+	Name string
+	JobSpecification
+}
+
+// repositories returns the repositories targeted by the jobs of the batch
+func (batch *JobBatch) repositories() []string {
+	repos := []string{}
+	seen := map[string]bool{}
+	for _, j := range batch.Jobs {
+		if !seen[j.Repository] {
+			seen[j.Repository] = true
+			repos = append(repos, j.Repository)
+		}
+	}
+	return repos
+}
+
+// priorities returns the priorities of the jobs of the batch
+func (batch *JobBatch) priorities() []int {
+	priorities := make([]int, 0, len(batch.Jobs))
+	for _, j := range batch.Jobs {
+		priorities = append(priorities, j.Priority)
+	}
+	return priorities
+}
+
+// PostJobBatchReply is the return type of the PostJobBatch action. IDs maps the
+// local names of the jobs of the batch to their assigned UUIDs
+type PostJobBatchReply struct {
+	BasicReply
+	IDs map[string]uuid.UUID `json:",omitempty"`
+}
+
+// PostJobStateReply is the return value of the PostJobState action
+type PostJobStateReply struct {
+	BasicReply
+}
+
+// CancelJobRequest is the body of a job cancellation request
+type CancelJobRequest struct {
+	ID     uuid.UUID
+	Reason string `json:",omitempty"`
+}
+
+// CancelJobReply is the return value of the CancelJob action. FailedDependents holds the
+// IDs of the jobs which were failed because they depend on the cancelled job
+type CancelJobReply struct {
+	BasicReply
+	FailedDependents []uuid.UUID `json:",omitempty"`
+}
+
+// JobPriorityRequest is the body of a request changing the priority of a queued job
+type JobPriorityRequest struct {
+	ID       uuid.UUID
+	Priority int
+}
+
+// JobPriorityReply is the return value of the SetJobPriority action
+type JobPriorityReply struct {
+	BasicReply
+}
+
+// ListJobsReply is the return type of the ListJobs query. NextOffset is the offset
+// of the next page of results, or zero if there are no more results
+type ListJobsReply struct {
+	BasicReply
+	Jobs       []ProcessedJob `json:",omitempty"`
+	NextOffset int            `json:",omitempty"`
+}
+
+// GetJobDependenciesReply is the return type of the GetJobDependencies query. Jobs holds
+// the queried job, the jobs it depends on and the jobs depending on it, directly or
+// indirectly. Dependencies maps each of these jobs to its direct dependencies among them
+type GetJobDependenciesReply struct {
+	BasicReply
+	Jobs         []ProcessedJob            `json:",omitempty"`
+	Dependencies map[uuid.UUID][]uuid.UUID `json:",omitempty"`
+}
+
+// JobStats holds the statistics of a group of jobs. Durations are in seconds: Duration
+// is the run time of the jobs and Wait is the time spent by the jobs in the queue,
+// from submission to start. FailuresByWorker counts the failed jobs of each worker and
+// BusiestLeasePaths lists the lease paths with the most jobs, in decreasing order
+type JobStats struct {
+	Group             string
+	Jobs              int
+	Succeeded         int
+	Failed            int
+	Cancelled         int
+	MedianDuration    float64
+	P95Duration       float64
+	MedianWait        float64
+	P95Wait           float64
+	FailuresByWorker  map[string]int   `json:",omitempty"`
+	BusiestLeasePaths []LeasePathCount `json:",omitempty"`
+}
+
+// LeasePathCount is the number of jobs published under a lease path
+type LeasePathCount struct {
+	LeasePath string
+	Jobs      int
+}
+
+// GetStatsReply is the return type of the GetStats query
+type GetStatsReply struct {
+	BasicReply
+	From    time.Time
+	To      time.Time
+	GroupBy string
+	Stats   []JobStats `json:",omitempty"`
+}
+
+// JobLogChunk is a piece of the output of a job, starting at Offset bytes into the log
+type JobLogChunk struct {
+	ID     uuid.UUID
+	Offset int64
+	Data   []byte
+}
+
+// PostJobLogReply is the return value of the PostJobLog action
+type PostJobLogReply struct {
+	BasicReply
+}
+
+// GetJobLogReply is the return value of the GetJobLog query. NextOffset is the size of
+// the log, to be used as the offset of a subsequent query. Finished is set once the job
+// is finished, in which case no more output will be added to the log
+type GetJobLogReply struct {
+	BasicReply
+	Data       []byte `json:",omitempty"`
+	NextOffset int64
+	Finished   bool
+}
+
+const (
+	// Number of jobs returned by a listing query when no limit is given
+	defaultListLimit = 100
+	// Maximum number of jobs returned by a single listing query
+	maxListLimit = 1000
+)
+
+// JobFilter holds the search criteria of a job listing query. Zero-valued fields
+// are not used for filtering
+type JobFilter struct {
+	Repository      string
+	JobName         string
+	WorkerName      string
+	State           string
+	Successful      *bool
+	LeasePathPrefix string
+	StartedAfter    time.Time
+	StartedBefore   time.Time
+	FinishedAfter   time.Time
+	FinishedBefore  time.Time
+	Limit           int
+	Offset          int
+}
+
+// Values encodes the filter as URL query parameters
+func (f *JobFilter) Values() url.Values {
+	q := url.Values{}
+	setString := func(key, v string) {
+		if v != "" {
+			q.Set(key, v)
+		}
+	}
+	setTime := func(key string, t time.Time) {
+		if !t.IsZero() {
+			q.Set(key, t.UTC().Format(time.RFC3339))
+		}
+	}
+	setString("repo", f.Repository)
+	setString("name", f.JobName)
+	setString("worker", f.WorkerName)
+	setString("state", f.State)
+	if f.Successful != nil {
+		q.Set("success", strconv.FormatBool(*f.Successful))
+	}
+	setString("lease_prefix", f.LeasePathPrefix)
+	setTime("started_after", f.StartedAfter)
+	setTime("started_before", f.StartedBefore)
+	setTime("finished_after", f.FinishedAfter)
+	setTime("finished_before", f.FinishedBefore)
+	if f.Limit > 0 {
+		q.Set("limit", strconv.Itoa(f.Limit))
+	}
+	if f.Offset > 0 {
+		q.Set("offset", strconv.Itoa(f.Offset))
+	}
+	return q
+}
+
+// parseJobFilter decodes a job filter from URL query parameters, applying the
+// default and maximum page sizes
+func parseJobFilter(q url.Values) (*JobFilter, error) {
+	f := JobFilter{
+		Repository:      q.Get("repo"),
+		JobName:         q.Get("name"),
+		WorkerName:      q.Get("worker"),
+		State:           q.Get("state"),
+		LeasePathPrefix: q.Get("lease_prefix"),
+		Limit:           defaultListLimit,
+	}
+
+	if v := q.Get("success"); v != "" {
+		success, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid success parameter")
+		}
+		f.Successful = &success
+	}
+
+	times := []struct {
+		key string
+		dst *time.Time
+	}{
+		{"started_after", &f.StartedAfter},
+		{"started_before", &f.StartedBefore},
+		{"finished_after", &f.FinishedAfter},
+		{"finished_before", &f.FinishedBefore},
+	}
+	for _, t := range times {
+		if v := q.Get(t.key); v != "" {
+			var err error
+			*t.dst, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid %v parameter", t.key)
+			}
+		}
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return nil, errors.New("invalid limit parameter")
+		}
+		f.Limit = limit
+	}
+	if f.Limit > maxListLimit {
+		f.Limit = maxListLimit
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, errors.New("invalid offset parameter")
+		}
+		f.Offset = offset
+	}
+
+	return &f, nil
+}
+
+// The groupings of the job statistics
+const (
+	// StatsGroupByRepository - one group of statistics for each repository
+	StatsGroupByRepository = "repository"
+	// StatsGroupByWorker - one group of statistics for each worker
+	StatsGroupByWorker = "worker"
+)
+
+// Default time window of the job statistics, ending at the time of the query
+const defaultStatsWindow = 7 * 24 * time.Hour
+
+// StatsFilter selects the jobs included in the statistics: the jobs finished between
+// From (included) and To (excluded), optionally of a single repository. The statistics
+// are grouped by repository or by worker
+type StatsFilter struct {
+	From       time.Time
+	To         time.Time
+	Repository string
+	GroupBy    string
+}
+
+// Values encodes the filter as URL query parameters
+func (f *StatsFilter) Values() url.Values {
+	q := url.Values{}
+	if !f.From.IsZero() {
+		q.Set("from", f.From.UTC().Format(time.RFC3339))
+	}
+	if !f.To.IsZero() {
+		q.Set("to", f.To.UTC().Format(time.RFC3339))
+	}
+	if f.Repository != "" {
+		q.Set("repo", f.Repository)
+	}
+	if f.GroupBy != "" {
+		q.Set("group_by", f.GroupBy)
+	}
+	return q
+}
+
+// parseStatsFilter decodes a statistics filter from URL query parameters. The time window
+// defaults to the last week, and the statistics are grouped by repository by default
+func parseStatsFilter(q url.Values, now time.Time) (*StatsFilter, error) {
+	f := StatsFilter{
+		To:         now,
+		Repository: q.Get("repo"),
+		GroupBy:    q.Get("group_by"),
+	}
+
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid to parameter")
+		}
+		f.To = t
+	}
+	f.From = f.To.Add(-defaultStatsWindow)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid from parameter")
+		}
+		f.From = t
+	}
+	if !f.From.Before(f.To) {
+		return nil, errors.New("empty statistics time window")
+	}
+
+	switch f.GroupBy {
+	case "":
+		f.GroupBy = StatsGroupByRepository
+	case StatsGroupByRepository, StatsGroupByWorker:
+	default:
+		return nil, fmt.Errorf("invalid group_by parameter: %v", f.GroupBy)
+	}
+
+	return &f, nil
+}
+
+// resolve assigns UUIDs to the jobs of a batch and replaces the local names used as
+// dependencies by the corresponding UUIDs. The jobs are returned in an order where
+// each job comes after all its dependencies from the batch. An error is returned if
+// the dependencies between the jobs have a cycle or reference unknown local names
+func (batch *JobBatch) resolve() ([]UnprocessedJob, map[string]uuid.UUID, error) {
+	ids := make(map[string]uuid.UUID, len(batch.Jobs))
+	for _, j := range batch.Jobs {
+		if j.Name == "" {
+			return nil, nil, errors.New("job without a name in batch")
+		}
+		if _, dup := ids[j.Name]; dup {
+			return nil, nil, fmt.Errorf("duplicate job name in batch: %v", j.Name)
+		}
+		ids[j.Name] = uuid.New()
+	}
+
+	// Number of unprocessed dependencies from the batch, and dependents, of each job
+	pending := make(map[string]int, len(batch.Jobs))
+	dependents := make(map[string][]string, len(batch.Jobs))
+	jobs := make(map[string]UnprocessedJob, len(batch.Jobs))
+	for _, j := range batch.Jobs {
+		job := UnprocessedJob{ID: ids[j.Name], JobSpecification: j.JobSpecification}
+		job.Dependencies = make([]string, 0, len(j.Dependencies))
+		for _, dep := range j.Dependencies {
+			if id, local := ids[dep]; local {
+				job.Dependencies = append(job.Dependencies, id.String())
+				pending[j.Name]++
+				dependents[dep] = append(dependents[dep], j.Name)
+			} else if _, err := uuid.Parse(dep); err == nil {
+				job.Dependencies = append(job.Dependencies, dep)
+			} else {
+				return nil, nil, fmt.Errorf(
+					"job %v depends on unknown job %v", j.Name, dep)
+			}
+		}
+		jobs[j.Name] = job
+	}
+
+	// Topological sort of the jobs; preserve the order of the batch where possible
+	ordered := make([]UnprocessedJob, 0, len(batch.Jobs))
+	ready := []string{}
+	for _, j := range batch.Jobs {
+		if pending[j.Name] == 0 {
+			ready = append(ready, j.Name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, jobs[name])
+		for _, dep := range dependents[name] {
+			pending[dep]--
+			if pending[dep] == 0 {
+				ready = append(ready, dep)
+			}
+		}
+	}
+
+	if len(ordered) != len(batch.Jobs) {
+		cycle := []string{}
+		for _, j := range batch.Jobs {
+			if pending[j.Name] > 0 {
+				cycle = append(cycle, j.Name)
+			}
+		}
+		return nil, nil, fmt.Errorf("dependency cycle between jobs: %v", cycle)
+	}
+
+	return ordered, ids, nil
+}
+
 // Prepare a job specification for submission: normalizes the lease path and embeds
 // the transaction script in the job description, if the script is a local file
 func (spec *JobSpecification) Prepare() {
-	if spec.LeasePath[0] != '/' {
+	if spec.LeasePath == "" || spec.LeasePath[0] != '/' {
 		spec.LeasePath = "/" + spec.LeasePath
 	}
 }
 
 // Process a job (download and unpack payload, run script etc.)
-func (j *UnprocessedJob) process(tempDir string) error {
+func (j *UnprocessedJob) process(ctx context.Context, tempDir string, out io.Writer) error {
 	if j.Payload != "" {
 		// Parse the payload string
 		tokens := strings.Split(j.Payload, "|")
 		if tokens[0] != "script" || len(tokens) < 2 {
-			return errors.New("invalid payload string")
+			return newPhaseError(PhaseDownload, errors.New("invalid payload string"))
 		}
 		scriptURL := tokens[1]
 		var scriptArg string
@@ -93,36 +594,48 @@ func (j *UnprocessedJob) process(tempDir string) error {
 
 		u, err := url.Parse(scriptURL)
 		if err != nil {
-			return errors.New("could not parse payload script URL")
+			return newPhaseError(PhaseDownload, errors.New("could not parse payload script URL"))
 		}
 		scriptFile := path.Join(tempDir, u.Path)
 
 		// Download the script into the temp directory
 		Log.Debug().Str("url", scriptURL).Msg("downloading transaction script")
+		t0 := time.Now()
 		if err := downloadFile(tempDir, scriptURL, downloadTimeout); err != nil {
-			return errors.Wrap(err, "could not download payload")
+			return newPhaseError(PhaseDownload, errors.Wrap(err, "could not download payload"))
 		}
+		observeSince(transactionPhaseDuration.WithLabelValues(PhaseDownload), t0)
 
 		// Make downloaded script file executable
 		if err := os.Chmod(scriptFile, 0755); err != nil {
-			return errors.Wrap(err, "could not make transaction script executable")
+			return newPhaseError(
+				PhaseDownload, errors.Wrap(err, "could not make transaction script executable"))
 		}
 
 		// Run the script from the root of the repository; the repository name,
 		// the lease path, and the optional argument from the payload strin are
 		// passed as arguments to the string
-		if err := runScript(scriptFile, j.Repository, j.LeasePath, scriptArg); err != nil {
-			return errors.Wrap(err, "running transaction script failed")
+		t0 = time.Now()
+		err = runScript(ctx, scriptFile, j.Repository, j.LeasePath, scriptArg, out)
+		observeSince(transactionPhaseDuration.WithLabelValues(PhaseScript), t0)
+		if err != nil {
+			return newPhaseError(PhaseScript, errors.Wrap(err, "running transaction script failed"))
 		}
 	}
 
 	return nil
 }
 
-func runScript(script string, repo string, leasePath string, arg string) error {
-	cmd := exec.Command(script, repo, leasePath, arg)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// runScript runs the transaction script. The script is killed if the context is cancelled.
+// The output of the script is written to the standard output of the worker and to "out"
+func runScript(
+	ctx context.Context, script string, repo string, leasePath string, arg string,
+	out io.Writer) error {
+	cmd := exec.CommandContext(ctx, script, repo, leasePath, arg)
+	// Using the same writer for both streams keeps their relative ordering
+	w := io.MultiWriter(os.Stdout, out)
+	cmd.Stdout = w
+	cmd.Stderr = w
 	cmd.Dir = path.Join("/cvmfs", repo)
 	if err := cmd.Run(); err != nil {
 		return err
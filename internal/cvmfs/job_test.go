@@ -1,3 +1,139 @@
 package cvmfs
 
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
 const input = "What goes in must also come out"
+
+func TestJobFilterValues(t *testing.T) {
+	success := true
+	f1 := JobFilter{
+		Repository:     "sft.cern.ch",
+		WorkerName:     "publisher1",
+		Successful:     &success,
+		StartedAfter:   time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC),
+		FinishedBefore: time.Date(2019, 3, 2, 12, 0, 0, 0, time.UTC),
+		Limit:          20,
+		Offset:         40,
+	}
+
+	f2, err := parseJobFilter(f1.Values())
+	if err != nil {
+		t.Fatalf("could not parse job filter: %v", err)
+	}
+
+	if f2.Repository != f1.Repository || f2.WorkerName != f1.WorkerName {
+		t.Errorf("invalid string fields: %+v", f2)
+	}
+	if f2.Successful == nil || *f2.Successful != success {
+		t.Errorf("invalid success field: %v", f2.Successful)
+	}
+	if !f2.StartedAfter.Equal(f1.StartedAfter) || !f2.FinishedBefore.Equal(f1.FinishedBefore) {
+		t.Errorf("invalid time fields: %+v", f2)
+	}
+	if !f2.StartedBefore.IsZero() || !f2.FinishedAfter.IsZero() {
+		t.Errorf("unset time fields should be zero: %+v", f2)
+	}
+	if f2.Limit != 20 || f2.Offset != 40 {
+		t.Errorf("invalid paging fields: %+v", f2)
+	}
+}
+
+func TestJobFilterDefaults(t *testing.T) {
+	f, err := parseJobFilter(url.Values{})
+	if err != nil {
+		t.Fatalf("could not parse empty job filter: %v", err)
+	}
+	if f.Limit != defaultListLimit || f.Successful != nil {
+		t.Errorf("invalid default filter: %+v", f)
+	}
+
+	f, err = parseJobFilter(url.Values{"limit": []string{"1000000"}})
+	if err != nil {
+		t.Fatalf("could not parse job filter: %v", err)
+	}
+	if f.Limit != maxListLimit {
+		t.Errorf("page size should be capped: %v", f.Limit)
+	}
+
+	if _, err := parseJobFilter(url.Values{"success": []string{"maybe"}}); err == nil {
+		t.Errorf("invalid success value should be rejected")
+	}
+}
+
+func TestResolveJobBatch(t *testing.T) {
+	external := uuid.New().String()
+
+	t.Run("valid batch", func(t *testing.T) {
+		batch := JobBatch{Jobs: []BatchJob{
+			{Name: "publish", JobSpecification: JobSpecification{
+				Dependencies: []string{"build", "test"}}},
+			{Name: "test", JobSpecification: JobSpecification{
+				Dependencies: []string{"build"}}},
+			{Name: "build", JobSpecification: JobSpecification{
+				Dependencies: []string{external}}},
+		}}
+
+		jobs, ids, err := batch.resolve()
+		if err != nil {
+			t.Fatalf("could not resolve batch: %v", err)
+		}
+		if len(ids) != 3 || len(jobs) != 3 {
+			t.Fatalf("invalid number of jobs: %v", len(jobs))
+		}
+
+		order := []string{}
+		for _, j := range jobs {
+			for name, id := range ids {
+				if id == j.ID {
+					order = append(order, name)
+				}
+			}
+		}
+		if order[0] != "build" || order[1] != "test" || order[2] != "publish" {
+			t.Errorf("invalid job order: %v", order)
+		}
+
+		if jobs[0].Dependencies[0] != external {
+			t.Errorf("external dependency should be kept: %v", jobs[0].Dependencies)
+		}
+		publish := jobs[2]
+		if publish.Dependencies[0] != ids["build"].String() ||
+			publish.Dependencies[1] != ids["test"].String() {
+			t.Errorf("local dependencies not resolved: %v", publish.Dependencies)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		batch := JobBatch{Jobs: []BatchJob{
+			{Name: "a", JobSpecification: JobSpecification{Dependencies: []string{"c"}}},
+			{Name: "b", JobSpecification: JobSpecification{Dependencies: []string{"a"}}},
+			{Name: "c", JobSpecification: JobSpecification{Dependencies: []string{"b"}}},
+			{Name: "d", JobSpecification: JobSpecification{}},
+		}}
+		if _, _, err := batch.resolve(); err == nil {
+			t.Errorf("dependency cycle should be rejected")
+		}
+	})
+
+	t.Run("unknown reference", func(t *testing.T) {
+		batch := JobBatch{Jobs: []BatchJob{
+			{Name: "a", JobSpecification: JobSpecification{Dependencies: []string{"b"}}},
+		}}
+		if _, _, err := batch.resolve(); err == nil {
+			t.Errorf("unknown dependency should be rejected")
+		}
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		batch := JobBatch{Jobs: []BatchJob{{Name: "a"}, {Name: "a"}}}
+		if _, _, err := batch.resolve(); err == nil {
+			t.Errorf("duplicate job names should be rejected")
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package cvmfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// errLogNotFound is returned when querying the log of a job which has none
+var errLogNotFound = errors.New("no log found for job")
+
+// jobLog captures the output of a job in memory. Output beyond maxSize bytes is
+// discarded and a truncation notice is added at the point where the log was cut.
+// The log is uploaded to the server incrementally; flushed is the amount of output
+// which was already uploaded
+type jobLog struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	maxSize   int
+	truncated bool
+	flushed   int64
+}
+
+func newJobLog(maxSize int) *jobLog {
+	return &jobLog{maxSize: maxSize}
+}
+
+// Write implements io.Writer. It never fails, so that writing to a full log does not
+// interrupt the transaction script
+func (l *jobLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.truncated {
+		return len(p), nil
+	}
+
+	n := len(p)
+	if l.maxSize > 0 && l.buf.Len()+n > l.maxSize {
+		n = l.maxSize - l.buf.Len()
+		l.truncated = true
+	}
+	l.buf.Write(p[:n])
+	if l.truncated {
+		fmt.Fprintf(&l.buf, "\n[conveyor: log truncated after %v bytes]\n", l.maxSize)
+	}
+
+	return len(p), nil
+}
+
+// Printf adds a formatted line to the log
+func (l *jobLog) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(l, format+"\n", args...)
+}
+
+// pending returns the chunk of output which was not yet uploaded
+func (l *jobLog) pending(id uuid.UUID) JobLogChunk {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data := append([]byte{}, l.buf.Bytes()[l.flushed:]...)
+	return JobLogChunk{ID: id, Offset: l.flushed, Data: data}
+}
+
+// setFlushed records that the output up to offset was uploaded
+func (l *jobLog) setFlushed(offset int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushed = offset
+}
+
+// logStore keeps the logs of the jobs as files in a directory of the server. Readers
+// following a log wait on a channel which is closed when the log is updated
+type logStore struct {
+	dir     string
+	mu      sync.Mutex
+	waiters map[uuid.UUID]chan struct{}
+}
+
+// newLogStore creates a log store, creating its directory if needed
+func newLogStore(dir string) (*logStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create job log directory")
+	}
+	return &logStore{dir: dir, waiters: map[uuid.UUID]chan struct{}{}}, nil
+}
+
+// notify wakes up the readers waiting for updates of a job log
+func (s *logStore) notify(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifyLocked(id)
+}
+
+func (s *logStore) notifyLocked(id uuid.UUID) {
+	if ch, ok := s.waiters[id]; ok {
+		close(ch)
+		delete(s.waiters, id)
+	}
+}
+
+// wait blocks until the log of a job grows beyond offset, the log is notified, or the
+// timeout expires
+func (s *logStore) wait(id uuid.UUID, offset int64, timeout time.Duration) {
+	s.mu.Lock()
+	if info, err := os.Stat(s.path(id)); err == nil && info.Size() > offset {
+		s.mu.Unlock()
+		return
+	}
+	ch, ok := s.waiters[id]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[id] = ch
+	}
+	s.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	}
+}
+
+func (s *logStore) path(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+".log")
+}
+
+// write stores a chunk of a job log. Data already stored beyond the offset of the
+// chunk is replaced, which makes repeated uploads of the same chunk harmless
+func (s *logStore) write(chunk *JobLogChunk) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path(chunk.ID), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "could not open job log")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not stat job log")
+	}
+	if chunk.Offset < 0 || chunk.Offset > info.Size() {
+		return fmt.Errorf(
+			"log chunk offset %v outside of job log of size %v", chunk.Offset, info.Size())
+	}
+
+	if err := f.Truncate(chunk.Offset); err != nil {
+		return errors.Wrap(err, "could not truncate job log")
+	}
+	if _, err := f.WriteAt(chunk.Data, chunk.Offset); err != nil {
+		return errors.Wrap(err, "could not write job log")
+	}
+
+	s.notifyLocked(chunk.ID)
+
+	return nil
+}
+
+// remove deletes the log of a job, if it has one
+func (s *logStore) remove(id uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove job log")
+	}
+	return nil
+}
+
+// read returns the content of a job log starting at offset, and the size of the log
+func (s *logStore) read(id uuid.UUID, offset int64) ([]byte, int64, error) {
+	f, err := os.Open(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, 0, errLogNotFound
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not open job log")
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "could not stat job log")
+	}
+	size := info.Size()
+	if offset < 0 || offset > size {
+		return nil, size, fmt.Errorf("offset %v outside of job log of size %v", offset, size)
+	}
+
+	buf := make([]byte, size-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && err != io.EOF {
+		return nil, size, errors.Wrap(err, "could not read job log")
+	}
+
+	return buf, size, nil
+}
@@ -0,0 +1,138 @@
+package cvmfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestJobLogTruncation(t *testing.T) {
+	l := newJobLog(10)
+	for _, s := range []string{"hello ", "world", "!"} {
+		n, err := l.Write([]byte(s))
+		if err != nil || n != len(s) {
+			t.Fatalf("write returned (%v, %v)", n, err)
+		}
+	}
+
+	out := string(l.pending(uuid.Nil).Data)
+	if !strings.HasPrefix(out, "hello worl\n") {
+		t.Errorf("unexpected log content: %q", out)
+	}
+	if !strings.Contains(out, "log truncated") {
+		t.Errorf("missing truncation notice: %q", out)
+	}
+	if strings.Contains(out, "!") {
+		t.Errorf("output written after truncation: %q", out)
+	}
+}
+
+func TestJobLogPending(t *testing.T) {
+	l := newJobLog(0)
+	id := uuid.New()
+
+	l.Printf("first")
+	chunk := l.pending(id)
+	if chunk.ID != id || chunk.Offset != 0 || string(chunk.Data) != "first\n" {
+		t.Errorf("unexpected first chunk: %+v", chunk)
+	}
+	l.setFlushed(chunk.Offset + int64(len(chunk.Data)))
+
+	l.Printf("second")
+	chunk = l.pending(id)
+	if chunk.Offset != 6 || string(chunk.Data) != "second\n" {
+		t.Errorf("unexpected second chunk: %+v", chunk)
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	if _, _, err := s.read(id, 0); err != errLogNotFound {
+		t.Errorf("expected errLogNotFound, got %v", err)
+	}
+
+	chunks := []JobLogChunk{
+		{ID: id, Offset: 0, Data: []byte("first\n")},
+		{ID: id, Offset: 6, Data: []byte("second\n")},
+		// A repeated upload replaces the end of the log
+		{ID: id, Offset: 6, Data: []byte("again\n")},
+	}
+	for _, c := range chunks {
+		if err := s.write(&c); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	if err := s.write(&JobLogChunk{ID: id, Offset: 100, Data: []byte("x")}); err == nil {
+		t.Errorf("write beyond the end of the log should fail")
+	}
+
+	data, size, err := s.read(id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first\nagain\n" || size != 12 {
+		t.Errorf("unexpected log: %q (size %v)", data, size)
+	}
+
+	data, _, err = s.read(id, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "again\n" {
+		t.Errorf("unexpected log from offset: %q", data)
+	}
+}
+
+func TestLogStoreWait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conveyor-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := uuid.New()
+	done := make(chan struct{})
+	go func() {
+		s.wait(id, 0, time.Minute)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if err := s.write(&JobLogChunk{ID: id, Offset: 0, Data: []byte("output")}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader was not woken up by the log update")
+	}
+
+	// Returns right away when the log already has new output
+	start := time.Now()
+	s.wait(id, 0, time.Minute)
+	if time.Since(start) > time.Second {
+		t.Errorf("wait blocked although the log has new output")
+	}
+}
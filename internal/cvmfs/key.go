@@ -3,8 +3,120 @@ package cvmfs
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"fmt"
+
+	"github.com/pkg/errors"
 )
 
+// keyIDHeader is the HTTP header carrying the ID of the key used to sign a request.
+// Requests without this header are signed with the shared key
+const keyIDHeader = "X-Conveyor-Key-ID"
+
+// anyRepository is used in the repository list of keys valid for all repositories
+const anyRepository = "*"
+
+// signingKey is a secret used to sign the requests to the job server, together with the
+// repositories for which it is valid and the highest priority of the jobs it may submit
+type signingKey struct {
+	ID           string
+	Secret       string
+	Repositories []string
+	MaxPriority  int
+}
+
+// allows returns true if the key is valid for the repository
+func (k *signingKey) allows(repository string) bool {
+	for _, r := range k.Repositories {
+		if r == anyRepository || r == repository {
+			return true
+		}
+	}
+	return false
+}
+
+// keyStore holds the signing keys known to a client or to the server. Several keys
+// may be valid for the same repository, which allows rotating keys without downtime
+type keyStore struct {
+	keys []*signingKey
+	byID map[string]*signingKey
+}
+
+// newKeyStore creates a key store with the keys of the configuration. The shared key,
+// if set, is valid for all repositories
+func newKeyStore(cfg *Config) (*keyStore, error) {
+	s := &keyStore{byID: map[string]*signingKey{}}
+
+	add := func(k *signingKey) error {
+		if _, ok := s.byID[k.ID]; ok {
+			return fmt.Errorf("duplicate key ID: %q", k.ID)
+		}
+		s.keys = append(s.keys, k)
+		s.byID[k.ID] = k
+		return nil
+	}
+
+	for _, kc := range cfg.Keys {
+		if kc.ID == "" {
+			return nil, errors.New("key ID is unset")
+		}
+		if isUnset(kc.Secret) {
+			return nil, fmt.Errorf("secret of key %q is unset", kc.ID)
+		}
+		if len(kc.Repositories) == 0 {
+			return nil, fmt.Errorf("key %q is not valid for any repository", kc.ID)
+		}
+		if kc.MaxPriority < 0 || kc.MaxPriority > maxJobPriority {
+			return nil, fmt.Errorf(
+				"maximum job priority of key %q is not between 0 and %v", kc.ID, maxJobPriority)
+		}
+		k := &signingKey{
+			ID: kc.ID, Secret: kc.Secret, Repositories: kc.Repositories,
+			MaxPriority: kc.MaxPriority}
+		if err := add(k); err != nil {
+			return nil, err
+		}
+	}
+
+	if !isUnset(cfg.SharedKey) {
+		k := &signingKey{
+			ID: cfg.KeyID, Secret: cfg.SharedKey, Repositories: []string{anyRepository},
+			MaxPriority: maxJobPriority}
+		if err := add(k); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(s.keys) == 0 {
+		return nil, errors.New("no signing key is configured")
+	}
+
+	return s, nil
+}
+
+// get returns the key with the given ID
+func (s *keyStore) get(id string) (*signingKey, bool) {
+	k, ok := s.byID[id]
+	return k, ok
+}
+
+// keyFor returns the key used to sign a request concerning the given repositories: the
+// first key valid for all of them, in configuration order, or the first key if none is
+func (s *keyStore) keyFor(repositories ...string) *signingKey {
+	for _, k := range s.keys {
+		valid := true
+		for _, r := range repositories {
+			if !k.allows(r) {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return k
+		}
+	}
+	return s.keys[0]
+}
+
 // computeHMAC - compute the HMAC of a message using a specific key
 func computeHMAC(message []byte, key string) []byte {
 	mac := hmac.New(sha256.New, []byte(key))
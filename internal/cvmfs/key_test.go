@@ -1,6 +1,9 @@
 package cvmfs
 
 import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -21,3 +24,139 @@ func TestHMAC(t *testing.T) {
 		t.Errorf("HMAC of msg2 should not be the same as for msg1")
 	}
 }
+
+func TestKeyStore(t *testing.T) {
+	cfg := &Config{
+		SharedKey: "UNSET",
+		Keys: []KeyConfig{
+			{ID: "new", Secret: "s1", Repositories: []string{"a.cern.ch"}},
+			{ID: "old", Secret: "s2", Repositories: []string{"a.cern.ch", "b.cern.ch"}},
+			{ID: "admin", Secret: "s3", Repositories: []string{"*"}},
+		},
+	}
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k := keys.keyFor("a.cern.ch"); k.ID != "new" {
+		t.Errorf("unexpected key for a.cern.ch: %v", k.ID)
+	}
+	if k := keys.keyFor("a.cern.ch", "b.cern.ch"); k.ID != "old" {
+		t.Errorf("unexpected key for a.cern.ch and b.cern.ch: %v", k.ID)
+	}
+	if k := keys.keyFor("c.cern.ch"); k.ID != "admin" {
+		t.Errorf("unexpected key for c.cern.ch: %v", k.ID)
+	}
+	if _, ok := keys.get(""); ok {
+		t.Errorf("the shared key is unset, but found")
+	}
+
+	// The shared key is valid for all repositories
+	cfg.SharedKey = "shared"
+	keys, err = newKeyStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := keys.get(""); !ok || !k.allows("c.cern.ch") {
+		t.Errorf("the shared key should be valid for all repositories")
+	}
+	if k, _ := keys.get(""); k.MaxPriority != maxJobPriority {
+		t.Errorf("the shared key should allow all the job priorities")
+	}
+
+	// The maximum job priority of a key must be valid
+	cfg.Keys[0].MaxPriority = maxJobPriority + 1
+	if _, err := newKeyStore(cfg); err == nil {
+		t.Errorf("invalid maximum job priority should be rejected")
+	}
+	cfg.Keys[0].MaxPriority = 0
+
+	// Duplicate key IDs are rejected
+	cfg.Keys = append(cfg.Keys, KeyConfig{ID: "new", Secret: "s4", Repositories: []string{"*"}})
+	if _, err := newKeyStore(cfg); err == nil {
+		t.Errorf("duplicate key IDs should be rejected")
+	}
+
+	// At least one key is needed
+	if _, err := newKeyStore(&Config{SharedKey: "UNSET"}); err == nil {
+		t.Errorf("a key store without keys should be rejected")
+	}
+}
+
+func TestRepositoryAuthorization(t *testing.T) {
+	cfg := &Config{
+		SharedKey: "UNSET",
+		Keys: []KeyConfig{
+			{ID: "sft", Secret: "s1", Repositories: []string{"sft.cern.ch"}},
+			{ID: "admin", Secret: "s2", Repositories: []string{"*"}},
+		},
+	}
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &JobClient{keys: keys}
+
+	verifier := newSignatureVerifier(
+		keys, &ServerConfig{AcceptV1Signatures: true, MaxClockSkew: 300})
+	authz := hmacAuthorization{verifier}
+	handler := authz.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authorizeRepositories(w, req, req.URL.Query().Get("repo")) {
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+
+	tests := []struct {
+		repo  string
+		keyID string
+		code  int
+	}{
+		{"sft.cern.ch", "sft", http.StatusOK},
+		{"other.cern.ch", "sft", http.StatusForbidden},
+		{"other.cern.ch", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/?repo="+tt.repo, nil)
+		key, _ := keys.get(tt.keyID)
+		hmac := base64.StdEncoding.EncodeToString(computeHMAC([]byte(req.URL.RawQuery), key.Secret))
+		req.Header.Set("Authorization", hmac)
+		req.Header.Set(keyIDHeader, tt.keyID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("repo %v, key %v: expected %v, got %v", tt.repo, tt.keyID, tt.code, rec.Code)
+		}
+	}
+
+	// Requests signed by the client with the key selected for the repository
+	req := httptest.NewRequest("GET", "/?repo=sft.cern.ch", nil)
+	if err := client.sign(req, []byte(req.URL.RawQuery), "sft.cern.ch"); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get(keyIDHeader) != "sft" {
+		t.Errorf("unexpected key ID: %v", req.Header.Get(keyIDHeader))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("request signed by the client was rejected: %v", rec.Code)
+	}
+
+	// Unknown key IDs and invalid signatures are rejected
+	req = httptest.NewRequest("GET", "/?repo=sft.cern.ch", nil)
+	req.Header.Set("Authorization", base64.StdEncoding.EncodeToString([]byte("invalid")))
+	req.Header.Set(keyIDHeader, "sft")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("request with an invalid HMAC was accepted: %v", rec.Code)
+	}
+
+	req.Header.Set(keyIDHeader, "unknown")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("request with an unknown key was accepted: %v", rec.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package cvmfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// jobManifest is the description of a batch of jobs, as given in a manifest file. The
+// repository, lease path and priority given at the top level are used for the jobs which
+// don't specify their own
+type jobManifest struct {
+	Repository string        `json:"repository" yaml:"repository"`
+	LeasePath  string        `json:"lease_path" yaml:"lease_path"`
+	Priority   int           `json:"priority" yaml:"priority"`
+	Jobs       []manifestJob `json:"jobs" yaml:"jobs"`
+}
+
+type manifestJob struct {
+	Name       string   `json:"name" yaml:"name"`
+	JobName    string   `json:"job_name" yaml:"job_name"`
+	Repository string   `json:"repository" yaml:"repository"`
+	Payload    string   `json:"payload" yaml:"payload"`
+	LeasePath  string   `json:"lease_path" yaml:"lease_path"`
+	Deps       []string `json:"deps" yaml:"deps"`
+	Priority   *int     `json:"priority" yaml:"priority"`
+}
+
+// ReadJobManifest reads a batch of jobs from a manifest file, in YAML or JSON format
+// (JSON is used for files with the ".json" extension). Jobs without a repository,
+// neither in the job description nor at the top level of the manifest, are assigned
+// to "defaultRepo". The job name defaults to the local name of the job in the batch
+func ReadJobManifest(fileName, defaultRepo string) (*JobBatch, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read manifest file")
+	}
+
+	var m jobManifest
+	if strings.ToLower(filepath.Ext(fileName)) == ".json" {
+		err = json.Unmarshal(buf, &m)
+	} else {
+		err = yaml.UnmarshalStrict(buf, &m)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse manifest file")
+	}
+
+	return m.batch(defaultRepo)
+}
+
+func (m *jobManifest) batch(defaultRepo string) (*JobBatch, error) {
+	if len(m.Jobs) == 0 {
+		return nil, errors.New("no jobs in manifest")
+	}
+
+	batch := JobBatch{Jobs: make([]BatchJob, 0, len(m.Jobs))}
+	for _, j := range m.Jobs {
+		spec := JobSpecification{
+			JobName:      firstNonEmpty(j.JobName, j.Name),
+			Repository:   firstNonEmpty(j.Repository, m.Repository, defaultRepo),
+			Payload:      j.Payload,
+			LeasePath:    firstNonEmpty(j.LeasePath, m.LeasePath, "/"),
+			Dependencies: j.Deps,
+			Priority:     m.Priority,
+		}
+		if j.Priority != nil {
+			spec.Priority = *j.Priority
+		}
+		if spec.Dependencies == nil {
+			spec.Dependencies = []string{}
+		}
+		if spec.Repository == "" {
+			return nil, errors.Errorf("no repository given for job %v", j.Name)
+		}
+		spec.Prepare()
+		batch.Jobs = append(batch.Jobs, BatchJob{Name: j.Name, JobSpecification: spec})
+	}
+
+	return &batch, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
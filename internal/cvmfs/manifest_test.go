@@ -0,0 +1,93 @@
+package cvmfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const yamlManifest = `
+repository: sft.cern.ch
+priority: 2
+jobs:
+  - name: build
+    payload: "script|http://payloads.example.com/build.sh"
+    lease_path: lcg_95
+  - name: publish
+    job_name: publish-release
+    repository: sft-nightlies.cern.ch
+    deps: [build]
+    priority: 0
+`
+
+const jsonManifest = `{
+	"jobs": [
+		{"name": "build", "payload": "script|http://payloads.example.com/build.sh"},
+		{"name": "publish", "deps": ["build"]}
+	]
+}`
+
+func writeManifest(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	fileName := path.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write manifest file: %v", err)
+	}
+	return fileName
+}
+
+func TestReadJobManifest(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatalf("Could not create temp dir")
+	}
+	defer os.RemoveAll(tmp)
+
+	t.Run("YAML", func(t *testing.T) {
+		batch, err := ReadJobManifest(writeManifest(t, tmp, "m.yaml", yamlManifest), "")
+		if err != nil {
+			t.Fatalf("could not read manifest: %v", err)
+		}
+		if len(batch.Jobs) != 2 {
+			t.Fatalf("invalid number of jobs: %v", len(batch.Jobs))
+		}
+		build := batch.Jobs[0]
+		if build.JobName != "build" || build.Repository != "sft.cern.ch" ||
+			build.LeasePath != "/lcg_95" || build.Priority != 2 {
+			t.Errorf("invalid job: %+v", build)
+		}
+		publish := batch.Jobs[1]
+		if publish.JobName != "publish-release" ||
+			publish.Repository != "sft-nightlies.cern.ch" ||
+			publish.LeasePath != "/" || publish.Dependencies[0] != "build" ||
+			publish.Priority != 0 {
+			t.Errorf("invalid job: %+v", publish)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		batch, err := ReadJobManifest(
+			writeManifest(t, tmp, "m.json", jsonManifest), "default.cern.ch")
+		if err != nil {
+			t.Fatalf("could not read manifest: %v", err)
+		}
+		if len(batch.Jobs) != 2 || batch.Jobs[1].Repository != "default.cern.ch" {
+			t.Errorf("invalid batch: %+v", batch)
+		}
+	})
+
+	t.Run("missing repository", func(t *testing.T) {
+		if _, err := ReadJobManifest(
+			writeManifest(t, tmp, "m2.json", jsonManifest), ""); err == nil {
+			t.Errorf("jobs without a repository should be rejected")
+		}
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		if _, err := ReadJobManifest(
+			writeManifest(t, tmp, "m3.yaml", "jobs:\n  - name: a\n    repo: x\n"), "r"); err == nil {
+			t.Errorf("unknown fields should be rejected")
+		}
+	})
+}
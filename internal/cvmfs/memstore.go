@@ -0,0 +1,443 @@
+package cvmfs
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryStore is a job store which keeps the jobs in memory. The jobs are lost when the
+// server is stopped, so it is meant for development and testing
+type memoryStore struct {
+	mu           sync.RWMutex
+	jobs         map[uuid.UUID]*ProcessedJob
+	dependencies map[uuid.UUID][]uuid.UUID
+	attempts     map[uuid.UUID][]JobAttempt
+	schedules    map[string]*JobSchedule
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		jobs:         map[uuid.UUID]*ProcessedJob{},
+		dependencies: map[uuid.UUID][]uuid.UUID{},
+		attempts:     map[uuid.UUID][]JobAttempt{},
+		schedules:    map[string]*JobSchedule{},
+	}
+}
+
+func (s *memoryStore) InsertJobs(jobs []ProcessedJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[uuid.UUID]bool{}
+	for _, j := range jobs {
+		if _, ok := s.jobs[j.ID]; ok || seen[j.ID] {
+			return fmt.Errorf("job %v already recorded", j.ID)
+		}
+		seen[j.ID] = true
+	}
+
+	for i := range jobs {
+		s.putJob(&jobs[i])
+	}
+	return nil
+}
+
+func (s *memoryStore) PutJob(j *ProcessedJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	submitTime := j.SubmitTime
+	if old, ok := s.jobs[j.ID]; ok {
+		submitTime = old.SubmitTime
+	}
+	s.putJob(j)
+	s.jobs[j.ID].SubmitTime = submitTime
+
+	last := len(s.attempts[j.ID])
+	for i, a := range j.Attempts {
+		a.Attempt = last + i + 1
+		s.attempts[j.ID] = append(s.attempts[j.ID], a)
+	}
+	return nil
+}
+
+// putJob records a job and its dependencies, without its attempts. As in the job DB,
+// dependencies on unknown jobs are skipped
+func (s *memoryStore) putJob(j *ProcessedJob) {
+	job := *j
+	job.Attempts = nil
+	s.jobs[j.ID] = &job
+
+	for _, dep := range j.Dependencies {
+		depID, err := uuid.Parse(dep)
+		if err != nil {
+			continue
+		}
+		if _, ok := s.jobs[depID]; !ok || containsID(s.dependencies[j.ID], depID) {
+			continue
+		}
+		s.dependencies[j.ID] = append(s.dependencies[j.ID], depID)
+	}
+}
+
+func (s *memoryStore) UpdateJobState(
+	id uuid.UUID, state, worker string, startTime time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || isFinalState(j.State) {
+		return false, nil
+	}
+	j.State = state
+	j.WorkerName = worker
+	if !startTime.IsZero() {
+		j.StartTime = startTime
+	}
+	return true, nil
+}
+
+func (s *memoryStore) FinishJob(
+	id uuid.UUID, state, reason string, finishTime time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || isFinalState(j.State) {
+		return false, nil
+	}
+	j.State = state
+	j.Successful = false
+	j.FinishTime = finishTime
+	j.ErrorMessage = reason
+	return true, nil
+}
+
+func (s *memoryStore) UpdateJobPriority(id uuid.UUID, priority int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[id]
+	if !ok || !isQueuedState(j.State) {
+		return false, nil
+	}
+	j.Priority = priority
+	return true, nil
+}
+
+func (s *memoryStore) GetJobs(ids []string, attempts bool) ([]ProcessedJob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := []ProcessedJob{}
+	seen := map[uuid.UUID]bool{}
+	for _, v := range ids {
+		id, err := uuid.Parse(v)
+		if err != nil || seen[id] {
+			continue
+		}
+		seen[id] = true
+		j, ok := s.jobs[id]
+		if !ok {
+			continue
+		}
+		job := *j
+		if attempts && len(s.attempts[id]) > 0 {
+			job.Attempts = append([]JobAttempt{}, s.attempts[id]...)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *memoryStore) ListJobs(f *JobFilter) ([]ProcessedJob, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := s.selectJobs(func(j *ProcessedJob) bool { return matchJobFilter(f, j) })
+	sort.Slice(jobs, func(i, k int) bool {
+		if !jobs[i].SubmitTime.Equal(jobs[k].SubmitTime) {
+			return jobs[i].SubmitTime.After(jobs[k].SubmitTime)
+		}
+		return jobs[i].ID.String() < jobs[k].ID.String()
+	})
+
+	page := paginate(jobs, f.Limit, f.Offset)
+	return page, f.Offset+len(page) < len(jobs), nil
+}
+
+// matchJobFilter returns true if a job matches a job listing filter. Jobs without start
+// (or finish) time don't match the conditions on the start (or finish) time
+func matchJobFilter(f *JobFilter, j *ProcessedJob) bool {
+	after := func(t, bound time.Time) bool {
+		return bound.IsZero() || (!t.IsZero() && !t.Before(bound))
+	}
+	before := func(t, bound time.Time) bool {
+		return bound.IsZero() || (!t.IsZero() && t.Before(bound))
+	}
+	return (f.Repository == "" || j.Repository == f.Repository) &&
+		(f.JobName == "" || j.JobName == f.JobName) &&
+		(f.WorkerName == "" || j.WorkerName == f.WorkerName) &&
+		(f.State == "" || j.State == f.State) &&
+		(f.Successful == nil || j.Successful == *f.Successful) &&
+		strings.HasPrefix(j.LeasePath, f.LeasePathPrefix) &&
+		after(j.StartTime, f.StartedAfter) && before(j.StartTime, f.StartedBefore) &&
+		after(j.FinishTime, f.FinishedAfter) && before(j.FinishTime, f.FinishedBefore)
+}
+
+func (s *memoryStore) JobDependencies(id uuid.UUID) ([]uuid.UUID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]uuid.UUID{}, s.dependencies[id]...), nil
+}
+
+func (s *memoryStore) JobDependents(id uuid.UUID) ([]uuid.UUID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dependents(id, false), nil
+}
+
+func (s *memoryStore) PendingDependents(id uuid.UUID) ([]uuid.UUID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.dependents(id, true), nil
+}
+
+// dependents returns the IDs of the jobs which depend directly on a job, optionally only
+// the unfinished ones. The IDs are sorted, for a deterministic order
+func (s *memoryStore) dependents(id uuid.UUID, pending bool) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for job, deps := range s.dependencies {
+		if containsID(deps, id) && (!pending || !isFinalState(s.jobs[job].State)) {
+			ids = append(ids, job)
+		}
+	}
+	sort.Slice(ids, func(i, k int) bool { return ids[i].String() < ids[k].String() })
+	return ids
+}
+
+func (s *memoryStore) Repositories() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	repos := []string{}
+	seen := map[string]bool{}
+	for _, j := range s.jobs {
+		if !seen[j.Repository] {
+			seen[j.Repository] = true
+			repos = append(repos, j.Repository)
+		}
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+func (s *memoryStore) RecentJobs(repo string, n int) ([]uuid.UUID, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Jobs recorded by workers which predate job states may have no submission time
+	recorded := func(j *ProcessedJob) time.Time {
+		if j.SubmitTime.IsZero() {
+			return j.FinishTime
+		}
+		return j.SubmitTime
+	}
+
+	jobs := s.selectJobs(func(j *ProcessedJob) bool { return j.Repository == repo })
+	sort.Slice(jobs, func(i, k int) bool {
+		ti, tk := recorded(&jobs[i]), recorded(&jobs[k])
+		if !ti.Equal(tk) {
+			return ti.After(tk)
+		}
+		return jobs[i].ID.String() < jobs[k].ID.String()
+	})
+
+	ids := []uuid.UUID{}
+	for _, j := range paginate(jobs, n, 0) {
+		ids = append(ids, j.ID)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) ExpiredJobs(
+	repo string, cutoff, failedCutoff time.Time, limit, offset int) ([]ProcessedJob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jobs := s.selectJobs(func(j *ProcessedJob) bool {
+		if j.Repository != repo || j.FinishTime.IsZero() {
+			return false
+		}
+		switch j.State {
+		case JobStateSucceeded, JobStateCancelled:
+			return j.FinishTime.Before(cutoff)
+		case JobStateFailed:
+			return j.FinishTime.Before(failedCutoff)
+		}
+		return false
+	})
+	sort.Slice(jobs, func(i, k int) bool {
+		if !jobs[i].FinishTime.Equal(jobs[k].FinishTime) {
+			return jobs[i].FinishTime.Before(jobs[k].FinishTime)
+		}
+		return jobs[i].ID.String() < jobs[k].ID.String()
+	})
+
+	return paginate(jobs, limit, offset), nil
+}
+
+func (s *memoryStore) DeleteJobs(ids []uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		delete(s.jobs, id)
+		delete(s.dependencies, id)
+		delete(s.attempts, id)
+		deleted[id] = true
+	}
+
+	// Dependencies on the deleted jobs are deleted too
+	for job, deps := range s.dependencies {
+		kept := []uuid.UUID{}
+		for _, dep := range deps {
+			if !deleted[dep] {
+				kept = append(kept, dep)
+			}
+		}
+		s.dependencies[job] = kept
+	}
+	return nil
+}
+
+func (s *memoryStore) JobStats(f *StatsFilter) ([]JobStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Durations are only known when both ends are recorded
+	seconds := func(from, to time.Time) sql.NullFloat64 {
+		if from.IsZero() || to.IsZero() {
+			return sql.NullFloat64{}
+		}
+		return sql.NullFloat64{Float64: to.Sub(from).Seconds(), Valid: true}
+	}
+
+	jobs := []statsRow{}
+	for _, j := range s.jobs {
+		if j.FinishTime.IsZero() || j.FinishTime.Before(f.From) || !j.FinishTime.Before(f.To) ||
+			(f.Repository != "" && j.Repository != f.Repository) {
+			continue
+		}
+		group := j.Repository
+		if f.GroupBy == StatsGroupByWorker {
+			group = j.WorkerName
+		}
+		jobs = append(jobs, statsRow{
+			group:     group,
+			state:     j.State,
+			worker:    j.WorkerName,
+			leasePath: j.LeasePath,
+			duration:  seconds(j.StartTime, j.FinishTime),
+			wait:      seconds(j.SubmitTime, j.StartTime),
+		})
+	}
+
+	return aggregateStats(jobs), nil
+}
+
+func (s *memoryStore) PutSchedule(sc *JobSchedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule := *sc
+	schedule.NextRun = time.Time{}
+	if old, ok := s.schedules[sc.Name]; ok {
+		schedule.CreateTime = old.CreateTime
+		schedule.Source = old.Source
+		schedule.LastRun = old.LastRun
+		schedule.LastJobID = old.LastJobID
+	}
+	s.schedules[sc.Name] = &schedule
+	return nil
+}
+
+func (s *memoryStore) GetSchedules() ([]JobSchedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedules := []JobSchedule{}
+	for _, sc := range s.schedules {
+		schedules = append(schedules, *sc)
+	}
+	sort.Slice(schedules, func(i, k int) bool { return schedules[i].Name < schedules[k].Name })
+	return schedules, nil
+}
+
+func (s *memoryStore) DeleteSchedule(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[name]; !ok {
+		return false, nil
+	}
+	delete(s.schedules, name)
+	return true, nil
+}
+
+func (s *memoryStore) UpdateScheduleRun(name string, lastRun time.Time, jobID uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sc, ok := s.schedules[name]; ok {
+		sc.LastRun = lastRun
+		sc.LastJobID = jobID
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// selectJobs returns copies of the jobs matching a predicate
+func (s *memoryStore) selectJobs(match func(j *ProcessedJob) bool) []ProcessedJob {
+	jobs := []ProcessedJob{}
+	for _, j := range s.jobs {
+		if match(j) {
+			jobs = append(jobs, *j)
+		}
+	}
+	return jobs
+}
+
+// paginate returns the page of at most limit jobs starting at offset
+func paginate(jobs []ProcessedJob, limit, offset int) []ProcessedJob {
+	if offset >= len(jobs) {
+		return []ProcessedJob{}
+	}
+	jobs = jobs[offset:]
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs
+}
+
+func containsID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package cvmfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryStoreJobs(t *testing.T) {
+	s := newMemoryStore()
+
+	t0 := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	a, b := uuid.New(), uuid.New()
+	jobs := []ProcessedJob{
+		{UnprocessedJob: UnprocessedJob{ID: a, JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", LeasePath: "/lcg_95/x"}},
+			SubmitTime: t0, State: JobStateSubmitted},
+		{UnprocessedJob: UnprocessedJob{ID: b, JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", LeasePath: "/lcg_96",
+			Dependencies: []string{a.String(), uuid.New().String(), "x"}}},
+			SubmitTime: t0.Add(time.Minute), State: JobStateWaiting},
+	}
+	if err := s.InsertJobs(jobs); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.InsertJobs(jobs[:1]); err == nil {
+		t.Errorf("job recorded twice")
+	}
+
+	// Dependencies on unknown jobs are skipped
+	if deps, _ := s.JobDependencies(b); len(deps) != 1 || deps[0] != a {
+		t.Errorf("unexpected dependencies: %v", deps)
+	}
+	if deps, _ := s.PendingDependents(a); len(deps) != 1 || deps[0] != b {
+		t.Errorf("unexpected pending dependents: %v", deps)
+	}
+
+	// Jobs are listed from the most recently submitted
+	page, more, _ := s.ListJobs(&JobFilter{Limit: 1})
+	if len(page) != 1 || page[0].ID != b || !more {
+		t.Errorf("unexpected first page: %+v", page)
+	}
+	page, more, _ = s.ListJobs(&JobFilter{Limit: 1, Offset: 1})
+	if len(page) != 1 || page[0].ID != a || more {
+		t.Errorf("unexpected second page: %+v", page)
+	}
+	page, _, _ = s.ListJobs(&JobFilter{LeasePathPrefix: "/lcg_95", Limit: 10})
+	if len(page) != 1 || page[0].ID != a {
+		t.Errorf("unexpected jobs under lease path: %+v", page)
+	}
+
+	// Only the priority of a queued job can change
+	if ok, _ := s.UpdateJobPriority(a, 3); !ok {
+		t.Errorf("priority of a queued job not updated")
+	}
+	if found, _ := s.GetJobs([]string{a.String()}, false); found[0].Priority != 3 {
+		t.Errorf("unexpected priority: %v", found[0].Priority)
+	}
+
+	// The state of a finished job can't change
+	if ok, _ := s.UpdateJobState(a, JobStateRunning, "w1", t0.Add(2*time.Minute)); !ok {
+		t.Errorf("state of a pending job not updated")
+	}
+	if ok, _ := s.UpdateJobPriority(a, 4); ok {
+		t.Errorf("priority of a running job updated")
+	}
+	if ok, _ := s.FinishJob(b, JobStateCancelled, "cancelled", t0.Add(3*time.Minute)); !ok {
+		t.Errorf("pending job not finished")
+	}
+	if ok, _ := s.FinishJob(b, JobStateFailed, "failed", t0.Add(4*time.Minute)); ok {
+		t.Errorf("finished job finished again")
+	}
+
+	// The submission time is kept, and the attempts are numbered after the recorded ones
+	done := ProcessedJob{
+		UnprocessedJob: jobs[0].UnprocessedJob,
+		WorkerName:     "w1",
+		FinishTime:     t0.Add(5 * time.Minute),
+		State:          JobStateSucceeded,
+		Successful:     true,
+		Attempts:       []JobAttempt{{Attempt: 1, WorkerName: "w1"}},
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.PutJob(&done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, _ := s.GetJobs([]string{a.String(), "x", uuid.New().String()}, true)
+	if len(found) != 1 || !found[0].SubmitTime.Equal(t0) || len(found[0].Attempts) != 2 ||
+		found[0].Attempts[1].Attempt != 2 {
+		t.Errorf("unexpected job: %+v", found)
+	}
+	if found, _ = s.GetJobs([]string{a.String()}, false); len(found[0].Attempts) != 0 {
+		t.Errorf("attempts returned without being requested: %+v", found[0])
+	}
+
+	// Deleting a job deletes the dependencies on it
+	if err := s.DeleteJobs([]uuid.UUID{a}); err != nil {
+		t.Fatal(err)
+	}
+	if deps, _ := s.JobDependencies(b); len(deps) != 0 {
+		t.Errorf("dependency on a deleted job: %v", deps)
+	}
+	if repos, _ := s.Repositories(); len(repos) != 1 || repos[0] != "sft.cern.ch" {
+		t.Errorf("unexpected repositories: %v", repos)
+	}
+}
+
+func TestMemoryStoreExpiredJobs(t *testing.T) {
+	s := newMemoryStore()
+
+	now := time.Date(2019, 3, 8, 0, 0, 0, 0, time.UTC)
+	add := func(state string, finished time.Time) uuid.UUID {
+		id := uuid.New()
+		j := ProcessedJob{
+			UnprocessedJob: UnprocessedJob{ID: id, JobSpecification: JobSpecification{
+				Repository: "sft.cern.ch"}},
+			SubmitTime: finished, FinishTime: finished, State: state}
+		if err := s.InsertJobs([]ProcessedJob{j}); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	old := add(JobStateSucceeded, now.AddDate(0, 0, -10))
+	add(JobStateFailed, now.AddDate(0, 0, -10))
+	recent := add(JobStateSucceeded, now.AddDate(0, 0, -1))
+	add(JobStateRunning, time.Time{})
+
+	// Failed jobs are kept longer
+	expired, _ := s.ExpiredJobs("sft.cern.ch", now.AddDate(0, 0, -7), now.AddDate(0, 0, -30), 10, 0)
+	if len(expired) != 1 || expired[0].ID != old {
+		t.Errorf("unexpected expired jobs: %+v", expired)
+	}
+
+	if ids, _ := s.RecentJobs("sft.cern.ch", 1); len(ids) != 1 || ids[0] != recent {
+		t.Errorf("unexpected recent jobs: %v", ids)
+	}
+}
+
+func TestMemoryStoreSchedules(t *testing.T) {
+	s := newMemoryStore()
+
+	t0 := time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"weekly", "nightly"} {
+		sc := JobSchedule{Name: name, Cron: "@daily", Source: scheduleSourceAPI, CreateTime: t0}
+		if err := s.PutSchedule(&sc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := uuid.New()
+	if err := s.UpdateScheduleRun("nightly", t0.Add(time.Hour), job); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replacing the definition of a schedule keeps its creation time, source and last run
+	sc := JobSchedule{
+		Name: "nightly", Cron: "@hourly", Source: scheduleSourceConfig, CreateTime: t0.Add(time.Minute)}
+	if err := s.PutSchedule(&sc); err != nil {
+		t.Fatal(err)
+	}
+	schedules, _ := s.GetSchedules()
+	if len(schedules) != 2 || schedules[0].Name != "nightly" || schedules[1].Name != "weekly" {
+		t.Fatalf("unexpected schedules: %+v", schedules)
+	}
+	if n := schedules[0]; n.Cron != "@hourly" || !n.CreateTime.Equal(t0) || n.Source != scheduleSourceAPI ||
+		!n.LastRun.Equal(t0.Add(time.Hour)) || n.LastJobID != job {
+		t.Errorf("unexpected schedule: %+v", n)
+	}
+
+	if ok, _ := s.DeleteSchedule("weekly"); !ok {
+		t.Errorf("schedule not deleted")
+	}
+	if ok, _ := s.DeleteSchedule("weekly"); ok {
+		t.Errorf("unknown schedule deleted")
+	}
+}
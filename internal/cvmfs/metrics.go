@@ -0,0 +1,218 @@
+package cvmfs
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The server and the worker each expose their own set of metrics, in a separate registry
+var (
+	serverRegistry = prometheus.NewRegistry()
+	workerRegistry = prometheus.NewRegistry()
+)
+
+// Server metrics
+var (
+	jobSubmissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "job_submissions_total",
+		Help:      "Number of submitted jobs, by result of the submission.",
+	}, []string{"result"})
+
+	jobStatusPosts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "job_status_posts_total",
+		Help:      "Number of job completion statuses posted by workers, by final state.",
+	}, []string{"state"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of the database operations, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	publishFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "publish_failures_total",
+		Help:      "Number of messages which could not be published to the queue, by exchange.",
+	}, []string{"exchange"})
+
+	dependencyWaitDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "dependency_wait_seconds",
+		Help:      "Time spent by jobs waiting for their dependencies, from submission to release.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	jobsPruned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "jobs_pruned_total",
+		Help:      "Number of finished jobs deleted from the job DB by the retention policy.",
+	})
+
+	scheduleRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "schedule_runs_total",
+		Help:      "Number of runs of the job schedules, by result (submitted, missed, overlap, error).",
+	}, []string{"result"})
+
+	serverQueueConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "conveyor",
+		Subsystem: "server",
+		Name:      "queue_connected",
+		Help:      "Whether the server is connected to the job queue (1) or reconnecting (0).",
+	})
+)
+
+// Worker metrics
+var (
+	jobsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "worker",
+		Name:      "jobs_processed_total",
+		Help:      "Number of jobs processed by the worker, by final state.",
+	}, []string{"state"})
+
+	jobRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "conveyor",
+		Subsystem: "worker",
+		Name:      "job_retries_total",
+		Help:      "Number of retried job transactions.",
+	})
+
+	transactionPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "conveyor",
+		Subsystem: "worker",
+		Name:      "transaction_phase_duration_seconds",
+		Help:      "Duration of the phases of a job transaction (download, script, publish).",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"phase"})
+
+	workerQueueConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "conveyor",
+		Subsystem: "worker",
+		Name:      "queue_connected",
+		Help:      "Whether the worker is connected to the job queue (1) or reconnecting (0).",
+	})
+)
+
+func init() {
+	serverRegistry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		jobSubmissions, jobStatusPosts, httpRequestDuration, dbQueryDuration,
+		publishFailures, dependencyWaitDuration, jobsPruned, scheduleRuns, serverQueueConnected)
+
+	workerRegistry.MustRegister(
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGoCollector(),
+		jobsProcessed, jobRetries, transactionPhaseDuration, workerQueueConnected)
+}
+
+// observeSince records the time elapsed since t0 in a histogram
+func observeSince(o prometheus.Observer, t0 time.Time) {
+	o.Observe(time.Since(t0).Seconds())
+}
+
+// observeDBQuery records the latency of a database operation started at t0
+func observeDBQuery(operation string, t0 time.Time) {
+	observeSince(dbQueryDuration.WithLabelValues(operation), t0)
+}
+
+// setGauge returns a function setting a gauge to 1 when its argument is true, and to 0
+// otherwise
+func setGauge(g prometheus.Gauge) func(bool) {
+	return func(v bool) {
+		if v {
+			g.Set(1)
+		} else {
+			g.Set(0)
+		}
+	}
+}
+
+// countSubmissions records the result of the submission of n jobs
+func countSubmissions(n int, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	jobSubmissions.WithLabelValues(result).Add(float64(n))
+}
+
+// metricsHandler returns the HTTP handler exposing the metrics of a registry
+func metricsHandler(reg *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
+
+// statusRecorder keeps the status code of an HTTP response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// httpMetrics is a middleware recording the latency of the requests to the job server
+func httpMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t0 := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+		next.ServeHTTP(rec, req)
+
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if tpl, err := r.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		observeSince(
+			httpRequestDuration.WithLabelValues(route, req.Method, strconv.Itoa(rec.code)), t0)
+	})
+}
+
+// startMetricsListener serves the worker metrics on a separate HTTP listener
+func startMetricsListener(port int) error {
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", metricsHandler(workerRegistry))
+
+	srv := &http.Server{
+		Handler:      handler,
+		Addr:         fmt.Sprintf(":%d", port),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+
+	if err := srv.ListenAndServe(); err != nil {
+		return errors.Wrap(err, "metrics listener error")
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package cvmfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SharedKey = "TESTKEY"
+
+	countSubmissions(2, nil)
+
+	router, err := newRouter(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The metrics are served without authorization
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code for /metrics: %v", rec.Code)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	if !strings.Contains(string(body), `conveyor_server_job_submissions_total{result="ok"}`) {
+		t.Errorf("missing submission counter in metrics:\n%s", body)
+	}
+	if strings.Contains(string(body), "conveyor_worker_") {
+		t.Errorf("worker metrics exposed by the server")
+	}
+
+	// The API routes still require authorization
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "invalid")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Errorf("unauthorized API request was accepted")
+	}
+
+	// The metrics endpoint can be disabled
+	cfg.Server.EnableMetrics = false
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	rec = httptest.NewRecorder()
+	router, err = newRouter(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Errorf("metrics served although disabled")
+	}
+}
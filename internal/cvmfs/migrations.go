@@ -0,0 +1,606 @@
+package cvmfs
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// migration is a step updating the job DB schema from version Version-1 to Version.
+// The statements of a migration are applied in a single transaction, together with the
+// update of the SchemaVersion table. Transform, if set, is called after the statements,
+// for the data migrations which can't be written portably in SQL
+type migration struct {
+	Version     int
+	Description string
+	Statements  []string
+	Transform   func(tx *sql.Tx, adapter databaseAdapter) error
+}
+
+// postgresMigrations are the schema migrations for PostgreSQL, in order
+var postgresMigrations = []migration{
+	{
+		Version:     1,
+		Description: "create the Jobs table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS Jobs (
+    ID char(36) NOT NULL UNIQUE PRIMARY KEY,
+    JobName varchar(65535) NOT NULL,
+    Repository varchar(65535) NOT NULL,
+    Payload varchar(65535) NOT NULL,
+    LeasePath varchar(65535) NOT NULL,
+    Dependencies varchar(65535) NOT NULL,
+    WorkerName varchar(65535) NOT NULL,
+    StartTime timestamp NOT NULL,
+    FinishTime timestamp NOT NULL,
+    Successful boolean NOT NULL,
+    ErrorMessage varchar(65535) NOT NULL
+);`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "record jobs from submission onward, with their lifecycle state",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN State varchar(32);",
+			"ALTER TABLE Jobs ADD COLUMN SubmitTime timestamp;",
+			"ALTER TABLE Jobs ALTER COLUMN StartTime DROP NOT NULL;",
+			"ALTER TABLE Jobs ALTER COLUMN FinishTime DROP NOT NULL;",
+			// Jobs recorded with schema version 1 have all been processed
+			"UPDATE Jobs SET " +
+				"State = CASE WHEN Successful THEN 'succeeded' ELSE 'failed' END, " +
+				"SubmitTime = StartTime;",
+			"ALTER TABLE Jobs ALTER COLUMN State SET NOT NULL;",
+		},
+	},
+	{
+		Version:     3,
+		Description: "store the job dependencies in the JobDependencies table",
+		Statements: []string{
+			`CREATE TABLE JobDependencies (
+    JobID char(36) NOT NULL,
+    DependencyID char(36) NOT NULL,
+    PRIMARY KEY (JobID, DependencyID),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE,
+    FOREIGN KEY (DependencyID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+			"CREATE INDEX JobDependencies_DependencyID ON JobDependencies (DependencyID);",
+		},
+		Transform: copyJobDependencies,
+	},
+	{
+		Version:     4,
+		Description: "record the processing attempts of the jobs in the JobAttempts table",
+		Statements: []string{
+			`CREATE TABLE JobAttempts (
+    JobID char(36) NOT NULL,
+    Attempt int NOT NULL,
+    WorkerName varchar(65535) NOT NULL,
+    StartTime timestamp NOT NULL,
+    FinishTime timestamp NOT NULL,
+    Successful boolean NOT NULL,
+    Phase varchar(32) NOT NULL,
+    ErrorMessage varchar(65535) NOT NULL,
+    ExitCode int NOT NULL,
+    PRIMARY KEY (JobID, Attempt),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "record the priority of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN Priority int NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     6,
+		Description: "record the earliest start time of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN NotBefore timestamp;",
+		},
+	},
+	{
+		Version:     7,
+		Description: "record the recurring jobs in the Schedules table",
+		Statements: []string{
+			`CREATE TABLE Schedules (
+    Name varchar(255) NOT NULL PRIMARY KEY,
+    Cron varchar(255) NOT NULL,
+    Job varchar(65535) NOT NULL,
+    MissedRuns varchar(32) NOT NULL,
+    Source varchar(32) NOT NULL,
+    CreateTime timestamp NOT NULL,
+    LastRun timestamp,
+    LastJobID char(36) NOT NULL
+);`,
+		},
+	},
+}
+
+// mySQLMigrations are the schema migrations for MySQL, in order. Text columns use the
+// TEXT type, since the size of a MySQL row is limited to 64 KiB. MySQL commits the
+// transaction implicitly after each schema change, so a failed migration can leave the
+// DB partially migrated
+var mySQLMigrations = []migration{
+	{
+		Version:     1,
+		Description: "create the Jobs table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS Jobs (
+    ID char(36) NOT NULL UNIQUE PRIMARY KEY,
+    JobName text NOT NULL,
+    Repository text NOT NULL,
+    Payload text NOT NULL,
+    LeasePath text NOT NULL,
+    Dependencies text NOT NULL,
+    WorkerName text NOT NULL,
+    StartTime datetime(6) NOT NULL,
+    FinishTime datetime(6) NOT NULL,
+    Successful boolean NOT NULL,
+    ErrorMessage text NOT NULL
+);`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "record jobs from submission onward, with their lifecycle state",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN State varchar(32), ADD COLUMN SubmitTime datetime(6), " +
+				"MODIFY StartTime datetime(6) NULL, MODIFY FinishTime datetime(6) NULL;",
+			// Jobs recorded with schema version 1 have all been processed
+			"UPDATE Jobs SET " +
+				"State = CASE WHEN Successful THEN 'succeeded' ELSE 'failed' END, " +
+				"SubmitTime = StartTime;",
+			"ALTER TABLE Jobs MODIFY State varchar(32) NOT NULL;",
+		},
+	},
+	{
+		Version:     3,
+		Description: "store the job dependencies in the JobDependencies table",
+		Statements: []string{
+			`CREATE TABLE JobDependencies (
+    JobID char(36) NOT NULL,
+    DependencyID char(36) NOT NULL,
+    PRIMARY KEY (JobID, DependencyID),
+    INDEX (DependencyID),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE,
+    FOREIGN KEY (DependencyID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+		},
+		Transform: copyJobDependencies,
+	},
+	{
+		Version:     4,
+		Description: "record the processing attempts of the jobs in the JobAttempts table",
+		Statements: []string{
+			`CREATE TABLE JobAttempts (
+    JobID char(36) NOT NULL,
+    Attempt int NOT NULL,
+    WorkerName text NOT NULL,
+    StartTime datetime(6) NOT NULL,
+    FinishTime datetime(6) NOT NULL,
+    Successful boolean NOT NULL,
+    Phase varchar(32) NOT NULL,
+    ErrorMessage text NOT NULL,
+    ExitCode int NOT NULL,
+    PRIMARY KEY (JobID, Attempt),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "record the priority of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN Priority int NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     6,
+		Description: "record the earliest start time of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN NotBefore datetime(6);",
+		},
+	},
+	{
+		Version:     7,
+		Description: "record the recurring jobs in the Schedules table",
+		Statements: []string{
+			`CREATE TABLE Schedules (
+    Name varchar(255) NOT NULL PRIMARY KEY,
+    Cron varchar(255) NOT NULL,
+    Job text NOT NULL,
+    MissedRuns varchar(32) NOT NULL,
+    Source varchar(32) NOT NULL,
+    CreateTime datetime(6) NOT NULL,
+    LastRun datetime(6),
+    LastJobID char(36) NOT NULL
+);`,
+		},
+	},
+}
+
+// sqliteMigrations are the schema migrations for SQLite, in order. SQLite can't change
+// the constraints of a column, so tables are created again with the new schema and the
+// rows are copied over
+var sqliteMigrations = []migration{
+	{
+		Version:     1,
+		Description: "create the Jobs table",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS Jobs (
+    ID char(36) NOT NULL UNIQUE PRIMARY KEY,
+    JobName text NOT NULL,
+    Repository text NOT NULL,
+    Payload text NOT NULL,
+    LeasePath text NOT NULL,
+    Dependencies text NOT NULL,
+    WorkerName text NOT NULL,
+    StartTime timestamp NOT NULL,
+    FinishTime timestamp NOT NULL,
+    Successful boolean NOT NULL,
+    ErrorMessage text NOT NULL
+);`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "record jobs from submission onward, with their lifecycle state",
+		Statements: []string{
+			`CREATE TABLE Jobs_v2 (
+    ID char(36) NOT NULL UNIQUE PRIMARY KEY,
+    JobName text NOT NULL,
+    Repository text NOT NULL,
+    Payload text NOT NULL,
+    LeasePath text NOT NULL,
+    Dependencies text NOT NULL,
+    WorkerName text NOT NULL,
+    StartTime timestamp,
+    FinishTime timestamp,
+    Successful boolean NOT NULL,
+    ErrorMessage text NOT NULL,
+    State varchar(32) NOT NULL,
+    SubmitTime timestamp
+);`,
+			// Jobs recorded with schema version 1 have all been processed
+			"INSERT INTO Jobs_v2 SELECT ID, JobName, Repository, Payload, LeasePath, " +
+				"Dependencies, WorkerName, StartTime, FinishTime, Successful, ErrorMessage, " +
+				"CASE WHEN Successful THEN 'succeeded' ELSE 'failed' END, StartTime FROM Jobs;",
+			"DROP TABLE Jobs;",
+			"ALTER TABLE Jobs_v2 RENAME TO Jobs;",
+		},
+	},
+	{
+		Version:     3,
+		Description: "store the job dependencies in the JobDependencies table",
+		Statements: []string{
+			`CREATE TABLE JobDependencies (
+    JobID char(36) NOT NULL,
+    DependencyID char(36) NOT NULL,
+    PRIMARY KEY (JobID, DependencyID),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE,
+    FOREIGN KEY (DependencyID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+			"CREATE INDEX JobDependencies_DependencyID ON JobDependencies (DependencyID);",
+		},
+		Transform: copyJobDependencies,
+	},
+	{
+		Version:     4,
+		Description: "record the processing attempts of the jobs in the JobAttempts table",
+		Statements: []string{
+			`CREATE TABLE JobAttempts (
+    JobID char(36) NOT NULL,
+    Attempt integer NOT NULL,
+    WorkerName text NOT NULL,
+    StartTime timestamp NOT NULL,
+    FinishTime timestamp NOT NULL,
+    Successful boolean NOT NULL,
+    Phase varchar(32) NOT NULL,
+    ErrorMessage text NOT NULL,
+    ExitCode integer NOT NULL,
+    PRIMARY KEY (JobID, Attempt),
+    FOREIGN KEY (JobID) REFERENCES Jobs (ID) ON DELETE CASCADE
+);`,
+		},
+	},
+	{
+		Version:     5,
+		Description: "record the priority of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN Priority integer NOT NULL DEFAULT 0;",
+		},
+	},
+	{
+		Version:     6,
+		Description: "record the earliest start time of the jobs",
+		Statements: []string{
+			"ALTER TABLE Jobs ADD COLUMN NotBefore timestamp;",
+		},
+	},
+	{
+		Version:     7,
+		Description: "record the recurring jobs in the Schedules table",
+		Statements: []string{
+			`CREATE TABLE Schedules (
+    Name varchar(255) NOT NULL PRIMARY KEY,
+    Cron varchar(255) NOT NULL,
+    Job text NOT NULL,
+    MissedRuns varchar(32) NOT NULL,
+    Source varchar(32) NOT NULL,
+    CreateTime timestamp NOT NULL,
+    LastRun timestamp,
+    LastJobID char(36) NOT NULL
+);`,
+		},
+	},
+}
+
+// SchemaVersionInfo describes a version of the job DB schema
+type SchemaVersionInfo struct {
+	Version     int
+	Description string
+	Applied     bool
+	ValidFrom   time.Time
+	ValidTo     time.Time
+}
+
+// SchemaStatus is the state of the schema of the job DB
+type SchemaStatus struct {
+	// CurrentVersion is 0 if the DB is not initialized
+	CurrentVersion int
+	LatestVersion  int
+	Versions       []SchemaVersionInfo
+}
+
+// InitDatabase creates the schema of an empty job DB
+func InitDatabase(cfg *BackendConfig) error {
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := createSchemaVersionTable(db, adapter); err != nil {
+		return err
+	}
+	current, err := getSchemaVersion(db, adapter)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve current DB schema version")
+	}
+	if current != 0 {
+		return fmt.Errorf("database is already initialized with schema version %v", current)
+	}
+
+	return applyMigrations(db, adapter)
+}
+
+// MigrateDatabase updates the schema of the job DB to the latest version
+func MigrateDatabase(cfg *BackendConfig) error {
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return migrateDatabase(db, adapter)
+}
+
+// GetSchemaStatus returns the current schema version of the job DB and the history of
+// the schema versions
+func GetSchemaStatus(cfg *BackendConfig) (*SchemaStatus, error) {
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	status := SchemaStatus{LatestVersion: SchemaVersion}
+
+	applied := map[int]SchemaVersionInfo{}
+	rows, err := db.Query(adapter.schemaHistoryQuery())
+	if err != nil {
+		return nil, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v SchemaVersionInfo
+		if err := rows.Scan(
+			&v.Version, nullTime{&v.ValidFrom}, nullTime{&v.ValidTo}); err != nil {
+			return nil, errors.Wrap(err, "SQL query scan failed")
+		}
+		v.Applied = true
+		applied[v.Version] = v
+		if v.ValidTo.IsZero() && v.Version > status.CurrentVersion {
+			status.CurrentVersion = v.Version
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "SQL query failed")
+	}
+
+	for _, m := range adapter.migrations() {
+		v, ok := applied[m.Version]
+		if !ok {
+			v.Version = m.Version
+		}
+		v.Description = m.Description
+		status.Versions = append(status.Versions, v)
+	}
+
+	return &status, nil
+}
+
+// openDatabase opens the connection to the job DB
+func openDatabase(cfg *BackendConfig) (*sql.DB, databaseAdapter, error) {
+	if cfg.Type == memoryBackendType {
+		return nil, nil, errors.New("the in-memory job store has no database")
+	}
+
+	adapter, err := newDatabaseAdapter(cfg.Type)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not crate database query adapter")
+	}
+
+	if !driverRegistered(adapter.driverName()) {
+		return nil, nil, fmt.Errorf(
+			"the %v database driver is not included in this build of conveyor", cfg.Type)
+	}
+
+	db, err := sql.Open(
+		adapter.driverName(),
+		adapter.dataSourceName(cfg))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not create SQL connection")
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, nil, errors.Wrap(err, "connection ping failed")
+	}
+
+	return db, adapter, nil
+}
+
+// driverRegistered returns true if the SQL driver with the given name is registered
+func driverRegistered(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createSchemaVersionTable creates the SchemaVersion table, if it doesn't exist
+func createSchemaVersionTable(db *sql.DB, adapter databaseAdapter) error {
+	if _, err := db.Exec(adapter.createSchemaVersionTableStatement()); err != nil {
+		return errors.Wrap(err, "could not create SchemaVersion table")
+	}
+	return nil
+}
+
+// migrateDatabase applies the pending migrations to an initialized job DB
+func migrateDatabase(db *sql.DB, adapter databaseAdapter) error {
+	if err := createSchemaVersionTable(db, adapter); err != nil {
+		return err
+	}
+	current, err := getSchemaVersion(db, adapter)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve current DB schema version")
+	}
+	if current == 0 {
+		return errors.New("database is not initialized, run \"conveyor db init\" first")
+	}
+	if current > SchemaVersion {
+		return fmt.Errorf(
+			"database schema version %v is newer than the latest known version %v",
+			current, SchemaVersion)
+	}
+
+	return applyMigrations(db, adapter)
+}
+
+// applyMigrations applies, in order, the migrations newer than the current schema
+// version of the job DB. Each migration is applied in its own transaction
+func applyMigrations(db *sql.DB, adapter databaseAdapter) error {
+	for _, m := range adapter.migrations() {
+		applied, err := applyMigration(db, adapter, &m)
+		if err != nil {
+			return errors.Wrapf(err, "migration to schema version %v failed", m.Version)
+		}
+		if applied {
+			Log.Info().
+				Int("version", m.Version).
+				Str("description", m.Description).
+				Msg("database schema migrated")
+		}
+	}
+	return nil
+}
+
+// applyMigration applies a migration, unless the job DB is already at its version or
+// newer. It returns true if the migration was applied
+func applyMigration(db *sql.DB, adapter databaseAdapter, m *migration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, errors.Wrap(err, "could not begin SQL transaction")
+	}
+	defer tx.Rollback()
+
+	// The version is checked again in the transaction, in case the job DB was migrated
+	// concurrently
+	var current sql.NullInt64
+	if err := tx.QueryRow(adapter.currentSchemaVersionQuery()).Scan(&current); err != nil {
+		return false, errors.Wrap(err, "could not retrieve current DB schema version")
+	}
+	if int(current.Int64) >= m.Version {
+		return false, nil
+	}
+	if int(current.Int64) != m.Version-1 {
+		return false, fmt.Errorf(
+			"database schema version is %v, expected %v", current.Int64, m.Version-1)
+	}
+
+	for _, stmt := range m.Statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return false, errors.Wrap(err, "SQL statement failed")
+		}
+	}
+	if m.Transform != nil {
+		if err := m.Transform(tx, adapter); err != nil {
+			return false, errors.Wrap(err, "data migration failed")
+		}
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec(adapter.closeSchemaVersionStatement(), now); err != nil {
+		return false, errors.Wrap(err, "could not update SchemaVersion table")
+	}
+	if _, err := tx.Exec(adapter.insertSchemaVersionStatement(), m.Version, now); err != nil {
+		return false, errors.Wrap(err, "could not update SchemaVersion table")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "committing SQL transaction failed")
+	}
+
+	return true, nil
+}
+
+// copyJobDependencies fills the JobDependencies table from the comma-separated lists of
+// dependencies of the Jobs table. Dependencies on unknown jobs are skipped
+func copyJobDependencies(tx *sql.Tx, adapter databaseAdapter) error {
+	rows, err := tx.Query("SELECT ID, Dependencies FROM Jobs WHERE Dependencies <> '';")
+	if err != nil {
+		return errors.Wrap(err, "SQL query failed")
+	}
+	// The rows are read before inserting, since some drivers can't run a statement on
+	// a connection while the results of a query are pending
+	deps := map[string][]string{}
+	for rows.Next() {
+		var id, list string
+		if err := rows.Scan(&id, &list); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "SQL query scan failed")
+		}
+		deps[id] = strings.Split(list, ",")
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "SQL query failed")
+	}
+
+	for id, list := range deps {
+		if err := insertJobDependencies(tx, adapter, id, list); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
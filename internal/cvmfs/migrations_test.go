@@ -0,0 +1,26 @@
+package cvmfs
+
+import "testing"
+
+func TestMigrations(t *testing.T) {
+	for _, dbType := range []string{"postgres", "mysql", "sqlite"} {
+		adapter, err := newDatabaseAdapter(dbType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		migrations := adapter.migrations()
+		for i, m := range migrations {
+			if m.Version != i+1 {
+				t.Errorf("%v: migration %v has version %v", dbType, i, m.Version)
+			}
+			if m.Description == "" || len(m.Statements) == 0 {
+				t.Errorf("%v: migration %v is incomplete", dbType, m.Version)
+			}
+		}
+		if len(migrations) != SchemaVersion {
+			t.Errorf("%v: migrations end at version %v, latest schema version is %v",
+				dbType, len(migrations), SchemaVersion)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package cvmfs
 
 import (
+	"crypto/tls"
 	"encoding/json"
-	"os"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
 )
@@ -15,109 +17,486 @@ const (
 	successKey string = "success"
 	// failedKey - routing/binding key for failed jobs
 	failedKey string = "failure"
+	// cancelledKey - routing/binding key for cancelled jobs
+	cancelledKey string = "cancelled"
 )
 
+// notificationKey returns the routing key of the completion notification of a job
+// in a final state
+func notificationKey(state string) string {
+	switch state {
+	case JobStateSucceeded:
+		return successKey
+	case JobStateCancelled:
+		return cancelledKey
+	default:
+		return failedKey
+	}
+}
+
 // The type of connection to be established to RabbitMQ
 const (
 	consumerConnection = iota
 	publisherConnection
 )
 
+// Number of seconds before the first attempt to reconnect to the queue, and maximum
+// number of seconds between two attempts
+const (
+	reconnectInitWait = 1
+	reconnectMaxWait  = 60
+)
+
+// Header of a job message holding the number of its deliveries which failed. The broker
+// doesn't count the deliveries of a message, so the workers publish again each
+// redelivered message with this header incremented
+const failedDeliveriesHeader = "x-conveyor-failed-deliveries"
+
+// Maximum time the publisher waits for the broker to confirm a message
+const publishConfirmTimeout = 10 * time.Second
+
+// Capacity of the channels receiving the confirmations and returned messages. They are
+// read continuously, the buffer only absorbs bursts
+const confirmBufferSize = 16
+
+var (
+	errQueueDisconnected = errors.New("not connected to the job queue")
+	errQueueClosed       = errors.New("queue client closed")
+	errMessageUnroutable = errors.New("message could not be routed to a queue")
+)
+
+// amqpConnection is the part of a connection to the broker used by the queue client
+type amqpConnection interface {
+	Channel() (amqpChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// amqpChannel is the part of an AMQP channel used by the queue client
+type amqpChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ExchangeDeclare(
+		name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(
+		name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool,
+		args amqp.Table) (<-chan amqp.Delivery, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(returns chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Nack(tag uint64, multiple, requeue bool) error
+	QueuePurge(name string, noWait bool) (int, error)
+}
+
+// amqpConn is a connection to a RabbitMQ instance
+type amqpConn struct {
+	*amqp.Connection
+}
+
+func (c amqpConn) Channel() (amqpChannel, error) {
+	ch, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
 // QueueClient containts all the objects associated with a connection to a RabbitMQ
-// instance
+// instance. When the connection is lost, the client connects again in the background,
+// declares again the exchanges and queues, and resumes the consumers
 type QueueClient struct {
-	Conn              *amqp.Connection
-	Chan              *amqp.Channel
-	NewJobQueue       *amqp.Queue
-	CompletedJobQueue *amqp.Queue
+	cfg                  *QueueConfig
+	dial                 func() (amqpConnection, error)
+	connType             int
+	completedJobExchange string
+
+	mu        sync.Mutex
+	conn      amqpConnection
+	ch        amqpChannel
+	confirms  *confirmState
+	consumers []*queueConsumer
+	callbacks []func(connected bool)
+	closed    bool
+	done      chan struct{}
+
+	// The goroutines forwarding the messages of the consumers
+	forwarders sync.WaitGroup
+
+	// Serializes the publications, so that each one waits for its own confirmation
+	pubMu sync.Mutex
+}
+
+// confirmState receives the confirmations and the returned messages of a channel in
+// confirm mode, and hands the confirmation of the message being published to the
+// publisher. They are received by a dedicated goroutine, so that the late confirmations
+// of the messages whose wait timed out never block the connection
+type confirmState struct {
+	// Number of messages published on the channel, used with pubMu held
+	published uint64
+
+	mu       sync.Mutex
+	closed   bool
+	tag      uint64 // delivery tag of the message waiting for its confirmation
+	id       string
+	returned bool
+	reply    string
+	result   chan error
+}
+
+// queueConsumer is a subscription to a queue, which is resumed after a reconnection.
+// "declare" declares and binds the queue on a new channel and returns its name
+type queueConsumer struct {
+	declare    func(ch amqpChannel) (string, error)
+	autoAck    bool
+	deliveries chan amqp.Delivery
 }
 
 // NewQueueClient creates a new connection to the queue. connType can either be
-// consumerConnection or publisherConnection
+// consumerConnection or publisherConnection. Only the first connection attempt
+// is made synchronously, an error is returned if it fails
 func NewQueueClient(cfg *QueueConfig, connType int) (*QueueClient, error) {
+	var tlsCfg *tls.Config
+	if cfg.TLS {
+		var err error
+		if tlsCfg, err = newQueueTLSConfig(cfg); err != nil {
+			return nil, errors.Wrap(err, "could not create AMQP TLS configuration")
+		}
+	}
+
+	return newQueueClient(cfg, connType, func() (amqpConnection, error) {
+		return dialQueue(cfg, tlsCfg)
+	})
+}
+
+// newQueueClient creates a queue client opening its connections to the broker with
+// "dial"
+func newQueueClient(
+	cfg *QueueConfig, connType int, dial func() (amqpConnection, error)) (*QueueClient, error) {
+	c := &QueueClient{
+		cfg: cfg, dial: dial, connType: connType,
+		completedJobExchange: cfg.CompletedJobExchange, done: make(chan struct{})}
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// dialQueue opens a new connection to the broker, over TLS if tlsCfg is set
+func dialQueue(cfg *QueueConfig, tlsCfg *tls.Config) (amqpConnection, error) {
+	if tlsCfg != nil {
+		dialStr := createConnectionURL(
+			"amqps", cfg.Username, cfg.Password, cfg.Host, cfg.VHost, cfg.Port)
+		connection, err := amqp.DialTLS(dialStr, tlsCfg)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not open AMQPS connection")
+		}
+		return amqpConn{connection}, nil
+	}
+
 	dialStr := createConnectionURL(
-		cfg.Username, cfg.Password, cfg.Host, cfg.VHost, cfg.Port)
+		"amqp", cfg.Username, cfg.Password, cfg.Host, cfg.VHost, cfg.Port)
 	connection, err := amqp.Dial(dialStr)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not open AMQP connection")
 	}
+	return amqpConn{connection}, nil
+}
 
+// connect opens a connection and a channel to the broker, declares the exchanges and
+// queues and starts the registered consumers
+func (c *QueueClient) connect() error {
+	connection, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	channel, err := c.setup(connection)
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	connClosed := connection.NotifyClose(make(chan *amqp.Error, 1))
+	chanClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	confirms := newConfirmState(channel)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		connection.Close()
+		return errQueueClosed
+	}
+
+	for _, cons := range c.consumers {
+		if err := c.startConsumer(channel, cons); err != nil {
+			connection.Close()
+			return err
+		}
+	}
+
+	c.conn = connection
+	c.ch = channel
+	c.confirms = confirms
+	c.setConnected(true)
+
+	go c.watch(connClosed, chanClosed)
+
+	return nil
+}
+
+// setup opens a channel on a new connection and declares the exchanges and the
+// dead-letter queue. The job queues are declared by the consumers
+func (c *QueueClient) setup(connection amqpConnection) (amqpChannel, error) {
 	channel, err := connection.Channel()
 	if err != nil {
 		return nil, errors.Wrap(err, "could not open AMQP channel")
 	}
 
-	if err := channel.Qos(1, 0, false); err != nil {
+	// A worker consumes the job queues of several repositories on the same channel, and
+	// only receives a new job once the current one is acknowledged
+	if err := channel.Qos(1, 0, true); err != nil {
 		return nil, errors.Wrap(err, "could not set channel QoS")
 	}
 
+	// The broker confirms each published message once it is handled
+	if err := channel.Confirm(false); err != nil {
+		return nil, errors.Wrap(err, "could not enable publisher confirms")
+	}
+
 	// The exchange for publishing new jobs (to be processed) is durable and
 	// non auto-deleted
 	if err := channel.ExchangeDeclare(
-		cfg.NewJobExchange, "direct", true, false, false, false, nil); err != nil {
+		c.cfg.NewJobExchange, "direct", true, false, false, false, nil); err != nil {
 		return nil, errors.Wrap(err, "could not declare exchange")
 	}
 
 	// The exchange for publishing completedd job notifications is not-durable and
 	// non auto-deleted
 	if err := channel.ExchangeDeclare(
-		cfg.CompletedJobExchange, "topic", false, false, false, false, nil); err != nil {
+		c.cfg.CompletedJobExchange, "topic", false, false, false, false, nil); err != nil {
 		return nil, errors.Wrap(err, "could not declare exchange")
 	}
 
-	c := &QueueClient{connection, channel, nil, nil}
+	// The job messages which are rejected by the workers, or which were delivered too
+	// many times, are routed by the dead-letter exchange to the dead-letter queue, where
+	// they are kept until they are requeued or purged. Both are durable
+	if err := channel.ExchangeDeclare(
+		c.cfg.DeadLetterExchange, "fanout", true, false, false, false, nil); err != nil {
+		return nil, errors.Wrap(err, "could not declare dead-letter exchange")
+	}
+
+	if _, err := channel.QueueDeclare(
+		c.cfg.DeadLetterQueue, true, false, false, false, nil); err != nil {
+		return nil, errors.Wrap(err, "could not declare dead-letter queue")
+	}
+
+	if err := channel.QueueBind(
+		c.cfg.DeadLetterQueue, "", c.cfg.DeadLetterExchange, false, nil); err != nil {
+		return nil, errors.Wrap(err, "could not bind dead-letter queue")
+	}
+
+	return channel, nil
+}
+
+// jobQueueName returns the name of the queue of the new jobs of a repository
+func jobQueueName(cfg *QueueConfig, repository string) string {
+	return cfg.NewJobQueue + "." + repository
+}
 
-	// In a consumer connection relevant queues are declared and bound
-	if connType == consumerConnection {
-		// Declare and bind a queue for new job notifications (round-robin)
-		// This queue is durable, non auto-deleted, non exclusive
-		q1, err := channel.QueueDeclare(cfg.NewJobQueue, true, false, false, false, nil)
+// declareJobQueue returns a function declaring the queue of the new jobs of a
+// repository, bound to the new job exchange with the repository as routing key. The
+// queue is durable, non auto-deleted, non exclusive, and shared by all the workers of
+// the repository (round-robin)
+func (c *QueueClient) declareJobQueue(repository string) func(ch amqpChannel) (string, error) {
+	return func(ch amqpChannel) (string, error) {
+		q, err := ch.QueueDeclare(jobQueueName(c.cfg, repository), true, false, false, false,
+			amqp.Table{
+				"x-dead-letter-exchange": c.cfg.DeadLetterExchange,
+				"x-max-priority":         int32(maxJobPriority),
+			})
 		if err != nil {
-			return nil, errors.Wrap(err, "could not declare new job queue")
+			return "", errors.Wrap(err, "could not declare new job queue")
 		}
 
-		if err := channel.QueueBind(
-			q1.Name, "", cfg.NewJobExchange, false, nil); err != nil {
-			return nil, errors.Wrap(err, "could not bind new job queue")
+		if err := ch.QueueBind(
+			q.Name, repository, c.cfg.NewJobExchange, false, nil); err != nil {
+			return "", errors.Wrap(err, "could not bind new job queue")
 		}
 
-		c.NewJobQueue = &q1
+		return q.Name, nil
+	}
+}
 
-		// Declare and bind a queue for finished job notifications (one-to-all)
-		// This queue has an automatically generated name and is exclusive to
-		// a single consumer. It is not durable and is auto-deleted
-		q2, err := channel.QueueDeclare("", false, true, true, false, nil)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not declare completed job queue")
-		}
+// watch waits for the closure of the connection or of the channel, and connects again
+// unless the client was closed
+func (c *QueueClient) watch(connClosed, chanClosed <-chan *amqp.Error) {
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-chanClosed:
+	}
 
-		if err := channel.QueueBind(
-			q2.Name, "#", cfg.CompletedJobExchange, false, nil); err != nil {
-			return nil, errors.Wrap(err, "could not bind completed job queue")
+	c.mu.Lock()
+	connection := c.conn
+	c.conn = nil
+	c.ch = nil
+	c.confirms = nil
+	closed := c.closed
+	if !closed {
+		c.setConnected(false)
+	}
+	c.mu.Unlock()
+
+	if closed {
+		return
+	}
+
+	// A channel error leaves the connection open
+	connection.Close()
+
+	ev := Log.Error()
+	if reason != nil {
+		ev = ev.Err(reason)
+	}
+	ev.Msg("connection to job queue lost, reconnecting")
+
+	c.reconnect()
+}
+
+// reconnect connects again to the broker, with an exponential backoff between the
+// attempts, until it succeeds or the client is closed
+func (c *QueueClient) reconnect() {
+	w := NewWaiter(reconnectInitWait, reconnectMaxWait)
+	for {
+		w.Wait()
+		err := c.connect()
+		if err == nil {
+			Log.Info().Msg("reconnected to job queue")
+			return
+		}
+		if err == errQueueClosed {
+			return
 		}
+		Log.Error().Err(err).Msg("could not reconnect to job queue")
+	}
+}
 
-		c.CompletedJobQueue = &q2
+// startConsumer declares the queue of a consumer and forwards its messages to the
+// deliveries channel of the consumer, until the channel is closed. Called with the lock
+// held
+func (c *QueueClient) startConsumer(ch amqpChannel, cons *queueConsumer) error {
+	name, err := cons.declare(ch)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := ch.Consume(name, "", cons.autoAck, false, false, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not start consuming messages")
+	}
 
-		go func() {
-			ch := c.Chan.NotifyClose(make(chan *amqp.Error))
-			err, ok := <-ch
-			if ok {
-				Log.Error().Err(err).Msg("connection to job queue closed")
-				os.Exit(1)
+	c.forwarders.Add(1)
+	go func() {
+		defer c.forwarders.Done()
+		for m := range msgs {
+			select {
+			case cons.deliveries <- m:
+			case <-c.done:
+				return
 			}
-		}()
+		}
+	}()
+
+	return nil
+}
+
+// consume subscribes to a queue declared by "declare". The returned channel stays open
+// across reconnections and is only closed when the client is closed. Messages which
+// were not acknowledged when the connection was lost are redelivered by the broker, and
+// acknowledging them afterwards fails
+func (c *QueueClient) consume(
+	declare func(ch amqpChannel) (string, error), autoAck bool) (<-chan amqp.Delivery, error) {
+	cons := &queueConsumer{declare: declare, autoAck: autoAck, deliveries: make(chan amqp.Delivery)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, errQueueClosed
 	}
 
-	return c, nil
+	// While disconnected, the consumer is started by the next reconnection
+	if c.ch != nil {
+		if err := c.startConsumer(c.ch, cons); err != nil {
+			return nil, err
+		}
+	}
+	c.consumers = append(c.consumers, cons)
+
+	return cons.deliveries, nil
+}
+
+// Connected returns true if the client is currently connected to the broker
+func (c *QueueClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ch != nil
 }
 
-// Close the connection to the queue
+// NotifyConnection registers a function called with the current connection state, and
+// then every time the client is disconnected from, or connected again to, the broker.
+// The function is called with the lock of the client held and must not use the client
+func (c *QueueClient) NotifyConnection(f func(connected bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, f)
+	f(c.ch != nil)
+}
+
+// setConnected calls the registered functions with a new connection state. Called with
+// the lock held
+func (c *QueueClient) setConnected(connected bool) {
+	for _, f := range c.callbacks {
+		f(connected)
+	}
+}
+
+// Close the connection to the queue. The channels returned by consume are closed
 func (c *QueueClient) Close() error {
-	return c.Conn.Close()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	connection := c.conn
+	c.mu.Unlock()
+
+	var err error
+	if connection != nil {
+		err = connection.Close()
+	}
+
+	c.forwarders.Wait()
+	for _, cons := range c.consumers {
+		close(cons.deliveries)
+	}
+
+	return err
 }
 
-// publish data (as JSON) to an exchange using the given routing key
-func (c *QueueClient) publish(exchange string, key string, data interface{}) error {
+// publish data (as JSON) to an exchange using the given routing key and message priority.
+// An error is returned while the client is disconnected from the broker
+func (c *QueueClient) publish(exchange string, key string, priority uint8, data interface{}) error {
 	body, err := json.Marshal(data)
 	if err != nil {
 		return errors.Wrap(err, "could not marshal job into JSON")
@@ -125,23 +504,244 @@ func (c *QueueClient) publish(exchange string, key string, data interface{}) err
 
 	msg := amqp.Publishing{
 		DeliveryMode: amqp.Persistent,
+		Priority:     priority,
 		Timestamp:    time.Now(),
 		ContentType:  "text/json",
 		Body:         []byte(body),
 	}
 
-	if err := c.Chan.Publish(
-		exchange, key, true, false, msg); err != nil {
+	return c.publishMessage(exchange, key, msg)
+}
+
+// publishMessage publishes a message to an exchange using the given routing key, and
+// returns once the broker confirmed it. It fails if the broker rejected the message or
+// if a job description could not be routed to any queue
+func (c *QueueClient) publishMessage(exchange string, key string, msg amqp.Publishing) error {
+	c.pubMu.Lock()
+	defer c.pubMu.Unlock()
+
+	c.mu.Lock()
+	ch := c.ch
+	confirms := c.confirms
+	c.mu.Unlock()
+	if ch == nil {
+		return errQueueDisconnected
+	}
+
+	msg.MessageId = uuid.New().String()
+
+	// Completion notifications are only routed to a queue when a client is waiting for
+	// them, so only job descriptions are published as mandatory
+	mandatory := exchange == c.cfg.NewJobExchange
+
+	// The confirmation is expected before publishing, since it can arrive right away
+	tag := confirms.published + 1
+	result, err := confirms.expect(tag, msg.MessageId)
+	if err != nil {
+		return err
+	}
+	if err := ch.Publish(
+		exchange, key, mandatory, false, msg); err != nil {
+		confirms.forget()
 		return errors.Wrap(err, "RabbitMQ publishing failed")
 	}
+	confirms.published = tag
 
-	return nil
+	return confirms.wait(result)
+}
+
+// failedDeliveries returns the number of failed deliveries of a job message, recorded
+// in its headers
+func failedDeliveries(msg *amqp.Delivery) int {
+	switch v := msg.Headers[failedDeliveriesHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// redeliver handles a job message redelivered by the broker, whose previous delivery
+// failed. The message is published again with its count of failed deliveries
+// incremented, and acknowledged. Once it failed maxDeliveries times, it is rejected
+// instead, and dead-lettered by the broker. Returns true if the message was rejected
+func (c *QueueClient) redeliver(msg *amqp.Delivery, maxDeliveries int) (bool, error) {
+	failed := failedDeliveries(msg) + 1
+	if failed >= maxDeliveries {
+		if err := msg.Reject(false); err != nil {
+			return false, errors.Wrap(err, "could not reject job message")
+		}
+		return true, nil
+	}
+
+	headers := amqp.Table{}
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers[failedDeliveriesHeader] = int32(failed)
+
+	republished := amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Priority:     msg.Priority,
+		Timestamp:    msg.Timestamp,
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+	}
+	if err := c.publishMessage(msg.Exchange, msg.RoutingKey, republished); err != nil {
+		return false, errors.Wrap(err, "could not publish job message again")
+	}
+
+	if err := msg.Ack(false); err != nil {
+		return false, errors.Wrap(err, "could not acknowledge job message")
+	}
+
+	return false, nil
+}
+
+// newConfirmState starts receiving the confirmations and the returned messages of a
+// channel in confirm mode
+func newConfirmState(channel amqpChannel) *confirmState {
+	s := &confirmState{}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, confirmBufferSize))
+	returns := channel.NotifyReturn(make(chan amqp.Return, confirmBufferSize))
+	go s.receive(confirms, returns)
+	return s
+}
+
+// receive reads the confirmations and the returned messages until the channel is closed.
+// Those of the messages which are no longer waited for are dropped
+func (s *confirmState) receive(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				// Closed with the channel, the confirmations are closed too
+				returns = nil
+				continue
+			}
+			s.setReturned(&r)
+		case conf, ok := <-confirms:
+			if !ok {
+				s.close()
+				return
+			}
+			// The broker sends a returned message before its confirmation, so it is
+			// already buffered
+			s.drainReturns(returns)
+			s.confirm(&conf)
+		}
+	}
+}
+
+// drainReturns handles the returned messages which were already received
+func (s *confirmState) drainReturns(returns <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				return
+			}
+			s.setReturned(&r)
+		default:
+			return
+		}
+	}
+}
+
+// expect registers the message with the given delivery tag and ID as waiting for its
+// confirmation. The returned channel receives the outcome of the publication
+func (s *confirmState) expect(tag uint64, id string) (<-chan error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errQueueDisconnected
+	}
+	s.tag = tag
+	s.id = id
+	s.returned = false
+	s.reply = ""
+	s.result = make(chan error, 1)
+	return s.result, nil
+}
+
+// forget stops waiting for the confirmation of the current message
+func (s *confirmState) forget() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tag = 0
+	s.id = ""
+	s.result = nil
+}
+
+// wait for the outcome of the publication of the current message
+func (s *confirmState) wait(result <-chan error) error {
+	timer := time.NewTimer(publishConfirmTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		s.forget()
+		return errors.New("timed out waiting for the broker to confirm the message")
+	}
+}
+
+func (s *confirmState) setReturned(r *amqp.Return) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.result != nil && r.MessageId == s.id {
+		s.returned = true
+		s.reply = r.ReplyText
+	}
+}
+
+// confirm hands a confirmation to the publisher waiting for it. The confirmations of
+// earlier messages, whose wait timed out, are skipped
+func (s *confirmState) confirm(conf *amqp.Confirmation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.result == nil || conf.DeliveryTag < s.tag {
+		return
+	}
+
+	var err error
+	switch {
+	case s.returned:
+		Log.Debug().Str("reply", s.reply).Msg("message returned by the broker")
+		err = errMessageUnroutable
+	case !conf.Ack:
+		err = errors.New("message rejected by the broker")
+	}
+	s.result <- err
+	s.result = nil
+	s.tag = 0
+	s.id = ""
+}
+
+// close fails the publication waiting for its confirmation when the channel is closed
+func (s *confirmState) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.result != nil {
+		s.result <- errors.New("connection to job queue lost before the message was confirmed")
+		s.result = nil
+	}
 }
 
-func createConnectionURL(username string,
+func createConnectionURL(scheme string, username string,
 	password string, host string, vhost string, port int) string {
 
-	return "amqp://" + username +
+	return scheme + "://" + username +
 		":" + password +
 		"@" + host +
 		":" + strconv.Itoa(port) + "/" + vhost
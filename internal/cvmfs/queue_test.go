@@ -0,0 +1,418 @@
+package cvmfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeConnection is a connection to a fake broker. Dropping it closes its channel and
+// notifies the client, as when the connection to a broker is lost
+type fakeConnection struct {
+	mu      sync.Mutex
+	closed  bool
+	notify  []chan *amqp.Error
+	channel *fakeChannel
+}
+
+func (c *fakeConnection) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	c.channel = &fakeChannel{consumers: map[string]chan amqp.Delivery{}}
+	return c.channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) Close() error {
+	c.drop(nil)
+	return nil
+}
+
+// drop closes the connection and its channel. The client is notified with "reason",
+// if set
+func (c *fakeConnection) drop(reason *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.channel != nil {
+		c.channel.close()
+	}
+	for _, n := range c.notify {
+		if reason != nil {
+			n <- reason
+		}
+		close(n)
+	}
+}
+
+// fakeChannel is a channel to the fake broker. It records the published messages, and
+// the test delivers the messages of the consumed queues. In confirm mode, the broker
+// confirms each message as soon as it is published
+type fakeChannel struct {
+	mu        sync.Mutex
+	closed    bool
+	consumers map[string]chan amqp.Delivery
+	published []amqp.Publishing
+	notify    []chan *amqp.Error
+
+	confirm  bool
+	hold     bool
+	confirms []chan amqp.Confirmation
+	returns  []chan amqp.Return
+}
+
+func (c *fakeChannel) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	return nil
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return c.err()
+}
+
+func (c *fakeChannel) ExchangeDeclare(
+	name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	return c.err()
+}
+
+func (c *fakeChannel) QueueDeclare(
+	name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, c.err()
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return c.err()
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool,
+	args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, amqp.ErrClosed
+	}
+	msgs := make(chan amqp.Delivery, 10)
+	c.consumers[queue] = msgs
+	return msgs, nil
+}
+
+func (c *fakeChannel) Publish(
+	exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return amqp.ErrClosed
+	}
+	c.published = append(c.published, msg)
+	if c.confirm && !c.hold {
+		for _, confirms := range c.confirms {
+			confirms <- amqp.Confirmation{DeliveryTag: uint64(len(c.published)), Ack: true}
+		}
+	}
+	return nil
+}
+
+func (c *fakeChannel) Confirm(noWait bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirm = true
+	return nil
+}
+
+func (c *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.confirms = append(c.confirms, confirm)
+	return confirm
+}
+
+func (c *fakeChannel) NotifyReturn(returns chan amqp.Return) chan amqp.Return {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.returns = append(c.returns, returns)
+	return returns
+}
+
+func (c *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	return amqp.Delivery{}, false, c.err()
+}
+
+func (c *fakeChannel) Nack(tag uint64, multiple, requeue bool) error {
+	return c.err()
+}
+
+func (c *fakeChannel) QueuePurge(name string, noWait bool) (int, error) {
+	return 0, c.err()
+}
+
+func (c *fakeChannel) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, msgs := range c.consumers {
+		close(msgs)
+	}
+	for _, n := range c.notify {
+		close(n)
+	}
+	for _, confirms := range c.confirms {
+		close(confirms)
+	}
+	for _, returns := range c.returns {
+		close(returns)
+	}
+}
+
+// holdConfirms stops confirming the published messages
+func (c *fakeChannel) holdConfirms() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hold = true
+}
+
+// numPublished returns the number of messages published on the channel
+func (c *fakeChannel) numPublished() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.published)
+}
+
+// deliver a message to the consumer of a queue
+func (c *fakeChannel) deliver(t *testing.T, queue string, body string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs, ok := c.consumers[queue]
+	if !ok {
+		t.Fatalf("queue %v is not consumed", queue)
+	}
+	msgs <- amqp.Delivery{Body: []byte(body)}
+}
+
+// newFakeQueueClient creates a queue client connected to a fake broker. The connections
+// opened by the client are sent to the first returned channel, and the changes of its
+// connection state to the second one
+func newFakeQueueClient(
+	t *testing.T, connType int) (*QueueClient, <-chan *fakeConnection, <-chan bool) {
+	conns := make(chan *fakeConnection, 10)
+	dial := func() (amqpConnection, error) {
+		c := &fakeConnection{}
+		conns <- c
+		return c, nil
+	}
+
+	cfg := QueueConfig{
+		NewJobExchange: "jobs.new", NewJobQueue: "jobs", CompletedJobExchange: "jobs.done"}
+	q, err := newQueueClient(&cfg, connType, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := make(chan bool, 10)
+	q.NotifyConnection(func(connected bool) { states <- connected })
+	expectConnectionState(t, states, true)
+
+	return q, conns, states
+}
+
+func expectConnectionState(t *testing.T, states <-chan bool, expected bool) {
+	select {
+	case connected := <-states:
+		if connected != expected {
+			t.Fatalf("unexpected connection state: %v", connected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("connection state not notified, expected %v", expected)
+	}
+}
+
+func TestQueueClientReconnection(t *testing.T) {
+	q, conns, states := newFakeQueueClient(t, consumerConnection)
+	defer q.Close()
+	conn := <-conns
+
+	msgs, err := q.consume(func(ch amqpChannel) (string, error) {
+		queue, err := ch.QueueDeclare("jobs.test", true, false, false, false, nil)
+		return queue.Name, err
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMessage := func(body string) {
+		select {
+		case m := <-msgs:
+			if string(m.Body) != body {
+				t.Fatalf("unexpected message: %q", m.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %q not received", body)
+		}
+	}
+
+	conn.channel.deliver(t, "jobs.test", "first")
+	expectMessage("first")
+
+	conn.drop(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"})
+	expectConnectionState(t, states, false)
+
+	// Publishing fails while the client is disconnected
+	if err := q.publish("jobs.done", successKey, 0, "message"); err != errQueueDisconnected {
+		t.Errorf("message published while disconnected: %v", err)
+	}
+
+	// The client connects again and resumes the consumer
+	conn = <-conns
+	expectConnectionState(t, states, true)
+	if !q.Connected() {
+		t.Fatal("client not connected")
+	}
+
+	conn.channel.deliver(t, "jobs.test", "second")
+	expectMessage("second")
+
+	if err := q.publish("jobs.done", successKey, 0, "message"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.channel.numPublished() != 1 {
+		t.Errorf("message not published: %v", conn.channel.published)
+	}
+
+	// The consumer channel is closed with the client
+	q.Close()
+	if _, ok := <-msgs; ok {
+		t.Error("consumer not closed")
+	}
+}
+
+func TestQueueClientPublisherReconnection(t *testing.T) {
+	q, conns, states := newFakeQueueClient(t, publisherConnection)
+	defer q.Close()
+	conn := <-conns
+
+	if err := q.publish("jobs.new", "", 0, "job"); err != nil {
+		t.Fatalf("confirmed message failed: %v", err)
+	}
+
+	// A publication waiting for its confirmation fails when the connection is lost,
+	// without waiting for the confirmation timeout
+	conn.channel.holdConfirms()
+	result := make(chan error, 1)
+	go func() {
+		result <- q.publish("jobs.new", "", 0, "job")
+	}()
+	for conn.channel.numPublished() != 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.drop(&amqp.Error{Code: amqp.ConnectionForced, Reason: "CONNECTION_FORCED"})
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("unconfirmed message succeeded")
+		}
+	case <-time.After(publishConfirmTimeout / 2):
+		t.Fatal("publication not failed when the connection was lost")
+	}
+	expectConnectionState(t, states, false)
+
+	// The new channel is in confirm mode, with its own delivery tags
+	conn = <-conns
+	expectConnectionState(t, states, true)
+	for i := 0; i < 2; i++ {
+		if err := q.publish("jobs.new", "", 0, "job"); err != nil {
+			t.Fatalf("message not confirmed after reconnection: %v", err)
+		}
+	}
+	if !conn.channel.confirm {
+		t.Error("publisher confirms not enabled on the new channel")
+	}
+}
+
+func TestConfirmState(t *testing.T) {
+	s := &confirmState{}
+	confirms := make(chan amqp.Confirmation)
+	returns := make(chan amqp.Return)
+	go s.receive(confirms, returns)
+
+	// The late confirmations of the messages which are no longer waited for are received
+	// without blocking the sender
+	done := make(chan struct{})
+	go func() {
+		for tag := uint64(1); tag <= 4*confirmBufferSize; tag++ {
+			confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("late confirmations not received")
+	}
+
+	tag := uint64(4*confirmBufferSize + 1)
+	result, err := s.expect(tag, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	if err := s.wait(result); err != nil {
+		t.Errorf("confirmed message failed: %v", err)
+	}
+
+	// A returned message fails with its confirmation
+	tag++
+	if result, err = s.expect(tag, "b"); err != nil {
+		t.Fatal(err)
+	}
+	returns <- amqp.Return{MessageId: "b", ReplyText: "NO_ROUTE"}
+	confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+	if err := s.wait(result); err != errMessageUnroutable {
+		t.Errorf("returned message not reported: %v", err)
+	}
+
+	tag++
+	if result, err = s.expect(tag, "c"); err != nil {
+		t.Fatal(err)
+	}
+	confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+	if err := s.wait(result); err == nil {
+		t.Errorf("rejected message not reported")
+	}
+
+	// The message waiting for its confirmation fails when the channel is closed
+	tag++
+	if result, err = s.expect(tag, "d"); err != nil {
+		t.Fatal(err)
+	}
+	close(returns)
+	close(confirms)
+	if err := s.wait(result); err == nil {
+		t.Errorf("message not failed on closure")
+	}
+	if _, err := s.expect(tag+1, "e"); err != errQueueDisconnected {
+		t.Errorf("message expected on a closed channel: %v", err)
+	}
+}
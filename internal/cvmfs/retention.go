@@ -0,0 +1,239 @@
+package cvmfs
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Number of expired jobs which are read, and deleted, at once
+const pruneBatchSize = 500
+
+// PruneResult describes the jobs pruned from the job DB. Pruned is the number of
+// pruned jobs per repository; Archive is the file where they were archived, if any
+type PruneResult struct {
+	Pruned  map[string]int
+	Archive string
+}
+
+// Total returns the total number of pruned jobs
+func (r *PruneResult) Total() int {
+	n := 0
+	for _, v := range r.Pruned {
+		n += v
+	}
+	return n
+}
+
+// PruneJobs applies the retention policy of the configuration to the job DB. With
+// "dryRun", the expired jobs are counted but not deleted
+func PruneJobs(cfg *Config, dryRun bool) (*PruneResult, error) {
+	db, adapter, err := openDatabase(&cfg.Backend)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := checkSchemaVersion(db, adapter); err != nil {
+		return nil, err
+	}
+
+	logs, err := newLogStore(cfg.Server.LogDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open job log store")
+	}
+
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}, logs: logs}
+	return b.pruneJobs(&cfg.Retention, time.Now(), dryRun)
+}
+
+// runRetention applies the retention policy periodically, until quit is closed
+func (b *serverBackend) runRetention(r *RetentionConfig, quit <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(r.PruneInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		result, err := b.pruneJobs(r, time.Now(), false)
+		if err != nil {
+			Log.Error().Err(err).Msg("could not prune expired jobs")
+		} else if n := result.Total(); n > 0 {
+			Log.Info().Int("jobs", n).Str("archive", result.Archive).Msg("expired jobs pruned")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// pruneJobs deletes the finished jobs which have expired at time "now". Jobs are kept
+// for KeepDays days after they finished, or KeepFailedDays if they failed; the KeepLast
+// most recent jobs of each repository are always kept. Nothing is pruned if KeepDays is
+// zero. The pruned jobs are archived first, if an archive directory is configured
+func (b *serverBackend) pruneJobs(
+	r *RetentionConfig, now time.Time, dryRun bool) (*PruneResult, error) {
+	result := PruneResult{Pruned: map[string]int{}}
+	if r.KeepDays == 0 {
+		return &result, nil
+	}
+
+	cutoff := now.AddDate(0, 0, -r.KeepDays)
+	failedCutoff := cutoff
+	if r.KeepFailedDays > r.KeepDays {
+		failedCutoff = now.AddDate(0, 0, -r.KeepFailedDays)
+	}
+
+	repos, err := b.store.Repositories()
+	if err != nil {
+		return &result, errors.Wrap(err, "could not list repositories")
+	}
+
+	var archive *jobArchive
+	defer func() {
+		if archive != nil {
+			if err := archive.Close(); err != nil {
+				Log.Error().Err(err).Str("archive", archive.path).Msg("could not close job archive")
+			}
+		}
+	}()
+
+	for _, repo := range repos {
+		keep := map[uuid.UUID]bool{}
+		if r.KeepLast > 0 {
+			recent, err := b.store.RecentJobs(repo, r.KeepLast)
+			if err != nil {
+				return &result, errors.Wrap(err, "could not query recent jobs")
+			}
+			for _, id := range recent {
+				keep[id] = true
+			}
+		}
+
+		// The kept jobs remain in the results of the query, and are skipped
+		offset := 0
+		for {
+			jobs, err := b.store.ExpiredJobs(repo, cutoff, failedCutoff, pruneBatchSize, offset)
+			if err != nil {
+				return &result, errors.Wrap(err, "could not query expired jobs")
+			}
+
+			expired := []ProcessedJob{}
+			for _, j := range jobs {
+				if !keep[j.ID] {
+					expired = append(expired, j)
+				}
+			}
+
+			if !dryRun && len(expired) > 0 {
+				if archive == nil && r.ArchiveDir != "" {
+					archive, err = newJobArchive(r.ArchiveDir, now)
+					if err != nil {
+						return &result, err
+					}
+					result.Archive = archive.path
+				}
+				if archive != nil {
+					if err := archive.write(expired); err != nil {
+						return &result, err
+					}
+				}
+				if err := b.deleteJobs(expired); err != nil {
+					return &result, err
+				}
+			}
+			result.Pruned[repo] += len(expired)
+
+			if len(jobs) < pruneBatchSize {
+				break
+			}
+			if dryRun {
+				offset += len(jobs)
+			} else {
+				offset += len(jobs) - len(expired)
+			}
+		}
+	}
+
+	return &result, nil
+}
+
+// deleteJobs deletes jobs from the job store, together with their logs
+func (b *serverBackend) deleteJobs(jobs []ProcessedJob) error {
+	ids := make([]uuid.UUID, 0, len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.ID)
+	}
+
+	t0 := time.Now()
+	if err := b.store.DeleteJobs(ids); err != nil {
+		return errors.Wrap(err, "could not delete jobs")
+	}
+	observeDBQuery("delete_jobs", t0)
+	jobsPruned.Add(float64(len(jobs)))
+
+	// A log which can't be removed is only wasted space
+	for _, j := range jobs {
+		if err := b.logs.remove(j.ID); err != nil {
+			Log.Error().Err(err).Str("job_id", j.ID.String()).Msg("could not remove job log")
+		}
+	}
+
+	return nil
+}
+
+// jobArchive is a gzip-compressed file with a JSON description of a job on each line
+type jobArchive struct {
+	path string
+	f    *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+// newJobArchive creates a job archive in a directory, named after the time of the pruning
+func newJobArchive(dir string, t time.Time) (*jobArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create job archive directory")
+	}
+
+	p := filepath.Join(dir, fmt.Sprintf("jobs-%v.jsonl.gz", t.UTC().Format("20060102T150405Z")))
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create job archive")
+	}
+
+	gz := gzip.NewWriter(f)
+	return &jobArchive{path: p, f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// write appends jobs to the archive. The archive is flushed, so that the jobs are
+// archived before they are deleted
+func (a *jobArchive) write(jobs []ProcessedJob) error {
+	for i := range jobs {
+		if err := a.enc.Encode(&jobs[i]); err != nil {
+			return errors.Wrap(err, "could not archive job")
+		}
+	}
+	if err := a.gz.Flush(); err != nil {
+		return errors.Wrap(err, "could not write job archive")
+	}
+	if err := a.f.Sync(); err != nil {
+		return errors.Wrap(err, "could not write job archive")
+	}
+	return nil
+}
+
+// Close completes the archive
+func (a *jobArchive) Close() error {
+	if err := a.gz.Close(); err != nil {
+		a.f.Close()
+		return errors.Wrap(err, "could not write job archive")
+	}
+	return a.f.Close()
+}
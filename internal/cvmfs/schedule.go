@@ -0,0 +1,423 @@
+package cvmfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Interval between two checks for job schedules with a run due
+const jobSchedulesPollInterval = 10 * time.Second
+
+// A run of a schedule which is due for longer than missedRunGrace was missed, because the
+// job server was stopped at the time
+const missedRunGrace = time.Minute
+
+// Policies for the runs of a schedule missed while the job server was stopped
+const (
+	// MissedRunsSkip - the missed runs are skipped, the next job is submitted at the next
+	// scheduled time
+	MissedRunsSkip = "skip"
+	// MissedRunsRunOnce - a single job is submitted for all the missed runs
+	MissedRunsRunOnce = "run-once"
+)
+
+// Origins of a job schedule. The schedules defined in the configuration can only be
+// changed in the configuration
+const (
+	scheduleSourceConfig = "config"
+	scheduleSourceAPI    = "api"
+)
+
+var errScheduleNotFound = errors.New("unknown job schedule")
+
+var errScheduleExists = errors.New("job schedule already exists")
+
+var errConfigSchedule = errors.New("job schedule is defined in the server configuration")
+
+// JobSchedule describes a recurring job: a job is submitted from Job at each time matching
+// the cron expression, in the time zone of the job server. A run is skipped while the job
+// submitted for the previous run is unfinished. LastRun is the time of the last run,
+// handled or skipped, and LastJobID the last job submitted for the schedule. NextRun is
+// only set in the listings
+type JobSchedule struct {
+	Name       string
+	Cron       string
+	Job        JobSpecification
+	MissedRuns string
+	Source     string
+	CreateTime time.Time
+	LastRun    time.Time
+	LastJobID  uuid.UUID
+	NextRun    time.Time
+}
+
+// ListSchedulesReply is the return type of the ListSchedules query
+type ListSchedulesReply struct {
+	BasicReply
+	Schedules []JobSchedule `json:",omitempty"`
+}
+
+// PostScheduleReply is the return value of the PostSchedule action
+type PostScheduleReply struct {
+	BasicReply
+}
+
+// DeleteScheduleRequest is the body of a request deleting a job schedule
+type DeleteScheduleRequest struct {
+	Name string
+}
+
+// DeleteScheduleReply is the return value of the DeleteSchedule action
+type DeleteScheduleReply struct {
+	BasicReply
+}
+
+// schedule returns the job schedule defined by the configuration
+func (c *ScheduleConfig) schedule() JobSchedule {
+	s := JobSchedule{
+		Name: c.Name,
+		Cron: c.Cron,
+		Job: JobSpecification{
+			JobName:    c.JobName,
+			Repository: c.Repository,
+			Payload:    c.Payload,
+			LeasePath:  c.LeasePath,
+			Priority:   c.Priority,
+		},
+		MissedRuns: c.MissedRuns,
+		Source:     scheduleSourceConfig,
+	}
+	if s.MissedRuns == "" {
+		s.MissedRuns = MissedRunsSkip
+	}
+	return s
+}
+
+// validate returns an error if the definition of a job schedule is invalid
+func (s *JobSchedule) validate() error {
+	if s.Name == "" {
+		return errors.New("schedule name is unset")
+	}
+	if _, err := parseCron(s.Cron); err != nil {
+		return err
+	}
+	if s.Job.Repository == "" {
+		return errors.New("repository is unset")
+	}
+	if s.Job.LeasePath == "" {
+		return errors.New("lease path is unset")
+	}
+	if s.Job.Priority < 0 || s.Job.Priority > maxJobPriority {
+		return fmt.Errorf("job priority %v is not between 0 and %v", s.Job.Priority, maxJobPriority)
+	}
+	if len(s.Job.Dependencies) > 0 || !s.Job.NotBefore.IsZero() {
+		return errors.New("scheduled jobs can't have dependencies or a start time")
+	}
+	if s.MissedRuns != MissedRunsSkip && s.MissedRuns != MissedRunsRunOnce {
+		return fmt.Errorf("unknown missed runs policy %q", s.MissedRuns)
+	}
+	return nil
+}
+
+// nextRun returns the first scheduled time after the last run of the schedule, or after
+// its creation if it never ran. The zero time is returned if there is none
+func (s *JobSchedule) nextRun(expr *cronExpr) time.Time {
+	last := s.LastRun
+	if last.IsZero() {
+		last = s.CreateTime
+	}
+	return expr.next(last.Local())
+}
+
+// syncConfigSchedules records the job schedules defined in the configuration, and deletes
+// the ones which were removed from it. The last run of the existing schedules is kept. A
+// schedule created through the API is not replaced by one of the configuration with the
+// same name
+func (b *serverBackend) syncConfigSchedules(cfgs []ScheduleConfig, now time.Time) error {
+	b.schedulesMu.Lock()
+	defer b.schedulesMu.Unlock()
+
+	schedules, err := b.store.GetSchedules()
+	if err != nil {
+		return errors.Wrap(err, "could not list job schedules")
+	}
+	sources := map[string]string{}
+	for _, s := range schedules {
+		sources[s.Name] = s.Source
+	}
+
+	defined := map[string]bool{}
+	for i := range cfgs {
+		s := cfgs[i].schedule()
+		if src, ok := sources[s.Name]; ok && src != scheduleSourceConfig {
+			Log.Warn().
+				Str("schedule", s.Name).
+				Str("source", src).
+				Msg("job schedule of the configuration ignored, a schedule with the same name exists")
+			continue
+		}
+		s.CreateTime = now
+		if err := b.store.PutSchedule(&s); err != nil {
+			return errors.Wrapf(err, "could not record job schedule %q", s.Name)
+		}
+		defined[s.Name] = true
+	}
+
+	for _, s := range schedules {
+		if s.Source != scheduleSourceConfig || defined[s.Name] {
+			continue
+		}
+		if _, err := b.store.DeleteSchedule(s.Name); err != nil {
+			return errors.Wrapf(err, "could not delete job schedule %q", s.Name)
+		}
+		Log.Info().Str("schedule", s.Name).Msg("job schedule removed from the configuration")
+	}
+
+	return nil
+}
+
+// listSchedules returns the job schedules, with their next scheduled run
+func (b *serverBackend) listSchedules() (*ListSchedulesReply, error) {
+	reply := ListSchedulesReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
+
+	t0 := time.Now()
+	schedules, err := b.store.GetSchedules()
+	observeDBQuery("list_schedules", t0)
+	if err != nil {
+		reason := "SQL query failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	for i := range schedules {
+		if expr, err := parseCron(schedules[i].Cron); err == nil {
+			schedules[i].NextRun = schedules[i].nextRun(expr)
+		}
+	}
+	reply.Schedules = schedules
+
+	return &reply, nil
+}
+
+// getSchedule returns a job schedule, or nil if it is unknown
+func (b *serverBackend) getSchedule(name string) (*JobSchedule, error) {
+	schedules, err := b.store.GetSchedules()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list job schedules")
+	}
+	for i := range schedules {
+		if schedules[i].Name == name {
+			return &schedules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// putSchedule records a new job schedule. The first run is the first scheduled time
+// after "now"
+func (b *serverBackend) putSchedule(s *JobSchedule, now time.Time) (*PostScheduleReply, error) {
+	b.schedulesMu.Lock()
+	defer b.schedulesMu.Unlock()
+
+	reply := PostScheduleReply{BasicReply{Status: "ok", Reason: ""}}
+
+	if s.MissedRuns == "" {
+		s.MissedRuns = MissedRunsSkip
+	}
+	if err := s.validate(); err != nil {
+		reason := "invalid job schedule: " + err.Error()
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, "invalid job schedule")
+	}
+
+	old, err := b.getSchedule(s.Name)
+	if err != nil {
+		reply.Status = "error"
+		reply.Reason = "SQL query failed"
+		return &reply, err
+	}
+	if old != nil {
+		reply.Status = "error"
+		reply.Reason = errScheduleExists.Error()
+		return &reply, errScheduleExists
+	}
+
+	s.Source = scheduleSourceAPI
+	s.CreateTime = now
+	s.LastRun = time.Time{}
+	s.LastJobID = uuid.Nil
+	if err := b.store.PutSchedule(s); err != nil {
+		reason := "executing SQL statement failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	Log.Info().
+		Str("schedule", s.Name).
+		Str("cron", s.Cron).
+		Str("repository", s.Job.Repository).
+		Msg("job schedule created")
+
+	return &reply, nil
+}
+
+// deleteSchedule deletes a job schedule created through the API. The jobs already
+// submitted for the schedule are not affected
+func (b *serverBackend) deleteSchedule(req *DeleteScheduleRequest) (*DeleteScheduleReply, error) {
+	b.schedulesMu.Lock()
+	defer b.schedulesMu.Unlock()
+
+	reply := DeleteScheduleReply{BasicReply{Status: "ok", Reason: ""}}
+
+	s, err := b.getSchedule(req.Name)
+	if err != nil {
+		reply.Status = "error"
+		reply.Reason = "SQL query failed"
+		return &reply, err
+	}
+	if s == nil {
+		reply.Status = "error"
+		reply.Reason = errScheduleNotFound.Error()
+		return &reply, errScheduleNotFound
+	}
+	if s.Source == scheduleSourceConfig {
+		reply.Status = "error"
+		reply.Reason = errConfigSchedule.Error()
+		return &reply, errConfigSchedule
+	}
+
+	if _, err := b.store.DeleteSchedule(req.Name); err != nil {
+		reason := "executing SQL statement failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	Log.Info().Str("schedule", req.Name).Msg("job schedule deleted")
+
+	return &reply, nil
+}
+
+// getScheduleRepository returns the repository of the jobs of a schedule, or an empty
+// string if the schedule is unknown
+func (b *serverBackend) getScheduleRepository(name string) (string, error) {
+	s, err := b.getSchedule(name)
+	if err != nil || s == nil {
+		return "", err
+	}
+	return s.Job.Repository, nil
+}
+
+// runJobSchedules submits the jobs of the schedules periodically, until quit is closed
+func (b *serverBackend) runJobSchedules(quit <-chan struct{}) {
+	ticker := time.NewTicker(jobSchedulesPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.runDueSchedules(time.Now()); err != nil {
+			Log.Error().Err(err).Msg("could not run job schedules")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// runDueSchedules handles the schedules with a run due at time "now"
+func (b *serverBackend) runDueSchedules(now time.Time) error {
+	b.schedulesMu.Lock()
+	defer b.schedulesMu.Unlock()
+
+	schedules, err := b.store.GetSchedules()
+	if err != nil {
+		return errors.Wrap(err, "could not list job schedules")
+	}
+
+	// A failure to run one schedule should not hold back the others
+	for i := range schedules {
+		if err := b.runSchedule(&schedules[i], now); err != nil {
+			scheduleRuns.WithLabelValues("error").Inc()
+			Log.Error().Err(err).Str("schedule", schedules[i].Name).Msg("could not run job schedule")
+		}
+	}
+
+	return nil
+}
+
+// runSchedule submits the job of a schedule if a run is due at time "now". When several
+// runs are due, only the latest one is handled. A run which was missed is skipped, or
+// handled, depending on the missed runs policy of the schedule. The run is also skipped
+// if the job of the previous run is not yet finished
+func (b *serverBackend) runSchedule(s *JobSchedule, now time.Time) error {
+	expr, err := parseCron(s.Cron)
+	if err != nil {
+		return errors.Wrap(err, "invalid cron expression")
+	}
+
+	run := s.nextRun(expr)
+	if run.IsZero() || run.After(now) {
+		return nil
+	}
+	for t := expr.next(run); !t.IsZero() && !t.After(now); t = expr.next(t) {
+		run = t
+	}
+
+	if now.Sub(run) > missedRunGrace && s.MissedRuns == MissedRunsSkip {
+		if err := b.store.UpdateScheduleRun(s.Name, run, s.LastJobID); err != nil {
+			return errors.Wrap(err, "could not record schedule run")
+		}
+		scheduleRuns.WithLabelValues("missed").Inc()
+		Log.Info().Str("schedule", s.Name).Time("run", run).Msg("missed schedule run skipped")
+		return nil
+	}
+
+	if s.LastJobID != uuid.Nil {
+		state, err := b.getJobState(s.LastJobID)
+		if err != nil && errors.Cause(err) != errJobNotFound {
+			return errors.Wrap(err, "could not query the state of the previous job")
+		}
+		if err == nil && !isFinalState(state) {
+			if err := b.store.UpdateScheduleRun(s.Name, run, s.LastJobID); err != nil {
+				return errors.Wrap(err, "could not record schedule run")
+			}
+			scheduleRuns.WithLabelValues("overlap").Inc()
+			Log.Info().
+				Str("schedule", s.Name).
+				Time("run", run).
+				Str("previous_job_id", s.LastJobID.String()).
+				Msg("previous job of the schedule unfinished, run skipped")
+			return nil
+		}
+	}
+
+	job := s.Job
+	if job.JobName == "" {
+		job.JobName = s.Name
+	}
+	rep, err := b.putNewJob(&job)
+	if err != nil && errors.Cause(err) != errJobPublication {
+		// Nothing was recorded, the run is attempted again
+		return errors.Wrap(err, "could not submit job")
+	}
+
+	// A job which could not be published was recorded as failed
+	if err := b.store.UpdateScheduleRun(s.Name, run, rep.ID); err != nil {
+		return errors.Wrap(err, "could not record schedule run")
+	}
+	scheduleRuns.WithLabelValues("submitted").Inc()
+	Log.Info().
+		Str("schedule", s.Name).
+		Time("run", run).
+		Str("job_id", rep.ID.String()).
+		Msg("scheduled job submitted")
+
+	return nil
+}
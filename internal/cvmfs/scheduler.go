@@ -0,0 +1,350 @@
+package cvmfs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// Interval between two checks for scheduled jobs whose start time has come
+const scheduledJobsPollInterval = 10 * time.Second
+
+// The combined state of the dependencies of a job
+const (
+	dependenciesSucceeded = iota
+	dependenciesPending
+	dependenciesFailed
+)
+
+// errUnknownDependencies is returned when a job depends on jobs which are unknown to
+// the server
+type errUnknownDependencies []string
+
+func (e errUnknownDependencies) Error() string {
+	return fmt.Sprintf("unknown job dependencies: %v", []string(e))
+}
+
+// checkDependencies returns the combined state of the dependencies of a job. If any
+// dependency did not succeed, its ID is also returned
+func (b *serverBackend) checkDependencies(deps []string) (int, string, error) {
+	if len(deps) == 0 {
+		return dependenciesSucceeded, "", nil
+	}
+
+	rep, err := b.getJobStatus(deps, false)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "could not query the status of the dependencies")
+	}
+
+	states := map[string]string{}
+	for _, st := range rep.IDs {
+		states[st.ID.String()] = st.State
+	}
+
+	unknown := errUnknownDependencies{}
+	pending := false
+	for _, dep := range deps {
+		id, err := uuid.Parse(dep)
+		if err != nil {
+			unknown = append(unknown, dep)
+			continue
+		}
+		state, ok := states[id.String()]
+		switch {
+		case !ok:
+			unknown = append(unknown, dep)
+		case state == JobStateFailed || state == JobStateCancelled:
+			return dependenciesFailed, dep, nil
+		case state != JobStateSucceeded:
+			pending = true
+		}
+	}
+
+	if len(unknown) > 0 {
+		return 0, "", unknown
+	}
+	if pending {
+		return dependenciesPending, "", nil
+	}
+	return dependenciesSucceeded, "", nil
+}
+
+// scheduleDependents is called when a job is finished. The jobs waiting for it are
+// released if all their dependencies have succeeded, or failed if the job did not succeed
+func (b *serverBackend) scheduleDependents(id uuid.UUID, state string) error {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	if state != JobStateSucceeded {
+		reason := fmt.Sprintf("dependency %v failed", id)
+		if state == JobStateCancelled {
+			reason = fmt.Sprintf("dependency %v was cancelled", id)
+		}
+		_, err := b.failDependents(id, reason)
+		return err
+	}
+
+	dependents, err := b.getPendingDependents(id)
+	if err != nil {
+		return errors.Wrap(err, "could not retrieve dependent jobs")
+	}
+
+	// A failure to schedule one job should not hold back the others
+	for _, dep := range dependents {
+		if err := b.releaseIfReady(dep); err != nil {
+			Log.Error().Err(err).Str("job_id", dep.String()).Msg("could not schedule job")
+		}
+	}
+
+	return nil
+}
+
+// releaseWaitingJobs checks all the jobs which are waiting for their dependencies
+func (b *serverBackend) releaseWaitingJobs() error {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	waiting := []uuid.UUID{}
+	filter := JobFilter{State: JobStateWaiting, Limit: maxListLimit}
+	for {
+		rep, err := b.listJobs(&filter)
+		if err != nil {
+			return errors.Wrap(err, "could not list waiting jobs")
+		}
+		for _, j := range rep.Jobs {
+			waiting = append(waiting, j.ID)
+		}
+		if rep.NextOffset == 0 {
+			break
+		}
+		filter.Offset = rep.NextOffset
+	}
+
+	for _, id := range waiting {
+		if err := b.releaseIfReady(id); err != nil {
+			Log.Error().Err(err).Str("job_id", id.String()).Msg("could not schedule job")
+		}
+	}
+
+	return nil
+}
+
+// releaseIfReady publishes a job waiting for its dependencies once they have all
+// succeeded, and fails it if any of them did not succeed
+func (b *serverBackend) releaseIfReady(id uuid.UUID) error {
+	rep, err := b.getJobStatus([]string{id.String()}, true)
+	if err != nil {
+		return errors.Wrap(err, "could not query job status")
+	}
+	if len(rep.Jobs) == 0 || rep.Jobs[0].State != JobStateWaiting {
+		return nil
+	}
+	job := rep.Jobs[0].UnprocessedJob
+	submitTime := rep.Jobs[0].SubmitTime
+
+	deps, failedDep, err := b.checkDependencies(job.Dependencies)
+	if err != nil {
+		return err
+	}
+
+	switch deps {
+	case dependenciesFailed:
+		if err := b.failJob(id, fmt.Sprintf("dependency %v failed", failedDep)); err != nil {
+			return err
+		}
+		_, err := b.failDependents(id, fmt.Sprintf("dependency %v failed", id))
+		return err
+	case dependenciesSucceeded:
+		release := b.releaseJob
+		if job.NotBefore.After(time.Now()) {
+			release = b.scheduleJob
+		}
+		if err := release(&job); err != nil {
+			return err
+		}
+		if !submitTime.IsZero() {
+			observeSince(dependencyWaitDuration, submitTime)
+		}
+	}
+
+	return nil
+}
+
+// releaseJob moves a job which was waiting for its dependencies, or for its start time,
+// to the job queue
+func (b *serverBackend) releaseJob(job *UnprocessedJob) error {
+	t0 := time.Now()
+	if _, err := b.store.UpdateJobState(job.ID, JobStateSubmitted, "", time.Time{}); err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	observeDBQuery("release_job", t0)
+
+	if err := b.publishJob(job); err != nil {
+		return err
+	}
+
+	Log.Info().Str("job_id", job.ID.String()).Msg("job released")
+
+	return nil
+}
+
+// scheduleJob holds a job whose dependencies finished before its start time. The job is
+// released by releaseScheduledJobs
+func (b *serverBackend) scheduleJob(job *UnprocessedJob) error {
+	t0 := time.Now()
+	if _, err := b.store.UpdateJobState(job.ID, JobStateScheduled, "", time.Time{}); err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	observeDBQuery("schedule_job", t0)
+
+	Log.Info().
+		Str("job_id", job.ID.String()).
+		Time("not_before", job.NotBefore).
+		Msg("job dependencies finished, job scheduled")
+
+	return nil
+}
+
+// runScheduledJobs releases the scheduled jobs periodically, until quit is closed
+func (b *serverBackend) runScheduledJobs(quit <-chan struct{}) {
+	ticker := time.NewTicker(scheduledJobsPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.releaseScheduledJobs(time.Now()); err != nil {
+			Log.Error().Err(err).Msg("could not release scheduled jobs")
+		}
+
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// releaseScheduledJobs moves the scheduled jobs whose start time is not after "now" to
+// the job queue
+func (b *serverBackend) releaseScheduledJobs(now time.Time) error {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	due := []UnprocessedJob{}
+	filter := JobFilter{State: JobStateScheduled, Limit: maxListLimit}
+	for {
+		rep, err := b.listJobs(&filter)
+		if err != nil {
+			return errors.Wrap(err, "could not list scheduled jobs")
+		}
+		for _, j := range rep.Jobs {
+			if !j.NotBefore.After(now) {
+				due = append(due, j.UnprocessedJob)
+			}
+		}
+		if rep.NextOffset == 0 {
+			break
+		}
+		filter.Offset = rep.NextOffset
+	}
+
+	// A failure to release one job should not hold back the others
+	for i := range due {
+		if err := b.releaseJob(&due[i]); err != nil {
+			Log.Error().Err(err).Str("job_id", due[i].ID.String()).Msg("could not release job")
+		}
+	}
+
+	return nil
+}
+
+// publishJob publishes the description of a job to the job queue of its repository, and
+// returns once the broker confirmed it. If publishing fails, the job and its dependents
+// are failed, so that they are not left waiting forever. The error message recorded for
+// the job includes the reason of the failure
+func (b *serverBackend) publishJob(job *UnprocessedJob) error {
+	pubErr := b.pub.publish(b.newJobExchange, job.Repository, uint8(job.Priority), job)
+	if pubErr == nil {
+		return nil
+	}
+	publishFailures.WithLabelValues(b.newJobExchange).Inc()
+	if errors.Cause(pubErr) == errMessageUnroutable {
+		// The job queue of a repository is declared by the workers
+		pubErr = fmt.Errorf("no job queue for repository %v, no worker serves it", job.Repository)
+	}
+	pubErr = errors.Wrap(pubErr, errJobPublication.Error())
+
+	if err := b.failJob(job.ID, pubErr.Error()); err != nil {
+		Log.Error().Err(err).Str("job_id", job.ID.String()).Msg("could not mark job as failed")
+	}
+	if _, err := b.failDependents(
+		job.ID, fmt.Sprintf("dependency %v failed", job.ID)); err != nil {
+		Log.Error().Err(err).Str("job_id", job.ID.String()).Msg("could not fail dependent jobs")
+	}
+
+	return pubErr
+}
+
+// failDependents fails the unfinished jobs which depend on a job, recursively. The
+// IDs of the failed jobs are returned
+func (b *serverBackend) failDependents(id uuid.UUID, reason string) ([]uuid.UUID, error) {
+	dependents, err := b.getPendingDependents(id)
+	if err != nil {
+		return []uuid.UUID{}, err
+	}
+
+	failed := []uuid.UUID{}
+	for _, dep := range dependents {
+		if err := b.failJob(dep, reason); err != nil {
+			// The dependent may have finished in the meantime
+			if errors.Cause(err) == errJobNotPending {
+				continue
+			}
+			return failed, errors.Wrap(err, "could not fail dependent job")
+		}
+		failed = append(failed, dep)
+
+		indirect, err := b.failDependents(dep, fmt.Sprintf("dependency %v failed", dep))
+		failed = append(failed, indirect...)
+		if err != nil {
+			return failed, err
+		}
+	}
+
+	return failed, nil
+}
+
+// getPendingDependents returns the IDs of the unfinished jobs which depend directly on
+// a job
+func (b *serverBackend) getPendingDependents(id uuid.UUID) ([]uuid.UUID, error) {
+	defer observeDBQuery("pending_dependents", time.Now())
+	return b.store.PendingDependents(id)
+}
+
+// walkDependencies returns the IDs of the jobs reachable from a job, in breadth-first
+// order. "neighbours" returns the direct dependencies, or the direct dependents, of a
+// job. "visit" is called for each traversed edge
+func (b *serverBackend) walkDependencies(
+	id uuid.UUID, neighbours func(id uuid.UUID) ([]uuid.UUID, error),
+	visit func(from, to uuid.UUID)) ([]uuid.UUID, error) {
+	reached := []uuid.UUID{}
+	seen := map[uuid.UUID]bool{id: true}
+	next := []uuid.UUID{id}
+	for len(next) > 0 {
+		cur := next[0]
+		next = next[1:]
+		adjacent, err := neighbours(cur)
+		if err != nil {
+			return []uuid.UUID{}, err
+		}
+		for _, n := range adjacent {
+			visit(cur, n)
+			if !seen[n] {
+				seen[n] = true
+				reached = append(reached, n)
+				next = append(next, n)
+			}
+		}
+	}
+	return reached, nil
+}
@@ -0,0 +1,192 @@
+package cvmfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// insertTestJob records a job in the given state, with its dependencies
+func insertTestJob(t *testing.T, b *serverBackend, state string, deps ...uuid.UUID) uuid.UUID {
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{
+			ID: uuid.New(), JobSpecification: JobSpecification{Repository: "sft.cern.ch"}},
+		State:      state,
+		Successful: state == JobStateSucceeded,
+		SubmitTime: time.Now(),
+	}
+	for _, dep := range deps {
+		job.Dependencies = append(job.Dependencies, dep.String())
+	}
+	if err := b.store.InsertJobs([]ProcessedJob{job}); err != nil {
+		t.Fatal(err)
+	}
+	return job.ID
+}
+
+// jobState returns the recorded state of a job
+func jobState(t *testing.T, b *serverBackend, id uuid.UUID) string {
+	jobs, err := b.store.GetJobs([]string{id.String()}, false)
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("could not query job %v: %v", id, err)
+	}
+	return jobs[0].State
+}
+
+func TestCheckDependencies(t *testing.T) {
+	b, _, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	st, _, err := b.checkDependencies(nil)
+	if err != nil || st != dependenciesSucceeded {
+		t.Errorf("invalid state without dependencies: %v, %v", st, err)
+	}
+
+	succeeded := insertTestJob(t, b, JobStateSucceeded)
+	running := insertTestJob(t, b, JobStateRunning)
+	waiting := insertTestJob(t, b, JobStateWaiting)
+	failed := insertTestJob(t, b, JobStateFailed)
+	cancelled := insertTestJob(t, b, JobStateCancelled)
+
+	cases := []struct {
+		name   string
+		deps   []uuid.UUID
+		result int
+		failed uuid.UUID
+	}{
+		{"succeeded", []uuid.UUID{succeeded}, dependenciesSucceeded, uuid.Nil},
+		{"running", []uuid.UUID{succeeded, running}, dependenciesPending, uuid.Nil},
+		{"waiting", []uuid.UUID{waiting, succeeded}, dependenciesPending, uuid.Nil},
+		{"failed", []uuid.UUID{running, failed}, dependenciesFailed, failed},
+		{"cancelled", []uuid.UUID{cancelled, succeeded}, dependenciesFailed, cancelled},
+	}
+	for _, c := range cases {
+		deps := []string{}
+		for _, dep := range c.deps {
+			deps = append(deps, dep.String())
+		}
+		st, failedDep, err := b.checkDependencies(deps)
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		expected := ""
+		if c.failed != uuid.Nil {
+			expected = c.failed.String()
+		}
+		if st != c.result || failedDep != expected {
+			t.Errorf("%v: invalid dependency state: %v, %q", c.name, st, failedDep)
+		}
+	}
+
+	// Unknown and invalid IDs are reported
+	unknown := uuid.New().String()
+	_, _, err = b.checkDependencies([]string{succeeded.String(), unknown, "invalid"})
+	e, ok := err.(errUnknownDependencies)
+	if !ok || len(e) != 2 || e[0] != unknown || e[1] != "invalid" {
+		t.Errorf("unknown dependencies not reported: %v", err)
+	}
+}
+
+func TestScheduleDependentsRelease(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	a := insertTestJob(t, b, JobStateRunning)
+	c := insertTestJob(t, b, JobStateSucceeded)
+	waiting := insertTestJob(t, b, JobStateWaiting, a, c)
+
+	// The job is only released once its last dependency succeeded
+	if err := b.scheduleDependents(c, JobStateSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 0 {
+		t.Fatalf("job released before its dependencies succeeded: %v", ids)
+	}
+
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{ID: a}, State: JobStateSucceeded, Successful: true}
+	if err := b.store.PutJob(&job); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.scheduleDependents(a, JobStateSucceeded); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 1 || ids[0] != waiting {
+		t.Errorf("job not released: %v", ids)
+	}
+	if st := jobState(t, b, waiting); st != JobStateSubmitted {
+		t.Errorf("unexpected state of the released job: %v", st)
+	}
+}
+
+func TestScheduleDependentsFailure(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	// The failure is propagated along the chain of dependencies
+	a := insertTestJob(t, b, JobStateFailed)
+	bb := insertTestJob(t, b, JobStateWaiting, a)
+	c := insertTestJob(t, b, JobStateWaiting, bb)
+	done := insertTestJob(t, b, JobStateSucceeded, a)
+
+	if err := b.scheduleDependents(a, JobStateFailed); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uuid.UUID{bb, c} {
+		if st := jobState(t, b, id); st != JobStateFailed {
+			t.Errorf("dependent job %v not failed: %v", id, st)
+		}
+	}
+	if st := jobState(t, b, done); st != JobStateSucceeded {
+		t.Errorf("finished dependent job changed: %v", st)
+	}
+	if ids := pub.published("jobs.done"); len(ids) != 2 || ids[0] != bb || ids[1] != c {
+		t.Errorf("unexpected completion notifications: %v", ids)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 0 {
+		t.Errorf("unexpected published jobs: %v", ids)
+	}
+}
+
+func TestPutNewJobDependencies(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	rep, err := b.putNewJob(&JobSpecification{
+		Repository: "sft.cern.ch", Dependencies: []string{uuid.New().String()}})
+	if err == nil || rep.Status != "error" {
+		t.Errorf("job with an unknown dependency accepted: %+v", rep)
+	}
+
+	cases := []struct {
+		depState string
+		state    string
+		exchange string
+	}{
+		{JobStateSucceeded, JobStateSubmitted, "jobs.new"},
+		{JobStateRunning, JobStateWaiting, ""},
+		{JobStateFailed, JobStateFailed, "jobs.done"},
+		{JobStateCancelled, JobStateFailed, "jobs.done"},
+	}
+	for _, c := range cases {
+		pub.messages = nil
+		dep := insertTestJob(t, b, c.depState)
+		rep, err := b.putNewJob(&JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{dep.String()}})
+		if err != nil {
+			t.Fatalf("%v: %v", c.depState, err)
+		}
+		if st := jobState(t, b, rep.ID); st != c.state {
+			t.Errorf("%v: unexpected state of the new job: %v", c.depState, st)
+		}
+		if len(pub.messages) != 0 && c.exchange == "" {
+			t.Errorf("%v: unexpected messages: %+v", c.depState, pub.messages)
+		}
+		if c.exchange != "" {
+			if ids := pub.published(c.exchange); len(ids) != 1 || ids[0] != rep.ID {
+				t.Errorf("%v: unexpected messages: %+v", c.depState, pub.messages)
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql" // Import and register the MySQL driver
 	"github.com/google/uuid"
@@ -14,9 +16,30 @@ import (
 
 const (
 	// SchemaVersion is the latest schema version of the job database
-	SchemaVersion = 1
+	SchemaVersion = 7
 )
 
+// Maximum time a query following a job log waits for new output
+const logPollTimeout = 10 * time.Second
+
+// errJobPublication is returned when a job was recorded but could not be published
+var errJobPublication = errors.New("job description publishing failed")
+
+// errJobNotFound is returned when querying a job which is unknown
+var errJobNotFound = errors.New("unknown job")
+
+// errJobNotPending is returned when changing the state of a job which is unknown or
+// already finished
+var errJobNotPending = errors.New("unknown or already finished job")
+
+// errJobFinished is returned when the status of a job which is already finished is
+// posted by another worker than the one which ran it
+var errJobFinished = errors.New("job already finished")
+
+// errJobNotQueued is returned when changing the priority of a job which is unknown or
+// no longer queued
+var errJobNotQueued = errors.New("unknown or no longer queued job")
+
 // StartServer starts the conveyor server component. This function will block until
 // the server finishes.
 func StartServer(cfg *Config) error {
@@ -26,6 +49,31 @@ func StartServer(cfg *Config) error {
 	}
 	defer backend.Close()
 
+	// Jobs whose dependencies finished while the server was stopped are
+	// released (or failed) before accepting new requests
+	if err := backend.releaseWaitingJobs(); err != nil {
+		return errors.Wrap(err, "could not schedule waiting jobs")
+	}
+
+	// Scheduled jobs are released to the job queue once their start time has come
+	schedQuit := make(chan struct{})
+	defer close(schedQuit)
+	go backend.runScheduledJobs(schedQuit)
+
+	// The recurring jobs of the configuration are added or updated, and the ones removed
+	// from it are deleted. The schedules created through the API are kept
+	if err := backend.syncConfigSchedules(cfg.Schedules, time.Now()); err != nil {
+		return errors.Wrap(err, "could not record job schedules")
+	}
+	go backend.runJobSchedules(schedQuit)
+
+	// Expired jobs are pruned in the background
+	if cfg.Retention.KeepDays > 0 {
+		quit := make(chan struct{})
+		defer close(quit)
+		go backend.runRetention(&cfg.Retention, quit)
+	}
+
 	if err := startFrontEnd(cfg, backend); err != nil {
 		return errors.Wrap(err, "could not start service front-end")
 	}
@@ -33,102 +81,176 @@ func StartServer(cfg *Config) error {
 	return nil
 }
 
+// jobPublisher publishes messages to the exchanges of the job queue
+type jobPublisher interface {
+	publish(exchange string, key string, priority uint8, data interface{}) error
+	Close() error
+}
+
 // serverBackend encapsulates the server state
 type serverBackend struct {
-	db                   *sql.DB
-	dbAdapter            databaseAdapter
-	pub                  *QueueClient
+	store                JobStore
+	pub                  jobPublisher
 	newJobExchange       string
 	completedJobExchange string
+	logs                 *logStore
+
+	// Serializes the scheduling decisions taken on job submission and completion
+	schedMu sync.Mutex
+	// Serializes the changes and the runs of the job schedules
+	schedulesMu sync.Mutex
 }
 
 // startBackEnd initializes the backend of the job server
 func startBackEnd(cfg *Config) (*serverBackend, error) {
-	adapter, err := newDatabaseAdapter(cfg.Backend.Type)
+	store, err := newJobStore(&cfg.Backend)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not crate database query adapter")
+		return nil, err
+	}
+	if cfg.Backend.Type == memoryBackendType {
+		Log.Warn().Msg("using the in-memory job store, jobs are lost when the server stops")
 	}
 
-	db, err := sql.Open(
-		adapter.driverName(),
-		adapter.dataSourceName(
-			cfg.Backend.Username, cfg.Backend.Password, cfg.Backend.Host, cfg.Backend.Port,
-			cfg.Backend.Database))
-
+	logs, err := newLogStore(cfg.Server.LogDir)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not create SQL connection")
+		store.Close()
+		return nil, errors.Wrap(err, "could not create job log store")
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, errors.Wrap(err, "connection ping failed")
+	pub, err := NewQueueClient(&cfg.Queue, publisherConnection)
+	if err != nil {
+		store.Close()
+		return nil, errors.Wrap(err, "could not create publisher connection")
 	}
+	pub.NotifyConnection(setGauge(serverQueueConnected))
+
+	return &serverBackend{
+		store: store, pub: pub, newJobExchange: cfg.Queue.NewJobExchange,
+		completedJobExchange: cfg.Queue.CompletedJobExchange, logs: logs}, nil
+}
 
+// checkSchemaVersion returns an error if the schema of the job DB is not at the latest
+// version
+func checkSchemaVersion(db *sql.DB, adapter databaseAdapter) error {
 	currentSchemaVersion, err := getSchemaVersion(db, adapter)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not retrieve current DB schema version")
+		return errors.Wrap(err, "could not retrieve current DB schema version")
 	}
 	if currentSchemaVersion != SchemaVersion {
-		return nil, fmt.Errorf(
-			"invalid schema version: latest = %v, database = %v",
+		return fmt.Errorf(
+			"invalid schema version: latest = %v, database = %v "+
+				"(run \"conveyor db migrate\" to update the schema)",
 			SchemaVersion, currentSchemaVersion)
 	}
-
-	pub, err := NewQueueClient(&cfg.Queue, publisherConnection)
-	if err != nil {
-		return nil, errors.Wrap(err, "could not create publisher connection")
-	}
-
-	return &serverBackend{db, adapter, pub, cfg.Queue.NewJobExchange, cfg.Queue.CompletedJobExchange}, nil
+	return nil
 }
 
-// Close the connection to the database and the queue
+// Close the job store and the connection to the queue
 func (b *serverBackend) Close() {
-	b.db.Close()
+	b.store.Close()
 	b.pub.Close()
 }
 
-// getJobStatus returns the rows from the job DB corresponding to the IDs
+// getJobStatus returns the jobs from the job store corresponding to the IDs
 func (b *serverBackend) getJobStatus(ids []string, full bool) (*GetJobStatusReply, error) {
 	reply := GetJobStatusReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
 
-	queryStr := b.dbAdapter.jobStatusQuery(len(ids))
-	params := make([]interface{}, len(ids))
-	for i, v := range ids[0 : len(ids)-1] {
-		params[i] = v
-	}
-	params[len(ids)-1] = ids[len(ids)-1]
-
-	rows, err := b.db.Query(queryStr, params...)
+	defer observeDBQuery("get_job_status", time.Now())
+	jobs, err := b.store.GetJobs(ids, full)
 	if err != nil {
 		reason := "SQL query failed"
 		reply.Status = "error"
 		reply.Reason = reason
 		return &reply, errors.Wrap(err, reason)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		st, err := scanRow(rows)
-		if err != nil {
-			reason := "SQL query scan failed"
-			reply.Status = "error"
-			reply.Reason = reason
-			reply.IDs = []JobStatus{}
-			reply.Jobs = []ProcessedJob{}
-			return &reply, errors.Wrap(err, reason)
-		}
 
+	for _, st := range jobs {
 		if full {
-			reply.Jobs = append(reply.Jobs, *st)
+			reply.Jobs = append(reply.Jobs, st)
 		} else {
-			reply.IDs = append(reply.IDs, JobStatus{ID: st.ID, Successful: st.Successful})
+			reply.IDs = append(
+				reply.IDs, JobStatus{
+					ID: st.ID, State: st.State, Successful: st.Successful, Priority: st.Priority})
 		}
 	}
 
 	return &reply, nil
 }
 
-// putNewJob publishes a new (unprocessed) job
+// listJobs returns a page of the jobs from the job store which match the filter
+func (b *serverBackend) listJobs(f *JobFilter) (*ListJobsReply, error) {
+	reply := ListJobsReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
+
+	defer observeDBQuery("list_jobs", time.Now())
+	jobs, more, err := b.store.ListJobs(f)
+	if err != nil {
+		reason := "SQL query failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	if len(jobs) > 0 {
+		reply.Jobs = jobs
+	}
+	if more {
+		reply.NextOffset = f.Offset + f.Limit
+	}
+
+	return &reply, nil
+}
+
+// getJobDependencies returns the dependency graph of a job: the job itself, the jobs it
+// depends on (directly or indirectly) and the jobs which depend on it
+func (b *serverBackend) getJobDependencies(id uuid.UUID) (*GetJobDependenciesReply, error) {
+	reply := GetJobDependenciesReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
+
+	edges := map[uuid.UUID][]uuid.UUID{}
+	t0 := time.Now()
+	ancestors, err := b.walkDependencies(
+		id, b.store.JobDependencies,
+		func(job, dep uuid.UUID) { edges[job] = append(edges[job], dep) })
+	if err != nil {
+		reason := "could not query job dependencies"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+	descendants, err := b.walkDependencies(
+		id, b.store.JobDependents,
+		func(job, dependent uuid.UUID) { edges[dependent] = append(edges[dependent], job) })
+	if err != nil {
+		reason := "could not query job dependents"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+	observeDBQuery("job_dependencies", t0)
+
+	ids := []string{id.String()}
+	for _, n := range append(ancestors, descendants...) {
+		ids = append(ids, n.String())
+	}
+	status, err := b.getJobStatus(ids, true)
+	if err != nil {
+		reply.Status = status.Status
+		reply.Reason = status.Reason
+		return &reply, err
+	}
+	if len(status.Jobs) == 0 {
+		reply.Status = "error"
+		reply.Reason = errJobNotFound.Error()
+		return &reply, errJobNotFound
+	}
+
+	reply.Jobs = status.Jobs
+	reply.Dependencies = edges
+
+	return &reply, nil
+}
+
+// putNewJob records a new (unprocessed) job in the DB. The job is published right away
+// if it has no unfinished dependencies; otherwise it is held until they are finished
 func (b *serverBackend) putNewJob(j *JobSpecification) (*PostNewJobReply, error) {
 	id := uuid.New()
 
@@ -136,53 +258,451 @@ func (b *serverBackend) putNewJob(j *JobSpecification) (*PostNewJobReply, error)
 
 	job := UnprocessedJob{ID: id, JobSpecification: *j}
 
-	if err := b.pub.publish(b.newJobExchange, "", &job); err != nil {
-		return nil, errors.Wrap(err, "job description publishing failed")
+	reason, err := b.submitJobs([]UnprocessedJob{job})
+	countSubmissions(1, err)
+	if err != nil {
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, err
 	}
+
 	return &reply, nil
 }
 
-// putJobStatus inserts a job into the DB
-func (b *serverBackend) putJobStatus(j *ProcessedJob) (*PostJobStatusReply, error) {
-	reply := PostJobStatusReply{BasicReply{Status: "ok", Reason: ""}}
+// putJobBatch records a batch of new jobs in the DB, after validating the dependencies
+// between them. Either all the jobs of the batch are recorded, or none of them
+func (b *serverBackend) putJobBatch(batch *JobBatch) (*PostJobBatchReply, error) {
+	reply := PostJobBatchReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
+
+	jobs, ids, err := batch.resolve()
+	if err != nil {
+		countSubmissions(len(batch.Jobs), err)
+		reply.Status = "error"
+		reply.Reason = err.Error()
+		return &reply, errors.Wrap(err, "invalid job batch")
+	}
+
+	reason, err := b.submitJobs(jobs)
+	countSubmissions(len(jobs), err)
+	if err != nil {
+		reply.Status = "error"
+		reply.Reason = reason
+		if errors.Cause(err) == errJobPublication {
+			// The jobs were recorded in the DB
+			reply.IDs = ids
+		}
+		return &reply, err
+	}
+
+	reply.IDs = ids
+
+	return &reply, nil
+}
+
+// submitJobs records new jobs in the DB, in a single transaction, and publishes the ones
+// without unfinished dependencies. The jobs must be ordered such that each job comes
+// after its dependencies from the same submission. On error, the returned string is the
+// reason to be reported to the client
+func (b *serverBackend) submitJobs(jobs []UnprocessedJob) (string, error) {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	// Determine the initial state of each job
+	states := make(map[string]string, len(jobs))
+	errMsgs := make(map[string]string, len(jobs))
+	for _, job := range jobs {
+		deps := []string{}
+		pending := false
+		failedDep := ""
+		for _, dep := range job.Dependencies {
+			switch states[dep] {
+			case "":
+				deps = append(deps, dep)
+			case JobStateFailed:
+				failedDep = dep
+			default:
+				pending = true
+			}
+		}
+
+		depState, dbFailedDep, err := b.checkDependencies(deps)
+		if err != nil {
+			reason := "could not check job dependencies"
+			if e, ok := errors.Cause(err).(errUnknownDependencies); ok {
+				reason = e.Error()
+			}
+			return reason, errors.Wrap(err, reason)
+		}
+		if failedDep == "" {
+			failedDep = dbFailedDep
+		}
+
+		id := job.ID.String()
+		switch {
+		case failedDep != "":
+			states[id] = JobStateFailed
+			errMsgs[id] = fmt.Sprintf("dependency %v failed", failedDep)
+		case pending || depState == dependenciesPending:
+			states[id] = JobStateWaiting
+		case job.NotBefore.After(time.Now()):
+			states[id] = JobStateScheduled
+		default:
+			states[id] = JobStateSubmitted
+		}
+	}
+
+	submitTime := time.Now()
+	rows := make([]ProcessedJob, 0, len(jobs))
+	for _, job := range jobs {
+		id := job.ID.String()
+		row := ProcessedJob{
+			UnprocessedJob: job,
+			SubmitTime:     submitTime,
+			State:          states[id],
+			ErrorMessage:   errMsgs[id],
+		}
+		if states[id] == JobStateFailed {
+			row.FinishTime = submitTime
+		}
+		rows = append(rows, row)
+	}
+
+	t0 := time.Now()
+	if err := b.store.InsertJobs(rows); err != nil {
+		reason := "could not record jobs"
+		return reason, errors.Wrap(err, reason)
+	}
+	observeDBQuery("insert_jobs", t0)
+
+	// The reason of the last publication failure is reported to the client
+	var publishErr error
+	for i := range jobs {
+		job := &jobs[i]
+		state := states[job.ID.String()]
+
+		Log.Info().
+			Str("job_id", job.ID.String()).
+			Str("repository", job.Repository).
+			Str("state", state).
+			Msg("job submitted")
+
+		switch state {
+		case JobStateSubmitted:
+			if err := b.publishJob(job); err != nil {
+				Log.Error().Err(err).Str("job_id", job.ID.String()).Msg("could not publish job")
+				publishErr = err
+			}
+		case JobStateFailed:
+			if err := b.notifyCompletion(job.ID, state, false); err != nil {
+				Log.Error().Err(err).Str("job_id", job.ID.String()).Msg("could not notify job failure")
+			}
+		}
+	}
+
+	if publishErr != nil {
+		return publishErr.Error(), errJobPublication
+	}
+
+	return "", nil
+}
+
+// putJobState records a state transition of a job which is being processed
+func (b *serverBackend) putJobState(u *JobStateUpdate) (*PostJobStateReply, error) {
+	reply := PostJobStateReply{BasicReply{Status: "ok", Reason: ""}}
+
+	var startTime time.Time
+	if u.State == JobStateRunning {
+		startTime = u.Time
+	}
+
+	t0 := time.Now()
+	updated, err := b.store.UpdateJobState(u.ID, u.State, u.WorkerName, startTime)
+	observeDBQuery("update_job_state", t0)
+	if err != nil {
+		reason := "executing SQL statement failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	if !updated {
+		reply.Status = "error"
+		reply.Reason = errJobNotPending.Error()
+		return &reply, errJobNotPending
+	}
+
+	Log.Info().
+		Str("job_id", u.ID.String()).
+		Str("state", u.State).
+		Str("worker", u.WorkerName).
+		Msg("job state changed")
+
+	return &reply, nil
+}
+
+// failJob marks a job which has not been processed as failed
+func (b *serverBackend) failJob(id uuid.UUID, reason string) error {
+	return b.finishJob(id, JobStateFailed, reason)
+}
+
+// finishJob moves a job which has not been processed by a worker into a final state
+// and publishes the corresponding completion notification
+func (b *serverBackend) finishJob(id uuid.UUID, state, reason string) error {
+	t0 := time.Now()
+	finished, err := b.store.FinishJob(id, state, reason, time.Now())
+	observeDBQuery("finish_job", t0)
+	if err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	if !finished {
+		return errJobNotPending
+	}
+
+	if err := b.notifyCompletion(id, state, false); err != nil {
+		return err
+	}
+
+	Log.Info().
+		Str("job_id", id.String()).
+		Str("state", state).
+		Str("reason", reason).
+		Msg("job finished")
+
+	return nil
+}
+
+// notifyCompletion publishes the completion notification of a job
+func (b *serverBackend) notifyCompletion(id uuid.UUID, state string, successful bool) error {
+	// Wake up the clients following the log of the job
+	b.logs.notify(id)
+
+	status := JobStatus{ID: id, State: state, Successful: successful}
+	if err := b.pub.publish(
+		b.completedJobExchange, notificationKey(state), 0, &status); err != nil {
+		publishFailures.WithLabelValues(b.completedJobExchange).Inc()
+		return errors.Wrap(err, "publishing job status notification failed")
+	}
+	return nil
+}
+
+// cancelJob cancels a job which is not yet finished. The jobs which depend on it, directly
+// or indirectly, are failed. A worker which is processing the job is notified through
+// the completion notification of the cancelled job
+func (b *serverBackend) cancelJob(req *CancelJobRequest) (*CancelJobReply, error) {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	reply := CancelJobReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
 
-	tx, err := b.db.Begin()
+	msg := "job cancelled"
+	if req.Reason != "" {
+		msg += ": " + req.Reason
+	}
+	if err := b.finishJob(req.ID, JobStateCancelled, msg); err != nil {
+		reason := "could not cancel job"
+		if errors.Cause(err) == errJobNotPending {
+			reason = errJobNotPending.Error()
+		}
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	failed, err := b.failDependents(req.ID, fmt.Sprintf("dependency %v was cancelled", req.ID))
+	reply.FailedDependents = failed
 	if err != nil {
-		reason := "opening SQL transaction failed"
+		reason := "could not fail the dependents of the cancelled job"
 		reply.Status = "error"
 		reply.Reason = reason
 		return &reply, errors.Wrap(err, reason)
 	}
-	defer tx.Rollback()
 
-	queryStr := b.dbAdapter.insertOrUpdateJobStatement()
-	if _, err := tx.Exec(queryStr,
-		j.ID, j.JobName, j.Repository, j.Payload, j.LeasePath,
-		strings.Join(j.Dependencies, ","), j.WorkerName, j.StartTime,
-		j.FinishTime, j.Successful, j.ErrorMessage); err != nil {
+	return &reply, nil
+}
+
+// setJobPriority changes the priority of a job which is not yet running. A queued job is
+// published again with the new priority; the workers skip the message published before,
+// since its priority no longer matches the recorded one
+func (b *serverBackend) setJobPriority(req *JobPriorityRequest) (*JobPriorityReply, error) {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	reply := JobPriorityReply{BasicReply{Status: "ok", Reason: ""}}
+
+	rep, err := b.getJobStatus([]string{req.ID.String()}, true)
+	if err != nil {
+		reply.Status = rep.Status
+		reply.Reason = rep.Reason
+		return &reply, err
+	}
+	if len(rep.Jobs) == 0 || !isQueuedState(rep.Jobs[0].State) {
+		reply.Status = "error"
+		reply.Reason = errJobNotQueued.Error()
+		return &reply, errJobNotQueued
+	}
+	job := rep.Jobs[0]
+	if job.Priority == req.Priority {
+		return &reply, nil
+	}
+
+	t0 := time.Now()
+	updated, err := b.store.UpdateJobPriority(req.ID, req.Priority)
+	observeDBQuery("update_job_priority", t0)
+	if err != nil {
 		reason := "executing SQL statement failed"
 		reply.Status = "error"
 		reply.Reason = reason
 		return &reply, errors.Wrap(err, reason)
 	}
+	if !updated {
+		reply.Status = "error"
+		reply.Reason = errJobNotQueued.Error()
+		return &reply, errJobNotQueued
+	}
 
-	err = tx.Commit()
+	Log.Info().
+		Str("job_id", req.ID.String()).
+		Int("priority", req.Priority).
+		Int("previous_priority", job.Priority).
+		Msg("job priority changed")
+
+	if job.State == JobStateSubmitted {
+		job.Priority = req.Priority
+		if err := b.publishJob(&job.UnprocessedJob); err != nil {
+			reply.Status = "error"
+			reply.Reason = err.Error()
+			return &reply, err
+		}
+	}
+
+	return &reply, nil
+}
+
+// putJobLog stores a chunk of the log of a job
+func (b *serverBackend) putJobLog(chunk *JobLogChunk) (*PostJobLogReply, error) {
+	reply := PostJobLogReply{BasicReply{Status: "ok", Reason: ""}}
+
+	if chunk.ID == uuid.Nil {
+		reply.Status = "error"
+		reply.Reason = "missing job ID"
+		return &reply, errors.New(reply.Reason)
+	}
+
+	if err := b.logs.write(chunk); err != nil {
+		reason := "could not store job log"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+
+	return &reply, nil
+}
+
+// getJobLog returns the log of a job, starting at offset. When following the log of an
+// unfinished job, the query waits a limited amount of time for new output
+func (b *serverBackend) getJobLog(
+	id uuid.UUID, offset int64, follow bool) (*GetJobLogReply, error) {
+	reply := GetJobLogReply{BasicReply: BasicReply{Status: "ok", Reason: ""}}
+
+	state, err := b.getJobState(id)
+	if err == nil && follow && !isFinalState(state) {
+		b.logs.wait(id, offset, logPollTimeout)
+		state, err = b.getJobState(id)
+	}
 	if err != nil {
-		reason := "committing SQL transaction failed"
+		reason := "could not query job state"
+		if err == errJobNotFound {
+			reason = errJobNotFound.Error()
+		}
 		reply.Status = "error"
 		reply.Reason = reason
 		return &reply, errors.Wrap(err, reason)
 	}
+	// The worker uploads the whole log before reporting the final state of the job,
+	// so the log read after seeing a final state is complete
+	reply.Finished = isFinalState(state)
+
+	data, size, err := b.logs.read(id, offset)
+	if err == errLogNotFound && follow {
+		// The job has not produced any output yet, or was finished without running
+		data, size, err = nil, 0, nil
+	}
+	reply.NextOffset = size
+	if err != nil {
+		reason := "could not read job log"
+		if err == errLogNotFound {
+			reason = errLogNotFound.Error()
+		}
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+	reply.Data = data
 
-	status := JobStatus{ID: j.ID, Successful: j.Successful}
-	var routingKey string
-	if j.Successful {
-		routingKey = successKey
-	} else {
-		routingKey = failedKey
+	return &reply, nil
+}
+
+// getJobRepository returns the repository of a job, or an empty string if the job
+// is unknown
+func (b *serverBackend) getJobRepository(id uuid.UUID) (string, error) {
+	rep, err := b.getJobStatus([]string{id.String()}, true)
+	if err != nil {
+		return "", err
 	}
-	if err := b.pub.publish(b.completedJobExchange, routingKey, &status); err != nil {
-		return nil, errors.Wrap(err, "publishing job status notification failed")
+	if len(rep.Jobs) == 0 {
+		return "", nil
+	}
+	return rep.Jobs[0].Repository, nil
+}
+
+// getJobState returns the current state of a job
+func (b *serverBackend) getJobState(id uuid.UUID) (string, error) {
+	rep, err := b.getJobStatus([]string{id.String()}, false)
+	if err != nil {
+		return "", err
+	}
+	if len(rep.IDs) == 0 {
+		return "", errJobNotFound
+	}
+	return rep.IDs[0].State, nil
+}
+
+// putJobStatus records a job reported by a worker in the job store
+func (b *serverBackend) putJobStatus(j *ProcessedJob) (*PostJobStatusReply, error) {
+	reply := PostJobStatusReply{BasicReply{Status: "ok", Reason: ""}}
+
+	// Workers which predate job states only report the completion status
+	if j.State == "" {
+		j.State = completionState(j.Successful)
+	}
+
+	t0 := time.Now()
+	finished, err := b.recordJobStatus(j)
+	if err != nil {
+		reason := "could not record job"
+		if errors.Cause(err) == errJobFinished {
+			reason = errJobFinished.Error()
+		}
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+	observeDBQuery("put_job_status", t0)
+	jobStatusPosts.WithLabelValues(j.State).Inc()
+
+	// The completion of a job cancelled while it was running was already notified, and
+	// its dependents were failed
+	if finished {
+		Log.Info().
+			Str("job_id", j.ID.String()).
+			Str("worker", j.WorkerName).
+			Str("state", j.State).
+			Msg("run of finished job recorded")
+		return &reply, nil
+	}
+
+	if err := b.notifyCompletion(j.ID, j.State, j.Successful); err != nil {
+		return nil, err
 	}
 
 	Log.Info().
@@ -191,25 +711,65 @@ func (b *serverBackend) putJobStatus(j *ProcessedJob) (*PostJobStatusReply, erro
 		Time("start_time", j.StartTime).
 		Time("finish_time", j.FinishTime).
 		Str("worker", j.WorkerName).
+		Str("state", j.State).
 		Msg("job inserted")
 
+	if isFinalState(j.State) {
+		if err := b.scheduleDependents(j.ID, j.State); err != nil {
+			Log.Error().Err(err).Str("job_id", j.ID.String()).Msg("could not schedule dependent jobs")
+		}
+	}
+
 	return &reply, nil
 }
 
-func scanRow(rows *sql.Rows) (*ProcessedJob, error) {
-	var st ProcessedJob
-	var deps string
-	if err := rows.Scan(
-		&st.ID, &st.JobName, &st.Repository, &st.Payload, &st.LeasePath,
-		&deps, &st.WorkerName, &st.StartTime, &st.FinishTime,
-		&st.Successful, &st.ErrorMessage); err != nil {
-		return nil, err
+// recordJobStatus records the status of a job posted by a worker. The check of the
+// recorded state and the update are serialized with the cancellations. Returns true if
+// the job was already finished
+func (b *serverBackend) recordJobStatus(j *ProcessedJob) (bool, error) {
+	b.schedMu.Lock()
+	defer b.schedMu.Unlock()
+
+	finished, err := b.keepFinishedState(j)
+	if err != nil {
+		return false, err
 	}
-	if deps != "" {
-		st.Dependencies = strings.Split(deps, ",")
+
+	if err := b.store.PutJob(j); err != nil {
+		return false, err
 	}
 
-	return &st, nil
+	return finished, nil
+}
+
+// keepFinishedState returns true if the job of a posted status is already in a final
+// state, in which case only the status posted by the worker which ran the job is
+// accepted: the job keeps the state which was announced, and the outcome of the run is
+// added to its error message. Otherwise errJobFinished is returned
+func (b *serverBackend) keepFinishedState(j *ProcessedJob) (bool, error) {
+	t0 := time.Now()
+	jobs, err := b.store.GetJobs([]string{j.ID.String()}, false)
+	observeDBQuery("get_job_status", t0)
+	if err != nil {
+		return false, errors.Wrap(err, "SQL query failed")
+	}
+	if len(jobs) == 0 || !isFinalState(jobs[0].State) {
+		return false, nil
+	}
+	recorded := jobs[0]
+	if !isFinalState(j.State) || j.WorkerName == "" || j.WorkerName != recorded.WorkerName {
+		return true, errJobFinished
+	}
+
+	errMsg := recorded.ErrorMessage
+	if outcome := fmt.Sprintf(" (the run %v)", j.State); j.State != recorded.State &&
+		!strings.HasSuffix(errMsg, outcome) {
+		errMsg += outcome
+	}
+	j.State = recorded.State
+	j.Successful = recorded.Successful
+	j.ErrorMessage = errMsg
+	return true, nil
 }
 
 func getSchemaVersion(db *sql.DB, adapter databaseAdapter) (int, error) {
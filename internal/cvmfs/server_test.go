@@ -0,0 +1,657 @@
+package cvmfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// testPublisher records the messages published by the server. When err is set, the
+// publication of new jobs fails with it, as if the broker did not confirm them
+type testPublisher struct {
+	mu       sync.Mutex
+	messages []testMessage
+	err      error
+}
+
+type testMessage struct {
+	exchange string
+	key      string
+	priority uint8
+	body     []byte
+}
+
+func (p *testPublisher) publish(
+	exchange string, key string, priority uint8, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil && exchange == "jobs.new" {
+		return p.err
+	}
+	p.messages = append(p.messages, testMessage{exchange, key, priority, body})
+	return nil
+}
+
+func (p *testPublisher) Close() error {
+	return nil
+}
+
+// published returns the IDs of the jobs published to an exchange
+func (p *testPublisher) published(exchange string) []uuid.UUID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := []uuid.UUID{}
+	for _, m := range p.messages {
+		if m.exchange != exchange {
+			continue
+		}
+		var v struct{ ID uuid.UUID }
+		if err := json.Unmarshal(m.body, &v); err == nil {
+			ids = append(ids, v.ID)
+		}
+	}
+	return ids
+}
+
+func newTestBackend(t *testing.T) (*serverBackend, *testPublisher, func()) {
+	dir, err := ioutil.TempDir("", "conveyor-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, err := newLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &testPublisher{}
+	b := &serverBackend{
+		store: newMemoryStore(), pub: pub, newJobExchange: "jobs.new",
+		completedJobExchange: "jobs.done", logs: logs}
+	return b, pub, func() { os.RemoveAll(dir) }
+}
+
+// serveSigned calls a handler with a request signed by a key valid for the repositories
+// and all the job priorities, and decodes the JSON reply into "reply". The status code
+// of the response is returned
+func serveSigned(
+	t *testing.T, h http.HandlerFunc, method, target string, body interface{},
+	reply interface{}, repositories ...string) int {
+	key := &signingKey{
+		ID: "test", Secret: "secret", Repositories: repositories, MaxPriority: maxJobPriority}
+	return serveWithKey(t, h, method, target, body, reply, key)
+}
+
+// serveWithKey calls a handler with a request signed by the key, and decodes the JSON
+// reply into "reply". The status code of the response is returned
+func serveWithKey(
+	t *testing.T, h http.HandlerFunc, method, target string, body interface{},
+	reply interface{}, key *signingKey) int {
+	var buf []byte
+	if body != nil {
+		var err error
+		if buf, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(buf))
+	req = req.WithContext(context.WithValue(req.Context(), signingKeyContextKey{}, key))
+
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code == http.StatusOK && reply != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+			t.Fatalf("invalid reply %q: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestServerJobLifecycle(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	batch := JobBatch{Jobs: []BatchJob{
+		{Name: "a", JobSpecification: JobSpecification{Repository: "sft.cern.ch", LeasePath: "/a"}},
+		{Name: "b", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", LeasePath: "/b", Dependencies: []string{"a"}}},
+	}}
+	var submitted PostJobBatchReply
+	serveSigned(t, makePutJobBatchHandler(b), "POST", "/jobs/batch", &batch, &submitted, "sft.cern.ch")
+	if submitted.Status != "ok" || len(submitted.IDs) != 2 {
+		t.Fatalf("batch not submitted: %+v", submitted)
+	}
+	a, bb := submitted.IDs["a"], submitted.IDs["b"]
+
+	// Only the job without dependencies is queued, with its repository as routing key
+	if ids := pub.published("jobs.new"); len(ids) != 1 || ids[0] != a {
+		t.Fatalf("unexpected published jobs: %v", ids)
+	}
+	if key := pub.messages[0].key; key != "sft.cern.ch" {
+		t.Errorf("unexpected routing key of the job: %q", key)
+	}
+
+	var state PostJobStateReply
+	update := JobStateUpdate{ID: a, State: JobStateRunning, WorkerName: "w1", Time: time.Now()}
+	serveSigned(t, makePutJobStateHandler(b), "POST", "/jobs/state", &update, &state, "sft.cern.ch")
+	if state.Status != "ok" {
+		t.Fatalf("state not updated: %+v", state)
+	}
+
+	now := time.Now()
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{ID: a, JobSpecification: batch.Jobs[0].JobSpecification},
+		WorkerName:     "w1",
+		StartTime:      now,
+		FinishTime:     now,
+		State:          JobStateSucceeded,
+		Successful:     true,
+		Attempts: []JobAttempt{
+			{Attempt: 1, WorkerName: "w1", StartTime: now, FinishTime: now,
+				Phase: PhaseScript, ErrorMessage: "running transaction script failed", ExitCode: 1},
+			{Attempt: 2, WorkerName: "w1", StartTime: now, FinishTime: now, Successful: true},
+		},
+	}
+	var posted PostJobStatusReply
+	serveSigned(t, makePutJobStatusHandler(b), "POST", "/jobs/complete", &job, &posted, "sft.cern.ch")
+	if posted.Status != "ok" {
+		t.Fatalf("job status not recorded: %+v", posted)
+	}
+
+	// The dependent job is released once its dependency succeeded
+	if ids := pub.published("jobs.new"); len(ids) != 2 || ids[1] != bb {
+		t.Errorf("dependent job not released: %v", ids)
+	}
+	if ids := pub.published("jobs.done"); len(ids) != 1 || ids[0] != a {
+		t.Errorf("unexpected completion notifications: %v", ids)
+	}
+
+	var status GetJobStatusReply
+	serveSigned(t, makeGetJobStatusHandler(b), "GET",
+		"/jobs/complete?id="+a.String()+"&id="+bb.String()+"&full=true", nil, &status)
+	if status.Status != "ok" || len(status.Jobs) != 2 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	for _, j := range status.Jobs {
+		switch j.ID {
+		case a:
+			if j.State != JobStateSucceeded || len(j.Attempts) != 2 || j.SubmitTime.IsZero() {
+				t.Errorf("unexpected status of the finished job: %+v", j)
+			}
+		case bb:
+			if j.State != JobStateSubmitted {
+				t.Errorf("unexpected status of the released job: %+v", j)
+			}
+		}
+	}
+
+	// A finished job can't change state
+	update.State = JobStateRunning
+	serveSigned(t, makePutJobStateHandler(b), "POST", "/jobs/state", &update, &state, "sft.cern.ch")
+	if state.Status != "error" || state.Reason != errJobNotPending.Error() {
+		t.Errorf("state of a finished job updated: %+v", state)
+	}
+}
+
+func TestServerCancelJob(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	batch := JobBatch{Jobs: []BatchJob{
+		{Name: "a", JobSpecification: JobSpecification{Repository: "sft.cern.ch"}},
+		{Name: "b", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{"a"}}},
+		{Name: "c", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{"b"}}},
+	}}
+	var submitted PostJobBatchReply
+	serveSigned(t, makePutJobBatchHandler(b), "POST", "/jobs/batch", &batch, &submitted, "sft.cern.ch")
+	if submitted.Status != "ok" {
+		t.Fatalf("batch not submitted: %+v", submitted)
+	}
+
+	var cancelled CancelJobReply
+	req := CancelJobRequest{ID: submitted.IDs["a"], Reason: "test"}
+	serveSigned(t, makeCancelJobHandler(b), "POST", "/jobs/cancel", &req, &cancelled, "sft.cern.ch")
+	if cancelled.Status != "ok" || len(cancelled.FailedDependents) != 2 {
+		t.Fatalf("unexpected cancellation reply: %+v", cancelled)
+	}
+
+	// All the jobs are finished, and notified as such
+	if ids := pub.published("jobs.done"); len(ids) != 3 {
+		t.Errorf("unexpected completion notifications: %v", ids)
+	}
+	list, err := b.listJobs(&JobFilter{State: JobStateFailed, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Jobs) != 2 {
+		t.Errorf("dependent jobs not failed: %+v", list.Jobs)
+	}
+
+	var deps GetJobDependenciesReply
+	serveSigned(t, makeGetJobDependenciesHandler(b), "GET",
+		"/jobs/dependencies?id="+submitted.IDs["b"].String(), nil, &deps)
+	if deps.Status != "ok" || len(deps.Jobs) != 3 || len(deps.Dependencies) != 2 {
+		t.Errorf("unexpected dependency graph: %+v", deps)
+	}
+}
+
+func TestServerStatusOfCancelledJob(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	batch := JobBatch{Jobs: []BatchJob{
+		{Name: "a", JobSpecification: JobSpecification{Repository: "sft.cern.ch"}},
+		{Name: "b", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{"a"}}},
+	}}
+	var submitted PostJobBatchReply
+	serveSigned(t, makePutJobBatchHandler(b), "POST", "/jobs/batch", &batch, &submitted, "sft.cern.ch")
+	if submitted.Status != "ok" {
+		t.Fatalf("batch not submitted: %+v", submitted)
+	}
+	a := submitted.IDs["a"]
+
+	var state PostJobStateReply
+	update := JobStateUpdate{ID: a, State: JobStateRunning, WorkerName: "w1", Time: time.Now()}
+	serveSigned(t, makePutJobStateHandler(b), "POST", "/jobs/state", &update, &state, "sft.cern.ch")
+	if state.Status != "ok" {
+		t.Fatalf("state not updated: %+v", state)
+	}
+
+	// The job is cancelled while it is running
+	var cancelled CancelJobReply
+	req := CancelJobRequest{ID: a}
+	serveSigned(t, makeCancelJobHandler(b), "POST", "/jobs/cancel", &req, &cancelled, "sft.cern.ch")
+	if cancelled.Status != "ok" || len(cancelled.FailedDependents) != 1 {
+		t.Fatalf("unexpected cancellation reply: %+v", cancelled)
+	}
+	notified := len(pub.published("jobs.done"))
+
+	now := time.Now()
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{ID: a, JobSpecification: batch.Jobs[0].JobSpecification},
+		WorkerName:     "w2",
+		StartTime:      now,
+		FinishTime:     now,
+		State:          JobStateSucceeded,
+		Successful:     true,
+		Attempts: []JobAttempt{
+			{Attempt: 1, WorkerName: "w1", StartTime: now, FinishTime: now, Successful: true},
+		},
+	}
+
+	// Another worker can't change the status of the finished job
+	var posted PostJobStatusReply
+	serveSigned(t, makePutJobStatusHandler(b), "POST", "/jobs/complete", &job, &posted, "sft.cern.ch")
+	if posted.Status != "error" || posted.Reason != errJobFinished.Error() {
+		t.Errorf("status of a finished job recorded: %+v", posted)
+	}
+
+	// The worker which ran the job records its run, without changing the announced state
+	job.WorkerName = "w1"
+	serveSigned(t, makePutJobStatusHandler(b), "POST", "/jobs/complete", &job, &posted, "sft.cern.ch")
+	if posted.Status != "ok" {
+		t.Fatalf("job status not recorded: %+v", posted)
+	}
+	if n := len(pub.published("jobs.done")); n != notified {
+		t.Errorf("completion notified again: %v notifications, expected %v", n, notified)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 1 {
+		t.Errorf("dependent job released: %v", ids)
+	}
+
+	var status GetJobStatusReply
+	serveSigned(t, makeGetJobStatusHandler(b), "GET",
+		"/jobs/complete?id="+a.String()+"&full=true", nil, &status)
+	if status.Status != "ok" || len(status.Jobs) != 1 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	j := status.Jobs[0]
+	if j.State != JobStateCancelled || j.Successful ||
+		j.ErrorMessage != "job cancelled (the run succeeded)" {
+		t.Errorf("state of the cancelled job changed: %+v", j)
+	}
+	if len(j.Attempts) != 1 || !j.Attempts[0].Successful {
+		t.Errorf("run of the cancelled job not recorded: %+v", j.Attempts)
+	}
+}
+
+func TestServerPublicationFailure(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	// No worker declared the job queue of the repository
+	pub.err = errMessageUnroutable
+
+	batch := JobBatch{Jobs: []BatchJob{
+		{Name: "a", JobSpecification: JobSpecification{Repository: "sft.cern.ch"}},
+		{Name: "b", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{"a"}}},
+	}}
+	var submitted PostJobBatchReply
+	serveSigned(t, makePutJobBatchHandler(b), "POST", "/jobs/batch", &batch, &submitted, "sft.cern.ch")
+	reason := "no job queue for repository sft.cern.ch"
+	if submitted.Status != "error" || !strings.Contains(submitted.Reason, reason) {
+		t.Fatalf("unexpected reply for an unpublished batch: %+v", submitted)
+	}
+	if len(submitted.IDs) != 2 {
+		t.Fatalf("IDs of the recorded jobs not returned: %+v", submitted)
+	}
+
+	// The unpublished job and its dependent are failed, with the reason recorded
+	var status GetJobStatusReply
+	serveSigned(t, makeGetJobStatusHandler(b), "GET",
+		"/jobs/complete?id="+submitted.IDs["a"].String()+"&id="+submitted.IDs["b"].String()+
+			"&full=true", nil, &status)
+	if len(status.Jobs) != 2 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	for _, j := range status.Jobs {
+		if j.State != JobStateFailed {
+			t.Errorf("job not failed: %+v", j)
+		}
+		if j.ID == submitted.IDs["a"] && !strings.Contains(j.ErrorMessage, reason) {
+			t.Errorf("reason of the failure not recorded: %q", j.ErrorMessage)
+		}
+	}
+}
+
+func TestServerAuthorization(t *testing.T) {
+	b, _, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	spec := JobSpecification{Repository: "sft.cern.ch", LeasePath: "/"}
+	code := serveSigned(t, makePutNewJobHandler(b), "POST", "/jobs", &spec, nil, "alice.cern.ch")
+	if code != http.StatusForbidden {
+		t.Errorf("job submitted with a key not valid for the repository: %v", code)
+	}
+
+	var submitted PostNewJobReply
+	serveSigned(t, makePutNewJobHandler(b), "POST", "/jobs", &spec, &submitted, "sft.cern.ch")
+	if submitted.Status != "ok" {
+		t.Fatalf("job not submitted: %+v", submitted)
+	}
+
+	// The repository of an existing job is checked too
+	req := CancelJobRequest{ID: submitted.ID}
+	code = serveSigned(t, makeCancelJobHandler(b), "POST", "/jobs/cancel", &req, nil, "alice.cern.ch")
+	if code != http.StatusForbidden {
+		t.Errorf("job cancelled with a key not valid for its repository: %v", code)
+	}
+}
+
+func TestServerJobPriority(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	// The priority of the jobs is limited by the key which signed the submission
+	key := &signingKey{
+		ID: "sft", Secret: "secret", Repositories: []string{"sft.cern.ch"}, MaxPriority: 5}
+	spec := JobSpecification{Repository: "sft.cern.ch", LeasePath: "/", Priority: 7}
+	code := serveWithKey(t, makePutNewJobHandler(b), "POST", "/jobs", &spec, nil, key)
+	if code != http.StatusForbidden {
+		t.Errorf("job submitted with a priority not allowed by the key: %v", code)
+	}
+	spec.Priority = maxJobPriority + 1
+	code = serveSigned(t, makePutNewJobHandler(b), "POST", "/jobs", &spec, nil, "sft.cern.ch")
+	if code != http.StatusBadRequest {
+		t.Errorf("job submitted with an invalid priority: %v", code)
+	}
+
+	var submitted PostNewJobReply
+	spec.Priority = 5
+	serveWithKey(t, makePutNewJobHandler(b), "POST", "/jobs", &spec, &submitted, key)
+	if submitted.Status != "ok" {
+		t.Fatalf("job not submitted: %+v", submitted)
+	}
+	if p := pub.messages[0].priority; p != 5 {
+		t.Errorf("unexpected priority of the job message: %v", p)
+	}
+
+	// A queued job is published again with its new priority
+	var changed JobPriorityReply
+	req := JobPriorityRequest{ID: submitted.ID, Priority: 9}
+	code = serveWithKey(t, makeSetJobPriorityHandler(b), "POST", "/jobs/priority", &req, nil, key)
+	if code != http.StatusForbidden {
+		t.Errorf("priority raised above the maximum of the key: %v", code)
+	}
+	serveSigned(t, makeSetJobPriorityHandler(b), "POST", "/jobs/priority", &req, &changed, "sft.cern.ch")
+	if changed.Status != "ok" {
+		t.Fatalf("priority not changed: %+v", changed)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 2 || ids[1] != submitted.ID ||
+		pub.messages[1].priority != 9 {
+		t.Errorf("job not published again with its new priority: %+v", pub.messages)
+	}
+
+	var status GetJobStatusReply
+	serveSigned(t, makeGetJobStatusHandler(b), "GET",
+		"/jobs/complete?id="+submitted.ID.String()+"&full=false", nil, &status)
+	if len(status.IDs) != 1 || status.IDs[0].Priority != 9 {
+		t.Errorf("unexpected job status: %+v", status)
+	}
+
+	// The priority of a running job can't change
+	update := JobStateUpdate{
+		ID: submitted.ID, State: JobStateRunning, WorkerName: "w1", Time: time.Now()}
+	serveSigned(t, makePutJobStateHandler(b), "POST", "/jobs/state", &update, nil, "sft.cern.ch")
+	req.Priority = 1
+	serveSigned(t, makeSetJobPriorityHandler(b), "POST", "/jobs/priority", &req, &changed, "sft.cern.ch")
+	if changed.Status != "error" || changed.Reason != errJobNotQueued.Error() {
+		t.Errorf("priority of a running job changed: %+v", changed)
+	}
+}
+
+func TestServerScheduledJobs(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	// "b" depends on "a", which is started right away, and must not start before "c"
+	now := time.Now()
+	batch := JobBatch{Jobs: []BatchJob{
+		{Name: "a", JobSpecification: JobSpecification{Repository: "sft.cern.ch"}},
+		{Name: "b", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", Dependencies: []string{"a"},
+			NotBefore: now.Add(time.Hour)}},
+		{Name: "c", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", NotBefore: now.Add(30 * time.Minute)}},
+		{Name: "d", JobSpecification: JobSpecification{
+			Repository: "sft.cern.ch", NotBefore: now.Add(30 * time.Minute)}},
+	}}
+	var submitted PostJobBatchReply
+	serveSigned(t, makePutJobBatchHandler(b), "POST", "/jobs/batch", &batch, &submitted, "sft.cern.ch")
+	if submitted.Status != "ok" {
+		t.Fatalf("batch not submitted: %+v", submitted)
+	}
+	a, bb, c, d := submitted.IDs["a"], submitted.IDs["b"], submitted.IDs["c"], submitted.IDs["d"]
+
+	state := func(id uuid.UUID) string {
+		rep, err := b.getJobStatus([]string{id.String()}, false)
+		if err != nil || len(rep.IDs) != 1 {
+			t.Fatalf("could not query job state: %v", err)
+		}
+		return rep.IDs[0].State
+	}
+	if state(c) != JobStateScheduled || state(bb) != JobStateWaiting {
+		t.Errorf("jobs not held: %v, %v", state(c), state(bb))
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 1 || ids[0] != a {
+		t.Fatalf("unexpected published jobs: %v", ids)
+	}
+
+	// A job whose dependencies finished before its start time is scheduled
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{ID: a, JobSpecification: batch.Jobs[0].JobSpecification},
+		FinishTime:     now,
+		State:          JobStateSucceeded,
+		Successful:     true,
+	}
+	serveSigned(t, makePutJobStatusHandler(b), "POST", "/jobs/complete", &job, nil, "sft.cern.ch")
+	if state(bb) != JobStateScheduled {
+		t.Errorf("dependent job not scheduled: %v", state(bb))
+	}
+
+	// A scheduled job can be cancelled
+	var cancelled CancelJobReply
+	req := CancelJobRequest{ID: d}
+	serveSigned(t, makeCancelJobHandler(b), "POST", "/jobs/cancel", &req, &cancelled, "sft.cern.ch")
+	if cancelled.Status != "ok" || state(d) != JobStateCancelled {
+		t.Errorf("scheduled job not cancelled: %+v", cancelled)
+	}
+
+	// Scheduled jobs are released once their start time has come
+	if err := b.releaseScheduledJobs(now.Add(45 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 2 || ids[1] != c {
+		t.Errorf("unexpected published jobs: %v", ids)
+	}
+	if err := b.releaseScheduledJobs(now.Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pub.published("jobs.new"); len(ids) != 3 || ids[2] != bb {
+		t.Errorf("unexpected published jobs: %v", ids)
+	}
+	if state(bb) != JobStateSubmitted || state(c) != JobStateSubmitted {
+		t.Errorf("released jobs not queued: %v, %v", state(bb), state(c))
+	}
+}
+
+func TestServerJobSchedules(t *testing.T) {
+	b, pub, cleanup := newTestBackend(t)
+	defer cleanup()
+
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2019, 3, day, hour, min, 0, 0, time.Local)
+	}
+	run := func(now time.Time) []uuid.UUID {
+		if err := b.runDueSchedules(now); err != nil {
+			t.Fatal(err)
+		}
+		return pub.published("jobs.new")
+	}
+	finish := func(id uuid.UUID) {
+		job := ProcessedJob{
+			UnprocessedJob: UnprocessedJob{ID: id, JobSpecification: JobSpecification{
+				Repository: "sft.cern.ch"}},
+			State: JobStateSucceeded, Successful: true}
+		serveSigned(t, makePutJobStatusHandler(b), "POST", "/jobs/complete", &job, nil, "sft.cern.ch")
+	}
+
+	// The key must be valid for the repository of the jobs
+	s := JobSchedule{Name: "nightly", Cron: "0 3 * * *", Job: JobSpecification{
+		Repository: "sft.cern.ch", LeasePath: "/lcg_95"}}
+	code := serveSigned(t, makePostScheduleHandler(b), "POST", "/schedules", &s, nil, "alice.cern.ch")
+	if code != http.StatusForbidden {
+		t.Errorf("schedule created with a key for another repository: %v", code)
+	}
+	if _, err := b.putSchedule(&s, at(1, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.putSchedule(&s, at(1, 10, 0)); errors.Cause(err) != errScheduleExists {
+		t.Errorf("schedule created twice: %v", err)
+	}
+	invalid := s
+	invalid.Name = "invalid"
+	invalid.Cron = "0 3 * *"
+	if _, err := b.putSchedule(&invalid, at(1, 10, 0)); err == nil {
+		t.Errorf("schedule with an invalid cron expression created")
+	}
+
+	if ids := run(at(1, 11, 0)); len(ids) != 0 {
+		t.Errorf("job submitted before the first run: %v", ids)
+	}
+	ids := run(at(2, 3, 0).Add(10 * time.Second))
+	if len(ids) != 1 {
+		t.Fatalf("unexpected published jobs: %v", ids)
+	}
+	first := ids[0]
+	rep, _ := b.getJobStatus([]string{first.String()}, true)
+	if len(rep.Jobs) != 1 || rep.Jobs[0].JobName != "nightly" || rep.Jobs[0].LeasePath != "/lcg_95" {
+		t.Errorf("unexpected scheduled job: %+v", rep.Jobs)
+	}
+
+	// The run is skipped while the previous job is unfinished
+	if ids := run(at(3, 3, 0).Add(10 * time.Second)); len(ids) != 1 {
+		t.Errorf("job submitted while the previous one is unfinished: %v", ids)
+	}
+	finish(first)
+	if ids := run(at(3, 3, 0).Add(20 * time.Second)); len(ids) != 1 {
+		t.Errorf("skipped run handled again: %v", ids)
+	}
+	ids = run(at(4, 3, 0).Add(10 * time.Second))
+	if len(ids) != 2 {
+		t.Fatalf("unexpected published jobs: %v", ids)
+	}
+	finish(ids[1])
+
+	// Missed runs are skipped
+	if ids := run(at(7, 10, 0)); len(ids) != 2 {
+		t.Errorf("job submitted for a missed run: %v", ids)
+	}
+	var list ListSchedulesReply
+	serveSigned(t, makeListSchedulesHandler(b), "GET", "/schedules", nil, &list)
+	if len(list.Schedules) != 1 || !list.Schedules[0].LastRun.Equal(at(7, 3, 0)) ||
+		list.Schedules[0].LastJobID != ids[1] || !list.Schedules[0].NextRun.Equal(at(8, 3, 0)) {
+		t.Errorf("unexpected schedules: %+v", list.Schedules)
+	}
+
+	// With the run-once policy, a single job is submitted for the missed runs. The
+	// schedule created through the API is not replaced by the one of the configuration
+	cfgs := []ScheduleConfig{
+		{Name: "hourly", Cron: "@hourly", Repository: "sft.cern.ch", LeasePath: "/",
+			MissedRuns: MissedRunsRunOnce},
+		{Name: "nightly", Cron: "@hourly", Repository: "sft.cern.ch", LeasePath: "/"},
+	}
+	if err := b.syncConfigSchedules(cfgs, at(7, 10, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if ids := run(at(7, 13, 30)); len(ids) != 3 {
+		t.Errorf("unexpected published jobs: %v", ids)
+	}
+	nightly, err := b.getSchedule("nightly")
+	if err != nil || nightly == nil || nightly.Cron != "0 3 * * *" ||
+		nightly.Source != scheduleSourceAPI {
+		t.Errorf("schedule created through the API replaced: %+v", nightly)
+	}
+
+	// The schedules of the configuration can't be deleted through the API
+	var deleted DeleteScheduleReply
+	del := DeleteScheduleRequest{Name: "hourly"}
+	serveSigned(t, makeDeleteScheduleHandler(b), "POST", "/schedules/delete", &del, &deleted, "sft.cern.ch")
+	if deleted.Status != "error" {
+		t.Errorf("schedule of the configuration deleted: %+v", deleted)
+	}
+	del = DeleteScheduleRequest{Name: "nightly"}
+	code = serveSigned(t, makeDeleteScheduleHandler(b), "POST", "/schedules/delete", &del, nil, "alice.cern.ch")
+	if code != http.StatusForbidden {
+		t.Errorf("schedule deleted with a key for another repository: %v", code)
+	}
+	serveSigned(t, makeDeleteScheduleHandler(b), "POST", "/schedules/delete", &del, &deleted, "sft.cern.ch")
+	if deleted.Status != "ok" {
+		t.Errorf("schedule not deleted: %+v", deleted)
+	}
+
+	// Schedules removed from the configuration are deleted
+	if err := b.syncConfigSchedules(nil, at(8, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if schedules, _ := b.store.GetSchedules(); len(schedules) != 0 {
+		t.Errorf("schedules not deleted: %+v", schedules)
+	}
+}
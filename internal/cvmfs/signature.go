@@ -0,0 +1,174 @@
+package cvmfs
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version 2 of the request signature covers the HTTP method, the path, a timestamp and a
+// nonce in addition to the payload of the request, so that a captured request can't be
+// replayed, or sent to a different endpoint. The version 1 signature only covers the
+// payload (the body of POST requests and the query string of GET requests)
+const (
+	signatureV2Prefix = "v2 "
+	timestampHeader   = "X-Conveyor-Timestamp"
+	nonceHeader       = "X-Conveyor-Nonce"
+)
+
+// signatureV2Message builds the message whose HMAC is the version 2 signature of a request
+func signatureV2Message(method, path, timestamp, nonce string, payload []byte) []byte {
+	msg := strings.Join([]string{method, path, timestamp, nonce, ""}, "\n")
+	return append([]byte(msg), payload...)
+}
+
+// newNonce returns a random string used once to sign a request
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "could not generate nonce")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// signRequest adds the version 2 signature of a request, computed with a key, to its
+// headers. The payload is the body of POST requests or the query string of GET requests
+func signRequest(req *http.Request, payload []byte, key *signingKey) error {
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	msg := signatureV2Message(req.Method, req.URL.Path, timestamp, nonce, payload)
+	hmac := base64.StdEncoding.EncodeToString(computeHMAC(msg, key.Secret))
+
+	req.Header.Set("Authorization", signatureV2Prefix+hmac)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(nonceHeader, nonce)
+	if key.ID != "" {
+		req.Header.Set(keyIDHeader, key.ID)
+	}
+
+	return nil
+}
+
+// signatureVerifier checks the signatures of the requests received by the server
+type signatureVerifier struct {
+	keys     *keyStore
+	acceptV1 bool
+	maxSkew  time.Duration
+	nonces   *nonceCache
+}
+
+func newSignatureVerifier(keys *keyStore, cfg *ServerConfig) *signatureVerifier {
+	maxSkew := time.Duration(cfg.MaxClockSkew) * time.Second
+	return &signatureVerifier{
+		keys:     keys,
+		acceptV1: cfg.AcceptV1Signatures,
+		maxSkew:  maxSkew,
+		// A nonce needs to be remembered as long as its timestamp is accepted
+		nonces: newNonceCache(2 * maxSkew),
+	}
+}
+
+// verify checks the signature of a request with the given payload, and returns the key
+// which signed it
+func (v *signatureVerifier) verify(req *http.Request, payload []byte) (*signingKey, error) {
+	keyID := req.Header.Get(keyIDHeader)
+	key, ok := v.keys.get(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID: %q", keyID)
+	}
+
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, signatureV2Prefix) {
+		if !v.acceptV1 {
+			return nil, errors.New("version 1 signatures are not accepted")
+		}
+		HMAC, err := base64.StdEncoding.DecodeString(authHeader)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not base64 decode HMAC")
+		}
+		if !checkHMAC(payload, HMAC, key.Secret) {
+			return nil, errors.New("invalid HMAC")
+		}
+		return key, nil
+	}
+
+	HMAC, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authHeader, signatureV2Prefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not base64 decode HMAC")
+	}
+
+	timestamp := req.Header.Get(timestampHeader)
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid request timestamp")
+	}
+	skew := time.Since(time.Unix(secs, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, fmt.Errorf("request timestamp is off by %v", skew.Round(time.Second))
+	}
+
+	nonce := req.Header.Get(nonceHeader)
+	if nonce == "" {
+		return nil, errors.New("missing request nonce")
+	}
+
+	msg := signatureV2Message(req.Method, req.URL.Path, timestamp, nonce, payload)
+	if !checkHMAC(msg, HMAC, key.Secret) {
+		return nil, errors.New("invalid HMAC")
+	}
+
+	// The nonce is only recorded once the signature is verified, so that unauthenticated
+	// requests can't fill the cache
+	if !v.nonces.add(key.ID + ":" + nonce) {
+		return nil, errors.New("reused request nonce")
+	}
+
+	return key, nil
+}
+
+// nonceCache remembers the nonces of the accepted requests for a limited time
+type nonceCache struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	expiry    map[string]time.Time
+	lastPurge time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{ttl: ttl, expiry: map[string]time.Time{}, lastPurge: time.Now()}
+}
+
+// add records a nonce. It returns false if the nonce was already seen
+func (c *nonceCache) add(nonce string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPurge) > c.ttl {
+		for n, exp := range c.expiry {
+			if now.After(exp) {
+				delete(c.expiry, n)
+			}
+		}
+		c.lastPurge = now
+	}
+
+	if exp, ok := c.expiry[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	c.expiry[nonce] = now.Add(c.ttl)
+
+	return true
+}
@@ -0,0 +1,109 @@
+package cvmfs
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestVerifier(t *testing.T, acceptV1 bool) (*signatureVerifier, *signingKey) {
+	cfg := &Config{SharedKey: "secret"}
+	keys, err := newKeyStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newSignatureVerifier(
+		keys, &ServerConfig{AcceptV1Signatures: acceptV1, MaxClockSkew: 300})
+	return v, keys.keyFor()
+}
+
+func TestSignatureV2(t *testing.T) {
+	v, key := newTestVerifier(t, false)
+	body := []byte(`{"id":"1"}`)
+
+	req := httptest.NewRequest("POST", "/jobs/complete", nil)
+	if err := signRequest(req, body, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(req, body); err != nil {
+		t.Errorf("valid request rejected: %v", err)
+	}
+
+	// The same request can't be replayed
+	if _, err := v.verify(req, body); err == nil {
+		t.Errorf("replayed request accepted")
+	}
+
+	// The signature is bound to the payload, the method and the path
+	if err := signRequest(req, body, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.verify(req, []byte(`{"id":"2"}`)); err == nil {
+		t.Errorf("request with a modified body accepted")
+	}
+	req.URL.Path = "/jobs/cancel"
+	if _, err := v.verify(req, body); err == nil {
+		t.Errorf("request sent to another endpoint accepted")
+	}
+	req.URL.Path = "/jobs/complete"
+	req.Method = "GET"
+	if _, err := v.verify(req, body); err == nil {
+		t.Errorf("request with another method accepted")
+	}
+}
+
+func TestSignatureV2Timestamp(t *testing.T) {
+	v, key := newTestVerifier(t, false)
+
+	for _, offset := range []time.Duration{-10 * time.Minute, 10 * time.Minute} {
+		req := httptest.NewRequest("GET", "/jobs?id=1", nil)
+		timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		msg := signatureV2Message("GET", "/jobs", timestamp, "nonce", []byte("id=1"))
+		hmac := base64.StdEncoding.EncodeToString(computeHMAC(msg, key.Secret))
+		req.Header.Set("Authorization", signatureV2Prefix+hmac)
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(nonceHeader, "nonce")
+		if _, err := v.verify(req, []byte("id=1")); err == nil {
+			t.Errorf("request with a timestamp off by %v accepted", offset)
+		}
+	}
+}
+
+func TestSignatureV1Transition(t *testing.T) {
+	payload := []byte("id=1")
+	hmac := base64.StdEncoding.EncodeToString(computeHMAC(payload, "secret"))
+
+	for _, acceptV1 := range []bool{true, false} {
+		v, _ := newTestVerifier(t, acceptV1)
+		req := httptest.NewRequest("GET", "/jobs?id=1", nil)
+		req.Header.Set("Authorization", hmac)
+		_, err := v.verify(req, payload)
+		if acceptV1 && err != nil {
+			t.Errorf("v1 signature rejected during the transition: %v", err)
+		}
+		if !acceptV1 && err == nil {
+			t.Errorf("v1 signature accepted after the transition")
+		}
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := newNonceCache(10 * time.Millisecond)
+	if !c.add("a") {
+		t.Errorf("new nonce rejected")
+	}
+	if c.add("a") {
+		t.Errorf("reused nonce accepted")
+	}
+
+	// Nonces are forgotten after the TTL
+	time.Sleep(20 * time.Millisecond)
+	if !c.add("a") {
+		t.Errorf("expired nonce rejected")
+	}
+	if len(c.expiry) != 1 {
+		t.Errorf("expired nonces not purged: %v", len(c.expiry))
+	}
+}
@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package cvmfs
+
+import (
+	_ "github.com/mattn/go-sqlite3" // Import and register the SQLite driver
+)
@@ -0,0 +1,480 @@
+//go:build sqlite
+// +build sqlite
+
+package cvmfs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestSQLiteConfig(t *testing.T) (*BackendConfig, func()) {
+	dir, err := ioutil.TempDir("", "conveyor-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &BackendConfig{Type: "sqlite", Path: filepath.Join(dir, "jobs.db")}
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+func TestSQLiteSchema(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitDatabase(cfg); err == nil {
+		t.Errorf("initializing the database twice should fail")
+	}
+
+	status, err := GetSchemaStatus(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.CurrentVersion != SchemaVersion || len(status.Versions) != SchemaVersion {
+		t.Errorf("unexpected schema status: %+v", status)
+	}
+	for _, v := range status.Versions {
+		if !v.Applied || v.ValidFrom.IsZero() {
+			t.Errorf("migration %v not recorded: %+v", v.Version, v)
+		}
+	}
+}
+
+func TestSQLiteMigration(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Create a version 1 database with two processed jobs, the second depending on the
+	// first one and on an unknown job
+	if err := createSchemaVersionTable(db, adapter); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyMigration(db, adapter, &sqliteMigrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	first, second := uuid.New(), uuid.New()
+	if _, err := db.Exec(
+		"INSERT INTO Jobs VALUES (?, 'job', 'repo', '', '/', '', 'worker', ?, ?, 1, '');",
+		first, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(
+		"INSERT INTO Jobs VALUES (?, 'job', 'repo', '', '/', ?, 'worker', ?, ?, 1, '');",
+		second, first.String()+","+uuid.New().String(), now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateDatabase(db, adapter); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}}
+	reply, err := b.listJobs(&JobFilter{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Jobs) != 2 {
+		t.Fatalf("unexpected jobs after migration: %+v", reply.Jobs)
+	}
+	for _, j := range reply.Jobs {
+		if j.State != "succeeded" || !j.SubmitTime.Equal(j.StartTime) {
+			t.Errorf("job not migrated: %+v", j)
+		}
+	}
+
+	deps, err := b.store.JobDependencies(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 1 || deps[0] != first {
+		t.Errorf("dependencies not migrated: %v", deps)
+	}
+}
+
+func TestSQLiteJobs(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}}
+
+	insert := func(j *ProcessedJob) {
+		if _, err := db.Exec(adapter.insertOrUpdateJobStatement(),
+			j.ID, j.JobName, j.Repository, j.Payload, j.LeasePath, "", j.WorkerName,
+			timeOrNull(j.StartTime), timeOrNull(j.FinishTime), j.Successful,
+			j.ErrorMessage, j.State, timeOrNull(j.SubmitTime), j.Priority,
+			timeOrNull(j.NotBefore)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().UTC()
+	job := ProcessedJob{
+		UnprocessedJob: UnprocessedJob{
+			ID: uuid.New(),
+			JobSpecification: JobSpecification{
+				JobName: "job", Repository: "sft.cern.ch", LeasePath: "/lcg_95/x"}},
+		SubmitTime: now,
+		State:      "queued",
+	}
+	insert(&job)
+
+	// The upsert updates the existing row
+	job.State = "succeeded"
+	job.Successful = true
+	job.WorkerName = "worker"
+	job.StartTime = now
+	job.FinishTime = now
+	insert(&job)
+
+	status, err := b.getJobStatus([]string{job.ID.String()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Jobs) != 1 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	if j := status.Jobs[0]; j.State != "succeeded" || !j.Successful || j.WorkerName != "worker" {
+		t.Errorf("job not updated: %+v", j)
+	}
+
+	// The "_" of the lease path prefix is not a wildcard
+	for prefix, n := range map[string]int{"/lcg_95": 1, "/lcgx95": 0} {
+		reply, err := b.listJobs(&JobFilter{LeasePathPrefix: prefix, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Jobs) != n {
+			t.Errorf("prefix %v: expected %v jobs, got %v", prefix, n, len(reply.Jobs))
+		}
+	}
+}
+
+func TestSQLiteJobAttempts(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}}
+
+	now := time.Now().UTC()
+	id := uuid.New()
+	if _, err := db.Exec(adapter.insertJobStatement(),
+		id, "job", "sft.cern.ch", "", "/", "", "", nil, nil, false, "", "running", now, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(attempts []JobAttempt) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		if err := insertJobAttempts(tx, adapter, id.String(), attempts); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The job is delivered again after the first worker recorded a failed attempt
+	record([]JobAttempt{{
+		Attempt: 1, WorkerName: "worker1", StartTime: now, FinishTime: now,
+		Phase: PhaseScript, ErrorMessage: "running transaction script failed", ExitCode: 2}})
+	record([]JobAttempt{
+		{Attempt: 1, WorkerName: "worker2", StartTime: now, FinishTime: now,
+			Phase: PhasePublish, ErrorMessage: "could not commit CVMFS transaction", ExitCode: 1},
+		{Attempt: 2, WorkerName: "worker2", StartTime: now, FinishTime: now, Successful: true},
+	})
+
+	status, err := b.getJobStatus([]string{id.String()}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Jobs) != 1 || len(status.Jobs[0].Attempts) != 3 {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	for i, a := range status.Jobs[0].Attempts {
+		if a.Attempt != i+1 {
+			t.Errorf("attempt %v numbered %v", i+1, a.Attempt)
+		}
+	}
+	if a := status.Jobs[0].Attempts[0]; a.WorkerName != "worker1" || a.Phase != PhaseScript ||
+		a.ExitCode != 2 || a.Successful {
+		t.Errorf("unexpected first attempt: %+v", a)
+	}
+	if a := status.Jobs[0].Attempts[2]; a.WorkerName != "worker2" || !a.Successful || a.Phase != "" {
+		t.Errorf("unexpected last attempt: %+v", a)
+	}
+
+	// The attempts of a job are deleted together with the job
+	if _, err := db.Exec(adapter.deleteJobStatement(), id); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM JobAttempts;").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("%v job attempts left after deleting the job", n)
+	}
+}
+
+func TestSQLiteDependencies(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}}
+
+	// a <- b <- c, a <- c, with c finished
+	a, bb, c := uuid.New(), uuid.New(), uuid.New()
+	jobs := []struct {
+		id    uuid.UUID
+		deps  []string
+		state string
+	}{
+		{a, nil, JobStateRunning},
+		{bb, []string{a.String()}, JobStateWaiting},
+		{c, []string{a.String(), bb.String()}, JobStateCancelled},
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		if _, err := tx.Exec(adapter.insertJobStatement(),
+			j.id, "job", "repo", "", "/", strings.Join(j.deps, ","), "", nil, nil, false, "",
+			j.state, time.Now(), 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := insertJobDependencies(tx, adapter, j.id.String(), j.deps); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := b.getPendingDependents(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0] != bb {
+		t.Errorf("unexpected pending dependents: %v", pending)
+	}
+
+	reply, err := b.getJobDependencies(bb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Jobs) != 3 {
+		t.Errorf("unexpected jobs in dependency graph: %+v", reply.Jobs)
+	}
+	if d := reply.Dependencies[bb]; len(d) != 1 || d[0] != a {
+		t.Errorf("unexpected dependencies: %v", d)
+	}
+	if d := reply.Dependencies[c]; len(d) != 1 || d[0] != bb {
+		t.Errorf("unexpected dependents: %v", d)
+	}
+
+	if _, err := b.getJobDependencies(uuid.New()); err != errJobNotFound {
+		t.Errorf("unknown job not reported: %v", err)
+	}
+}
+
+func TestSQLiteSchedules(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &sqlStore{db: db, adapter: adapter}
+
+	now := time.Now().UTC()
+	sc := JobSchedule{
+		Name: "nightly", Cron: "0 3 * * *", MissedRuns: MissedRunsSkip, Source: scheduleSourceAPI,
+		CreateTime: now, Job: JobSpecification{Repository: "sft.cern.ch", LeasePath: "/lcg_95"}}
+	if err := store.PutSchedule(&sc); err != nil {
+		t.Fatal(err)
+	}
+	job := uuid.New()
+	if err := store.UpdateScheduleRun("nightly", now, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upsert keeps the source and the last run of the existing schedule
+	sc.Cron = "@hourly"
+	sc.Source = scheduleSourceConfig
+	if err := store.PutSchedule(&sc); err != nil {
+		t.Fatal(err)
+	}
+	schedules, err := store.GetSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 1 {
+		t.Fatalf("unexpected schedules: %+v", schedules)
+	}
+	if s := schedules[0]; s.Cron != "@hourly" || s.Job.LeasePath != "/lcg_95" ||
+		s.Source != scheduleSourceAPI || s.LastRun.IsZero() || s.LastJobID != job {
+		t.Errorf("unexpected schedule: %+v", s)
+	}
+
+	if ok, err := store.DeleteSchedule("nightly"); err != nil || !ok {
+		t.Errorf("schedule not deleted: %v", err)
+	}
+	if ok, _ := store.DeleteSchedule("nightly"); ok {
+		t.Errorf("unknown schedule deleted")
+	}
+}
+
+func TestSQLitePrune(t *testing.T) {
+	cfg, cleanup := newTestSQLiteConfig(t)
+	defer cleanup()
+
+	if err := InitDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dir := filepath.Dir(cfg.Path)
+	logs, err := newLogStore(filepath.Join(dir, "logs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &serverBackend{store: &sqlStore{db: db, adapter: adapter}, logs: logs}
+
+	now := time.Now()
+	days := func(n int) time.Time { return now.AddDate(0, 0, -n) }
+	jobs := []struct {
+		repo     string
+		state    string
+		finished time.Time
+		pruned   bool
+	}{
+		{"a", JobStateSucceeded, days(20), true},
+		{"a", JobStateFailed, days(20), false},
+		{"a", JobStateFailed, days(40), true},
+		{"a", JobStateSucceeded, days(1), false},
+		{"a", JobStateRunning, time.Time{}, false},
+		// The most recent job of the repository is kept
+		{"b", JobStateSucceeded, days(50), true},
+		{"b", JobStateSucceeded, days(30), false},
+	}
+	ids := make([]uuid.UUID, len(jobs))
+	for i, j := range jobs {
+		ids[i] = uuid.New()
+		submitTime := j.finished
+		if submitTime.IsZero() {
+			submitTime = days(60)
+		}
+		if _, err := db.Exec(adapter.insertJobStatement(),
+			ids[i], "job", j.repo, "", "/", "", "", nil, timeOrNull(j.finished),
+			j.state == JobStateSucceeded, "", j.state, submitTime, 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := logs.write(&JobLogChunk{ID: ids[i], Data: []byte("output")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := RetentionConfig{
+		KeepDays: 10, KeepFailedDays: 30, KeepLast: 1, ArchiveDir: filepath.Join(dir, "archive")}
+
+	result, err := b.pruneJobs(&r, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total() != 3 || result.Pruned["a"] != 2 || result.Pruned["b"] != 1 {
+		t.Errorf("unexpected dry run result: %+v", result)
+	}
+	if result.Archive != "" {
+		t.Errorf("dry run should not archive jobs")
+	}
+
+	result, err = b.pruneJobs(&r, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total() != 3 {
+		t.Errorf("unexpected pruning result: %+v", result)
+	}
+
+	for i, j := range jobs {
+		_, err := b.getJobState(ids[i])
+		if j.pruned != (err == errJobNotFound) {
+			t.Errorf("job %v: expected pruned = %v, got error %v", i, j.pruned, err)
+		}
+		_, _, err = logs.read(ids[i], 0)
+		if j.pruned != (err == errLogNotFound) {
+			t.Errorf("job %v: expected log removed = %v, got error %v", i, j.pruned, err)
+		}
+	}
+
+	f, err := os.Open(result.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for sc := bufio.NewScanner(gz); sc.Scan(); {
+		lines++
+	}
+	if lines != 3 {
+		t.Errorf("expected 3 archived jobs, got %v", lines)
+	}
+}
@@ -0,0 +1,412 @@
+package cvmfs
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// sqlStore is a job store backed by a SQL database. The queries are provided by the
+// adapter of the database type
+type sqlStore struct {
+	db      *sql.DB
+	adapter databaseAdapter
+}
+
+func (s *sqlStore) InsertJobs(jobs []ProcessedJob) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "opening SQL transaction failed")
+	}
+	defer tx.Rollback()
+
+	queryStr := s.adapter.insertJobStatement()
+	for _, j := range jobs {
+		if _, err := tx.Exec(queryStr,
+			j.ID, j.JobName, j.Repository, j.Payload, j.LeasePath,
+			strings.Join(j.Dependencies, ","), j.WorkerName, timeOrNull(j.StartTime),
+			timeOrNull(j.FinishTime), j.Successful, j.ErrorMessage, j.State,
+			timeOrNull(j.SubmitTime), j.Priority, timeOrNull(j.NotBefore)); err != nil {
+			return errors.Wrap(err, "executing SQL statement failed")
+		}
+		if err := insertJobDependencies(tx, s.adapter, j.ID.String(), j.Dependencies); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing SQL transaction failed")
+	}
+	return nil
+}
+
+func (s *sqlStore) PutJob(j *ProcessedJob) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "opening SQL transaction failed")
+	}
+	defer tx.Rollback()
+
+	queryStr := s.adapter.insertOrUpdateJobStatement()
+	if _, err := tx.Exec(queryStr,
+		j.ID, j.JobName, j.Repository, j.Payload, j.LeasePath,
+		strings.Join(j.Dependencies, ","), j.WorkerName, timeOrNull(j.StartTime),
+		timeOrNull(j.FinishTime), j.Successful, j.ErrorMessage, j.State,
+		timeOrNull(j.SubmitTime), j.Priority, timeOrNull(j.NotBefore)); err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	if err := insertJobDependencies(tx, s.adapter, j.ID.String(), j.Dependencies); err != nil {
+		return err
+	}
+	if err := insertJobAttempts(tx, s.adapter, j.ID.String(), j.Attempts); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing SQL transaction failed")
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdateJobState(
+	id uuid.UUID, state, worker string, startTime time.Time) (bool, error) {
+	res, err := s.db.Exec(
+		s.adapter.updateJobStateStatement(), state, worker, timeOrNull(startTime), id)
+	if err != nil {
+		return false, errors.Wrap(err, "executing SQL statement failed")
+	}
+	return rowsAffected(res), nil
+}
+
+func (s *sqlStore) FinishJob(
+	id uuid.UUID, state, reason string, finishTime time.Time) (bool, error) {
+	res, err := s.db.Exec(s.adapter.finishJobStatement(), state, false, finishTime, reason, id)
+	if err != nil {
+		return false, errors.Wrap(err, "executing SQL statement failed")
+	}
+	return rowsAffected(res), nil
+}
+
+func (s *sqlStore) UpdateJobPriority(id uuid.UUID, priority int) (bool, error) {
+	res, err := s.db.Exec(s.adapter.updateJobPriorityStatement(), priority, id)
+	if err != nil {
+		return false, errors.Wrap(err, "executing SQL statement failed")
+	}
+	return rowsAffected(res), nil
+}
+
+// rowsAffected returns false if a statement is known to have changed no rows
+func rowsAffected(res sql.Result) bool {
+	n, err := res.RowsAffected()
+	return err != nil || n > 0
+}
+
+func (s *sqlStore) GetJobs(ids []string, attempts bool) ([]ProcessedJob, error) {
+	if len(ids) == 0 {
+		return []ProcessedJob{}, nil
+	}
+
+	params := make([]interface{}, len(ids))
+	for i, v := range ids {
+		params[i] = v
+	}
+
+	jobs, err := s.queryJobs(s.adapter.jobStatusQuery(len(ids)), params...)
+	if err != nil {
+		return []ProcessedJob{}, err
+	}
+
+	if attempts && len(jobs) > 0 {
+		byJob, err := s.getJobAttempts(params)
+		if err != nil {
+			return []ProcessedJob{}, err
+		}
+		for i := range jobs {
+			jobs[i].Attempts = byJob[jobs[i].ID]
+		}
+	}
+
+	return jobs, nil
+}
+
+// getJobAttempts returns the recorded attempts of the jobs with the given IDs, by job
+func (s *sqlStore) getJobAttempts(ids []interface{}) (map[uuid.UUID][]JobAttempt, error) {
+	rows, err := s.db.Query(s.adapter.jobAttemptsQuery(len(ids)), ids...)
+	if err != nil {
+		return nil, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	attempts := map[uuid.UUID][]JobAttempt{}
+	for rows.Next() {
+		var id uuid.UUID
+		var a JobAttempt
+		if err := rows.Scan(
+			&id, &a.Attempt, &a.WorkerName, &a.StartTime, &a.FinishTime, &a.Successful,
+			&a.Phase, &a.ErrorMessage, &a.ExitCode); err != nil {
+			return nil, errors.Wrap(err, "SQL query scan failed")
+		}
+		attempts[id] = append(attempts[id], a)
+	}
+
+	return attempts, rows.Err()
+}
+
+func (s *sqlStore) ListJobs(f *JobFilter) ([]ProcessedJob, bool, error) {
+	queryStr, params := s.adapter.listJobsQuery(f)
+	jobs, err := s.queryJobs(queryStr, params...)
+	if err != nil {
+		return []ProcessedJob{}, false, err
+	}
+
+	// The query returns one extra row when there are more results
+	if len(jobs) > f.Limit {
+		return jobs[:f.Limit], true, nil
+	}
+	return jobs, false, nil
+}
+
+func (s *sqlStore) JobDependencies(id uuid.UUID) ([]uuid.UUID, error) {
+	return s.queryJobIDs(s.adapter.jobDependenciesQuery(), id.String())
+}
+
+func (s *sqlStore) JobDependents(id uuid.UUID) ([]uuid.UUID, error) {
+	return s.queryJobIDs(s.adapter.jobDependentsQuery(), id.String())
+}
+
+func (s *sqlStore) PendingDependents(id uuid.UUID) ([]uuid.UUID, error) {
+	return s.queryJobIDs(s.adapter.pendingDependentsQuery(), id.String())
+}
+
+func (s *sqlStore) Repositories() ([]string, error) {
+	rows, err := s.db.Query(s.adapter.repositoriesQuery())
+	if err != nil {
+		return []string{}, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	repos := []string{}
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return []string{}, errors.Wrap(err, "SQL query scan failed")
+		}
+		repos = append(repos, repo)
+	}
+
+	return repos, rows.Err()
+}
+
+func (s *sqlStore) RecentJobs(repo string, n int) ([]uuid.UUID, error) {
+	return s.queryJobIDs(s.adapter.recentJobsQuery(), repo, n)
+}
+
+func (s *sqlStore) ExpiredJobs(
+	repo string, cutoff, failedCutoff time.Time, limit, offset int) ([]ProcessedJob, error) {
+	return s.queryJobs(
+		s.adapter.expiredJobsQuery(), repo, cutoff, failedCutoff, limit, offset)
+}
+
+func (s *sqlStore) DeleteJobs(ids []uuid.UUID) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "opening SQL transaction failed")
+	}
+	defer tx.Rollback()
+
+	// The dependencies and attempts of the jobs are deleted by the DB
+	queryStr := s.adapter.deleteJobStatement()
+	for _, id := range ids {
+		if _, err := tx.Exec(queryStr, id); err != nil {
+			return errors.Wrap(err, "executing SQL statement failed")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing SQL transaction failed")
+	}
+	return nil
+}
+
+func (s *sqlStore) JobStats(f *StatsFilter) ([]JobStats, error) {
+	queryStr, params := s.adapter.jobStatsQuery(f)
+	rows, err := s.db.Query(queryStr, params...)
+	if err != nil {
+		return []JobStats{}, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	jobs := []statsRow{}
+	for rows.Next() {
+		var r statsRow
+		if err := rows.Scan(
+			&r.group, &r.state, &r.worker, &r.leasePath, &r.duration, &r.wait); err != nil {
+			return []JobStats{}, errors.Wrap(err, "SQL query scan failed")
+		}
+		jobs = append(jobs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return []JobStats{}, err
+	}
+
+	return aggregateStats(jobs), nil
+}
+
+func (s *sqlStore) PutSchedule(sc *JobSchedule) error {
+	job, err := json.Marshal(&sc.Job)
+	if err != nil {
+		return errors.Wrap(err, "JSON serialization of the scheduled job failed")
+	}
+	if _, err := s.db.Exec(s.adapter.putScheduleStatement(),
+		sc.Name, sc.Cron, string(job), sc.MissedRuns, sc.Source, sc.CreateTime,
+		timeOrNull(sc.LastRun), sc.LastJobID); err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	return nil
+}
+
+func (s *sqlStore) GetSchedules() ([]JobSchedule, error) {
+	rows, err := s.db.Query(s.adapter.schedulesQuery())
+	if err != nil {
+		return []JobSchedule{}, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	schedules := []JobSchedule{}
+	for rows.Next() {
+		var sc JobSchedule
+		var job string
+		if err := rows.Scan(
+			&sc.Name, &sc.Cron, &job, &sc.MissedRuns, &sc.Source, nullTime{&sc.CreateTime},
+			nullTime{&sc.LastRun}, &sc.LastJobID); err != nil {
+			return []JobSchedule{}, errors.Wrap(err, "SQL query scan failed")
+		}
+		if err := json.Unmarshal([]byte(job), &sc.Job); err != nil {
+			return []JobSchedule{}, errors.Wrap(err, "JSON deserialization of the scheduled job failed")
+		}
+		schedules = append(schedules, sc)
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *sqlStore) DeleteSchedule(name string) (bool, error) {
+	res, err := s.db.Exec(s.adapter.deleteScheduleStatement(), name)
+	if err != nil {
+		return false, errors.Wrap(err, "executing SQL statement failed")
+	}
+	return rowsAffected(res), nil
+}
+
+func (s *sqlStore) UpdateScheduleRun(name string, lastRun time.Time, jobID uuid.UUID) error {
+	if _, err := s.db.Exec(
+		s.adapter.updateScheduleRunStatement(), timeOrNull(lastRun), jobID, name); err != nil {
+		return errors.Wrap(err, "executing SQL statement failed")
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// queryJobs runs a query returning rows of the Jobs table
+func (s *sqlStore) queryJobs(queryStr string, params ...interface{}) ([]ProcessedJob, error) {
+	rows, err := s.db.Query(queryStr, params...)
+	if err != nil {
+		return []ProcessedJob{}, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	jobs := []ProcessedJob{}
+	for rows.Next() {
+		st, err := scanRow(rows)
+		if err != nil {
+			return []ProcessedJob{}, errors.Wrap(err, "SQL query scan failed")
+		}
+		jobs = append(jobs, *st)
+	}
+
+	return jobs, rows.Err()
+}
+
+// queryJobIDs runs a query returning job IDs
+func (s *sqlStore) queryJobIDs(queryStr string, params ...interface{}) ([]uuid.UUID, error) {
+	rows, err := s.db.Query(queryStr, params...)
+	if err != nil {
+		return []uuid.UUID{}, errors.Wrap(err, "SQL query failed")
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return []uuid.UUID{}, errors.Wrap(err, "SQL query scan failed")
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// insertJobDependencies records the dependencies of a job in the JobDependencies table.
+// Dependencies which are not valid job IDs are skipped
+func insertJobDependencies(tx *sql.Tx, adapter databaseAdapter, id string, deps []string) error {
+	queryStr := adapter.insertJobDependencyStatement()
+	for _, dep := range deps {
+		depID, err := uuid.Parse(dep)
+		if err != nil {
+			continue
+		}
+		if _, err := tx.Exec(queryStr, id, depID.String()); err != nil {
+			return errors.Wrap(err, "could not record job dependency")
+		}
+	}
+	return nil
+}
+
+// insertJobAttempts records the attempts of a job in the JobAttempts table. A job which is
+// delivered again, to the same or to another worker, is attempted again: the attempts are
+// numbered after the ones already recorded for the job
+func insertJobAttempts(tx *sql.Tx, adapter databaseAdapter, id string, attempts []JobAttempt) error {
+	if len(attempts) == 0 {
+		return nil
+	}
+
+	var last int
+	if err := tx.QueryRow(adapter.lastJobAttemptQuery(), id).Scan(&last); err != nil {
+		return errors.Wrap(err, "could not query job attempts")
+	}
+
+	queryStr := adapter.insertJobAttemptStatement()
+	for i, a := range attempts {
+		if _, err := tx.Exec(queryStr,
+			id, last+i+1, a.WorkerName, a.StartTime, a.FinishTime, a.Successful,
+			a.Phase, a.ErrorMessage, a.ExitCode); err != nil {
+			return errors.Wrap(err, "could not record job attempt")
+		}
+	}
+	return nil
+}
+
+func scanRow(rows *sql.Rows) (*ProcessedJob, error) {
+	var st ProcessedJob
+	var deps string
+	if err := rows.Scan(
+		&st.ID, &st.JobName, &st.Repository, &st.Payload, &st.LeasePath,
+		&deps, &st.WorkerName, nullTime{&st.StartTime}, nullTime{&st.FinishTime},
+		&st.Successful, &st.ErrorMessage, &st.State, nullTime{&st.SubmitTime},
+		&st.Priority, nullTime{&st.NotBefore}); err != nil {
+		return nil, err
+	}
+	if deps != "" {
+		st.Dependencies = strings.Split(deps, ",")
+	}
+
+	return &st, nil
+}
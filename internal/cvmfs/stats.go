@@ -0,0 +1,132 @@
+package cvmfs
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Number of lease paths listed in the statistics of a group of jobs
+const statsTopLeasePaths = 5
+
+// statsRow is a finished job, as aggregated in the job statistics
+type statsRow struct {
+	group     string
+	state     string
+	worker    string
+	leasePath string
+	duration  sql.NullFloat64
+	wait      sql.NullFloat64
+}
+
+// getStats returns the statistics of the jobs matching the filter
+func (b *serverBackend) getStats(f *StatsFilter) (*GetStatsReply, error) {
+	reply := GetStatsReply{
+		BasicReply: BasicReply{Status: "ok", Reason: ""},
+		From:       f.From,
+		To:         f.To,
+		GroupBy:    f.GroupBy,
+	}
+
+	defer observeDBQuery("job_stats", time.Now())
+	stats, err := b.store.JobStats(f)
+	if err != nil {
+		reason := "SQL query failed"
+		reply.Status = "error"
+		reply.Reason = reason
+		return &reply, errors.Wrap(err, reason)
+	}
+	reply.Stats = stats
+
+	return &reply, nil
+}
+
+// aggregateStats computes the statistics of each group of jobs. The groups are sorted
+// by name
+func aggregateStats(jobs []statsRow) []JobStats {
+	type group struct {
+		stats     JobStats
+		durations []float64
+		waits     []float64
+		paths     map[string]int
+	}
+
+	groups := map[string]*group{}
+	for _, j := range jobs {
+		g, ok := groups[j.group]
+		if !ok {
+			g = &group{stats: JobStats{Group: j.group}, paths: map[string]int{}}
+			groups[j.group] = g
+		}
+
+		g.stats.Jobs++
+		switch j.state {
+		case JobStateSucceeded:
+			g.stats.Succeeded++
+		case JobStateFailed:
+			g.stats.Failed++
+			if g.stats.FailuresByWorker == nil {
+				g.stats.FailuresByWorker = map[string]int{}
+			}
+			g.stats.FailuresByWorker[j.worker]++
+		case JobStateCancelled:
+			g.stats.Cancelled++
+		}
+		// Jobs finished without running have no duration nor wait time
+		if j.duration.Valid {
+			g.durations = append(g.durations, j.duration.Float64)
+		}
+		if j.wait.Valid {
+			g.waits = append(g.waits, j.wait.Float64)
+		}
+		g.paths[j.leasePath]++
+	}
+
+	stats := make([]JobStats, 0, len(groups))
+	for _, g := range groups {
+		g.stats.MedianDuration = quantile(g.durations, 0.5)
+		g.stats.P95Duration = quantile(g.durations, 0.95)
+		g.stats.MedianWait = quantile(g.waits, 0.5)
+		g.stats.P95Wait = quantile(g.waits, 0.95)
+		g.stats.BusiestLeasePaths = busiestLeasePaths(g.paths, statsTopLeasePaths)
+		stats = append(stats, g.stats)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Group < stats[j].Group })
+
+	return stats
+}
+
+// quantile returns the q-quantile of the values, using the nearest-rank method, or zero
+// if there are no values. The values are sorted in place
+func quantile(values []float64, q float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	rank := int(math.Ceil(q * float64(len(values))))
+	if rank < 1 {
+		rank = 1
+	}
+	return values[rank-1]
+}
+
+// busiestLeasePaths returns the n lease paths with the most jobs, in decreasing order
+func busiestLeasePaths(paths map[string]int, n int) []LeasePathCount {
+	counts := make([]LeasePathCount, 0, len(paths))
+	for p, c := range paths {
+		counts = append(counts, LeasePathCount{LeasePath: p, Jobs: c})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Jobs != counts[j].Jobs {
+			return counts[i].Jobs > counts[j].Jobs
+		}
+		return counts[i].LeasePath < counts[j].LeasePath
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
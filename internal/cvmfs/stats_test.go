@@ -0,0 +1,91 @@
+package cvmfs
+
+import (
+	"database/sql"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQuantile(t *testing.T) {
+	if q := quantile(nil, 0.5); q != 0 {
+		t.Errorf("quantile of no values: %v", q)
+	}
+
+	values := []float64{10, 1, 9, 2, 8, 3, 7, 4, 6, 5}
+	if q := quantile(values, 0.5); q != 5 {
+		t.Errorf("invalid median: %v", q)
+	}
+	if q := quantile(values, 0.95); q != 10 {
+		t.Errorf("invalid 95th percentile: %v", q)
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	dur := func(s float64) sql.NullFloat64 { return sql.NullFloat64{Float64: s, Valid: true} }
+	jobs := []statsRow{
+		{"b", JobStateSucceeded, "w1", "/x", dur(10), dur(1)},
+		{"a", JobStateSucceeded, "w1", "/x", dur(20), dur(2)},
+		{"a", JobStateFailed, "w2", "/y", dur(30), dur(3)},
+		{"a", JobStateFailed, "w2", "/x", dur(40), dur(4)},
+		// Cancelled before running
+		{"a", JobStateCancelled, "", "/z", sql.NullFloat64{}, sql.NullFloat64{}},
+	}
+
+	stats := aggregateStats(jobs)
+	if len(stats) != 2 || stats[0].Group != "a" || stats[1].Group != "b" {
+		t.Fatalf("unexpected groups: %+v", stats)
+	}
+
+	a := stats[0]
+	if a.Jobs != 4 || a.Succeeded != 1 || a.Failed != 2 || a.Cancelled != 1 {
+		t.Errorf("invalid job counts: %+v", a)
+	}
+	if a.MedianDuration != 30 || a.P95Duration != 40 || a.MedianWait != 3 {
+		t.Errorf("invalid durations: %+v", a)
+	}
+	if len(a.FailuresByWorker) != 1 || a.FailuresByWorker["w2"] != 2 {
+		t.Errorf("invalid failures by worker: %v", a.FailuresByWorker)
+	}
+	if len(a.BusiestLeasePaths) != 3 || a.BusiestLeasePaths[0].LeasePath != "/x" ||
+		a.BusiestLeasePaths[0].Jobs != 2 {
+		t.Errorf("invalid busiest lease paths: %v", a.BusiestLeasePaths)
+	}
+}
+
+func TestParseStatsFilter(t *testing.T) {
+	now := time.Date(2019, 3, 8, 0, 0, 0, 0, time.UTC)
+
+	f, err := parseStatsFilter(url.Values{}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.To.Equal(now) || !f.From.Equal(now.Add(-defaultStatsWindow)) ||
+		f.GroupBy != StatsGroupByRepository {
+		t.Errorf("invalid default filter: %+v", f)
+	}
+
+	in := StatsFilter{
+		From:       time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2019, 3, 2, 0, 0, 0, 0, time.UTC),
+		Repository: "sft.cern.ch",
+		GroupBy:    StatsGroupByWorker,
+	}
+	f, err = parseStatsFilter(in.Values(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.From.Equal(in.From) || !f.To.Equal(in.To) || f.Repository != in.Repository ||
+		f.GroupBy != in.GroupBy {
+		t.Errorf("filter not preserved: %+v", f)
+	}
+
+	for _, q := range []url.Values{
+		{"group_by": {"lease_path"}},
+		{"from": {"2019-03-02T00:00:00Z"}, "to": {"2019-03-01T00:00:00Z"}},
+	} {
+		if _, err := parseStatsFilter(q, now); err == nil {
+			t.Errorf("invalid query accepted: %v", q)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package cvmfs
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// memoryBackendType is the job DB type of the in-memory job store
+const memoryBackendType = "memory"
+
+// JobStore records the jobs known to the job server, together with their dependencies
+// and processing attempts, and the job schedules. Changes of the state of a job are only applied while the job
+// is unfinished: the methods changing the state of a job return false if the job is
+// unknown or already finished
+type JobStore interface {
+	// InsertJobs records new jobs and their dependencies. Either all the jobs are
+	// recorded, or none of them. Jobs may depend on jobs recorded before them in the
+	// same call
+	InsertJobs(jobs []ProcessedJob) error
+	// PutJob records a job reported by a worker, together with its dependencies and
+	// attempts. An existing job is replaced, except for its submission time
+	PutJob(j *ProcessedJob) error
+	// UpdateJobState changes the state and the worker of an unfinished job. The start
+	// time of the job is only changed if startTime is not zero
+	UpdateJobState(id uuid.UUID, state, worker string, startTime time.Time) (bool, error)
+	// FinishJob moves an unfinished job to a final state, as unsuccessful
+	FinishJob(id uuid.UUID, state, reason string, finishTime time.Time) (bool, error)
+	// UpdateJobPriority changes the priority of a job which is not yet running. Returns
+	// false if the job is unknown or no longer queued
+	UpdateJobPriority(id uuid.UUID, priority int) (bool, error)
+	// GetJobs returns the jobs with the given IDs; unknown IDs are skipped. With
+	// "attempts", the recorded attempts of the jobs are included
+	GetJobs(ids []string, attempts bool) ([]ProcessedJob, error)
+	// ListJobs returns a page of the jobs matching the filter, from the most recently
+	// submitted, and whether there are more jobs after the page
+	ListJobs(f *JobFilter) ([]ProcessedJob, bool, error)
+	// JobDependencies returns the IDs of the jobs which a job depends on directly
+	JobDependencies(id uuid.UUID) ([]uuid.UUID, error)
+	// JobDependents returns the IDs of the jobs which depend directly on a job
+	JobDependents(id uuid.UUID) ([]uuid.UUID, error)
+	// PendingDependents returns the IDs of the unfinished jobs which depend directly
+	// on a job
+	PendingDependents(id uuid.UUID) ([]uuid.UUID, error)
+	// Repositories returns the repositories of the recorded jobs
+	Repositories() ([]string, error)
+	// RecentJobs returns the IDs of the n most recently submitted jobs of a repository
+	RecentJobs(repo string, n int) ([]uuid.UUID, error)
+	// ExpiredJobs returns a page of the finished jobs of a repository which finished
+	// before the cutoff times: failedCutoff for the failed jobs, cutoff for the others.
+	// The jobs are ordered by finish time
+	ExpiredJobs(
+		repo string, cutoff, failedCutoff time.Time, limit, offset int) ([]ProcessedJob, error)
+	// DeleteJobs deletes jobs, together with their dependencies and attempts. Either
+	// all the jobs are deleted, or none of them
+	DeleteJobs(ids []uuid.UUID) error
+	// JobStats returns the statistics of the jobs matching the filter
+	JobStats(f *StatsFilter) ([]JobStats, error)
+	// PutSchedule records a job schedule, or replaces the definition of an existing one.
+	// The creation time, the source and the last run of an existing schedule are kept
+	PutSchedule(s *JobSchedule) error
+	// GetSchedules returns the job schedules, ordered by name
+	GetSchedules() ([]JobSchedule, error)
+	// DeleteSchedule deletes a job schedule. Returns false if the schedule is unknown
+	DeleteSchedule(name string) (bool, error)
+	// UpdateScheduleRun records the last run of a job schedule, and the last job
+	// submitted for it
+	UpdateScheduleRun(name string, lastRun time.Time, jobID uuid.UUID) error
+	// Close releases the resources of the store
+	Close() error
+}
+
+// newJobStore creates the job store described by the configuration. The schema of a
+// job DB is migrated first, if enabled in the configuration, and must be at the
+// latest version
+func newJobStore(cfg *BackendConfig) (JobStore, error) {
+	if cfg.Type == memoryBackendType {
+		return newMemoryStore(), nil
+	}
+
+	db, adapter, err := openDatabase(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AutoMigrate {
+		if err := migrateDatabase(db, adapter); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "could not migrate DB schema")
+		}
+	}
+
+	if err := checkSchemaVersion(db, adapter); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: db, adapter: adapter}, nil
+}
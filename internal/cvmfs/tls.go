@@ -0,0 +1,164 @@
+package cvmfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpClient is used for the requests to the job server and for the payload downloads.
+// It is configured with the CA bundle of the job server by configureHTTPClient
+var httpClient = http.DefaultClient
+
+// configureHTTPClient sets up the HTTP client to trust the CA bundle of the job server,
+// in addition to the system CAs
+func configureHTTPClient(cfg *ServerConfig) error {
+	if cfg.CAFile == "" {
+		return nil
+	}
+
+	pool, err := loadCAPool(cfg.CAFile)
+	if err != nil {
+		return err
+	}
+
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     &tls.Config{RootCAs: pool},
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	httpClient = &http.Client{Transport: transport}
+
+	return nil
+}
+
+// loadCAPool returns the system certificate pool with the certificates of a CA bundle
+// appended to it
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read CA bundle")
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in CA bundle %v", caFile)
+	}
+
+	return pool, nil
+}
+
+// certReloader holds a certificate and its private key, loaded from files. The files are
+// loaded again when they are modified, so that certificates can be renewed without
+// restarting the daemons
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader creates a certReloader, loading the certificate right away
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// certificate returns the current certificate, reloading it if the files have changed.
+// If the new files can't be loaded, the previous certificate is kept
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			Log.Error().Err(err).Msg("could not check certificate files, keeping current certificate")
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			Log.Error().Err(err).Msg("could not reload certificate, keeping current certificate")
+			return r.cert, nil
+		}
+		return nil, errors.Wrap(err, "could not load certificate")
+	}
+	if r.cert != nil {
+		Log.Info().Str("cert_file", r.certFile).Msg("certificate reloaded")
+	}
+	r.cert = &cert
+	r.modTime = modTime
+
+	return r.cert, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// GetClientCertificate can be used as tls.Config.GetClientCertificate
+func (r *certReloader) GetClientCertificate(
+	*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// latestModTime returns the most recent modification time of a set of files
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, "could not stat certificate file")
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// newQueueTLSConfig creates the TLS configuration of the connection to RabbitMQ
+func newQueueTLSConfig(cfg *QueueConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{ServerName: cfg.ServerName}
+
+	if cfg.CAFile != "" {
+		pool, err := loadCAPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		certs, err := newCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client certificate")
+		}
+		tlsCfg.GetClientCertificate = certs.GetClientCertificate
+	}
+
+	return tlsCfg, nil
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -30,7 +31,7 @@ func runTransaction(repository, subpath string, task func() error) error {
 
 	if err := startTransaction(fullPath, true); err != nil {
 		abort = true
-		return errors.Wrap(err, "could not start CVMFS transaction")
+		return newPhaseError(PhaseStart, errors.Wrap(err, "could not start CVMFS transaction"))
 	}
 
 	if !mock {
@@ -41,14 +42,46 @@ func runTransaction(repository, subpath string, task func() error) error {
 	}
 
 	Log.Debug().Msg("Publishing CVMFS transaction")
+	t0 := time.Now()
 	if err := commitTransaction(repository, true); err != nil {
 		abort = true
-		return errors.Wrap(err, "could not commit CVMFS transaction")
+		return newPhaseError(PhasePublish, errors.Wrap(err, "could not commit CVMFS transaction"))
 	}
+	observeSince(transactionPhaseDuration.WithLabelValues(PhasePublish), t0)
 
 	return nil
 }
 
+// phaseError is an error which occurred during a phase of a job transaction. The
+// message of the error is the message of the underlying error
+type phaseError struct {
+	phase string
+	err   error
+}
+
+func newPhaseError(phase string, err error) error {
+	return &phaseError{phase: phase, err: err}
+}
+
+func (e *phaseError) Error() string {
+	return e.err.Error()
+}
+
+// failedPhase returns the transaction phase in which an error occurred, and the exit
+// code of the failed command, if the error was returned by a command. Errors of the
+// task which are not associated to a phase are attributed to the script
+func failedPhase(err error) (string, int) {
+	phase := PhaseScript
+	if e, ok := errors.Cause(err).(*phaseError); ok {
+		phase = e.phase
+		err = e.err
+	}
+	if e, ok := errors.Cause(err).(*exec.ExitError); ok {
+		return phase, e.ExitCode()
+	}
+	return phase, 0
+}
+
 func startTransaction(path string, verbose bool) error {
 	if !mock {
 		cmd := exec.Command("cvmfs_server", "transaction", "-r", path)
@@ -0,0 +1,46 @@
+package cvmfs
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFailedPhase(t *testing.T) {
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+	if exitErr == nil {
+		t.Fatal("command should have failed")
+	}
+
+	cases := []struct {
+		err      error
+		phase    string
+		exitCode int
+	}{
+		{
+			errors.Wrap(newPhaseError(PhaseStart, errors.Wrap(exitErr, "could not start")), "failed"),
+			PhaseStart, 3,
+		},
+		{
+			newPhaseError(PhaseDownload, errors.New("could not download payload")),
+			PhaseDownload, 0,
+		},
+		{errors.Wrap(exitErr, "running transaction script failed"), PhaseScript, 3},
+		{errors.New("unknown error"), PhaseScript, 0},
+	}
+
+	for _, c := range cases {
+		phase, exitCode := failedPhase(c.err)
+		if phase != c.phase || exitCode != c.exitCode {
+			t.Errorf("%v: expected phase %v and exit code %v, got %v and %v",
+				c.err, c.phase, c.exitCode, phase, exitCode)
+		}
+	}
+
+	// The message of the underlying error is preserved
+	err := newPhaseError(PhasePublish, errors.New("could not commit CVMFS transaction"))
+	if err.Error() != "could not commit CVMFS transaction" {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
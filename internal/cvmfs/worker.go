@@ -1,17 +1,23 @@
 package cvmfs
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
 )
 
 var mock bool
 
+// Interval between uploads of the output of a running job
+const logFlushInterval = 5 * time.Second
+
 func init() {
 	mock = false
 	v := os.Getenv("CONVEYOR_MOCK_WORKER")
@@ -25,11 +31,19 @@ func init() {
 type Worker struct {
 	name          string
 	maxJobRetries int
+	maxDeliveries int
+	repositories  []string
 	tempDir       string
+	maxLogSize    int
+	metricsPort   int
 	client        *JobClient
 	sharedKey     string
 	endpoints     HTTPEndpoints
-	timeout       int
+
+	// The job currently being processed and the function which cancels it
+	mu         sync.Mutex
+	currentJob uuid.UUID
+	cancelJob  context.CancelFunc
 }
 
 // NewWorker creates a new Worker object using a config object
@@ -41,8 +55,11 @@ func NewWorker(cfg *Config) (*Worker, error) {
 	}
 
 	return &Worker{
-		cfg.Worker.Name, cfg.Worker.JobRetries, cfg.Worker.TempDir,
-		client, cfg.SharedKey, cfg.HTTPEndpoints(), cfg.JobWaitTimeout}, nil
+		name: cfg.Worker.Name, maxJobRetries: cfg.Worker.JobRetries,
+		maxDeliveries: cfg.Queue.MaxDeliveries, repositories: cfg.Worker.Repositories,
+		tempDir: cfg.Worker.TempDir, maxLogSize: cfg.Worker.MaxLogSize,
+		metricsPort: cfg.Worker.MetricsPort, client: client,
+		sharedKey: cfg.SharedKey, endpoints: cfg.HTTPEndpoints()}, nil
 }
 
 // Close all the internal connections of the Worker object
@@ -53,13 +70,31 @@ func (w *Worker) Close() {
 // Loop subscribes to the new job messages from the conveyor server and processes them
 // one by one
 func (w *Worker) Loop() error {
-	// Select the lowest alphabetical keyID to be used for signing the subscription request
-	// This is an arbitrary choice which has no impact on the content of the messages.
-	ch, err := w.client.SubscribeNewJobs(w.sharedKey)
+	if w.metricsPort > 0 {
+		go func() {
+			if err := startMetricsListener(w.metricsPort); err != nil {
+				Log.Error().Err(err).Msg("could not serve worker metrics")
+			}
+		}()
+	}
+
+	w.client.qcl.NotifyConnection(setGauge(workerQueueConnected))
+
+	ch, err := w.client.SubscribeNewJobs(w.repositories)
 	if err != nil {
 		return errors.Wrap(err, "could not start job subscription")
 	}
 
+	cancellations, err := w.client.SubscribeCancellations()
+	if err != nil {
+		return errors.Wrap(err, "could not start cancellation subscription")
+	}
+	go func() {
+		for id := range cancellations {
+			w.cancel(id)
+		}
+	}()
+
 	for msg := range ch {
 		if err := w.handle(&msg); err != nil {
 			Log.Error().Err(err).Msg("error in job handler")
@@ -75,61 +110,106 @@ func (w *Worker) handle(msg *amqp.Delivery) error {
 
 	var job UnprocessedJob
 	if err := json.Unmarshal(msg.Body, &job); err != nil {
+		// The message is dead-lettered, it can't be processed by any worker
+		if err := msg.Reject(false); err != nil {
+			Log.Warn().Err(err).Msg("could not reject job message")
+		}
 		return errors.Wrap(err, "could not unmarshal queue message")
 	}
 
-	if len(job.Dependencies) > 0 {
-		// Wait for job dependencies to finish
-		depStatus, err := w.client.WaitForJobs(job.Dependencies, w.timeout)
-		if err != nil {
-			t := time.Now()
-			if err := w.postJobStatus(
-				&job, w.name, t, t, false, err.Error()); err != nil {
-				msg.Nack(false, true)
-				return errors.Wrap(err, "posting job status to server failed")
-			}
-			msg.Nack(false, true)
-			return errors.Wrap(err, "waiting for job dependencies failed")
-		}
+	// Skip jobs which were cancelled while they were queued. Dependencies are handled
+	// by the server, which only publishes a job once all its dependencies succeeded
+	status := w.getJobStatus(&job)
+	if isFinalState(status.State) {
+		ackJob(msg, job.ID)
+		Log.Info().
+			Str("job_id", job.ID.String()).
+			Str("state", status.State).
+			Msg("job already finished, skipping")
+		return nil
+	}
 
-		// In any of the dependencies failed, the current job should also
-		// be listed as failed
-		failed := []string{}
-		for _, st := range depStatus {
-			if st.Successful == false {
-				failed = append(failed, st.ID.String())
+	// When the priority of a queued job is changed, the server publishes the job again
+	// with the new priority. The message published before is skipped
+	if status.State == JobStateSubmitted && status.Priority != job.Priority {
+		ackJob(msg, job.ID)
+		Log.Info().
+			Str("job_id", job.ID.String()).
+			Int("priority", job.Priority).
+			Int("new_priority", status.Priority).
+			Msg("job priority changed, skipping superseded message")
+		return nil
+	}
+
+	// The previous delivery of a redelivered message failed, because the worker stopped
+	// or the job status could not be recorded. It is published again to count the failed
+	// delivery, and is dead-lettered after too many failures
+	if msg.Redelivered {
+		rejected, err := w.client.qcl.redeliver(msg, w.maxDeliveries)
+		if err != nil {
+			if err := msg.Nack(false, true); err != nil {
+				Log.Warn().Err(err).Str("job_id", job.ID.String()).Msg("could not requeue job message")
 			}
+			return errors.Wrap(err, "could not count failed delivery")
 		}
-		if len(failed) > 0 {
-			err := fmt.Errorf("failed job dependencies: %v", failed)
-			t := time.Now()
-			if err := w.postJobStatus(
-				&job, w.name, t, t, false, err.Error()); err != nil {
-				msg.Nack(false, true)
-				return errors.Wrap(err, "posting job status to server failed")
-			}
-			msg.Nack(false, false)
-			return err
+		if rejected {
+			Log.Error().
+				Str("job_id", job.ID.String()).
+				Int("max_deliveries", w.maxDeliveries).
+				Msg("job delivered too many times, moved to the dead-letter queue")
 		}
+		return nil
 	}
 
-	Log.Info().Str("job_id", job.ID.String()).Msg("start publishing job")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.setCurrentJob(job.ID, cancel)
+	defer w.setCurrentJob(uuid.Nil, nil)
+
+	// The job may have been cancelled since its state was queried. The server then
+	// refuses to mark it as running, and it is skipped
 	startTime := time.Now()
+	if err := w.postJobState(&job, JobStateRunning, startTime); err == errJobNotPending {
+		msg.Ack(false)
+		Log.Info().Str("job_id", job.ID.String()).Msg("job already finished, skipping")
+		return nil
+	}
+	Log.Info().Str("job_id", job.ID.String()).Msg("start publishing job")
+
+	// Output of the transaction script, uploaded to the server while the job is running
+	output := newJobLog(w.maxLogSize)
+	stopStreaming := w.streamJobLog(&job, output)
 
 	task := func() error {
-		return job.process(w.tempDir)
+		return job.process(ctx, w.tempDir, output)
 	}
 
 	success := false
 	var returnErr error
+	attempts := []JobAttempt{}
 	retry := 0
 	for retry <= w.maxJobRetries {
+		output.Printf("[conveyor: attempt %v/%v on worker %v]", retry+1, w.maxJobRetries+1, w.name)
+		attempt := JobAttempt{Attempt: retry + 1, WorkerName: w.name, StartTime: time.Now()}
 		err := runTransaction(job.Repository, job.LeasePath, task)
+		attempt.FinishTime = time.Now()
+		if err != nil {
+			attempt.Phase, attempt.ExitCode = failedPhase(err)
+			attempt.ErrorMessage = err.Error()
+		} else {
+			attempt.Successful = true
+		}
+		attempts = append(attempts, attempt)
 		if err != nil {
+			output.Printf("[conveyor: attempt failed in phase %v: %v]", attempt.Phase, err)
 			returnErr = err
 			Log.Error().Err(err).Msg("transaction failed")
+			if ctx.Err() != nil {
+				break
+			}
 			retry++
 			if retry <= w.maxJobRetries {
+				jobRetries.Inc()
 				Log.Error().Msgf("retrying: %v/%v\n", retry, w.maxJobRetries)
 			}
 		} else {
@@ -140,36 +220,65 @@ func (w *Worker) handle(msg *amqp.Delivery) error {
 
 	finishTime := time.Now()
 
+	state := completionState(success)
 	var errMsg string
-	if returnErr != nil {
+	// A job cancelled after its transaction was published still succeeded
+	if !success && ctx.Err() != nil {
+		state = JobStateCancelled
+		errMsg = "job cancelled while running"
+	} else if returnErr != nil {
 		errMsg = returnErr.Error()
 	}
+
+	// The rest of the log is uploaded before the job status, so that clients following
+	// the log get the complete output
+	stopStreaming()
+	w.postJobLog(&job, output)
+
 	// Publish the processed job status to the job server
 	if err := w.postJobStatus(
-		&job, w.name, startTime, finishTime, success, errMsg); err != nil {
-		msg.Nack(false, true)
+		&job, w.name, startTime, finishTime, state, errMsg, attempts); err != nil {
+		if err := msg.Nack(false, true); err != nil {
+			Log.Warn().Err(err).Str("job_id", job.ID.String()).Msg("could not requeue job message")
+		}
 		return errors.Wrap(err, "posting job status to server failed")
 	}
 
-	msg.Ack(false)
+	ackJob(msg, job.ID)
+	jobsProcessed.WithLabelValues(state).Inc()
 	Log.Info().
 		Str("job_id", job.ID.String()).
-		Bool("success", success).
+		Str("state", state).
 		Msg("finished publishing job")
 
 	return returnErr
 }
 
+// ackJob acknowledges a job message. When the connection to the queue was lost while the
+// job was processed, the acknowledgement fails and the broker redelivers the message; the
+// status of the job is already recorded by the server, so the redelivered job is skipped
+func ackJob(msg *amqp.Delivery, id uuid.UUID) {
+	if err := msg.Ack(false); err != nil {
+		Log.Warn().
+			Err(err).
+			Str("job_id", id.String()).
+			Msg("could not acknowledge job message, it will be redelivered")
+	}
+}
+
 func (w *Worker) postJobStatus(
-	j *UnprocessedJob, workerName string, t0 time.Time, t1 time.Time, success bool, errMsg string) error {
+	j *UnprocessedJob, workerName string, t0 time.Time, t1 time.Time, state string, errMsg string,
+	attempts []JobAttempt) error {
 
 	processed := ProcessedJob{
 		UnprocessedJob: *j,
 		WorkerName:     workerName,
 		StartTime:      t0,
 		FinishTime:     t1,
-		Successful:     success,
+		State:          state,
+		Successful:     state == JobStateSucceeded,
 		ErrorMessage:   errMsg,
+		Attempts:       attempts,
 	}
 
 	// Post job status to the job server
@@ -184,3 +293,103 @@ func (w *Worker) postJobStatus(
 
 	return nil
 }
+
+// postJobState reports a state transition of a job to the server. errJobNotPending is
+// returned if the server rejected it because the job is already finished. Other failures
+// are only logged, since the final job status is reported separately
+func (w *Worker) postJobState(j *UnprocessedJob, state string, t time.Time) error {
+	update := JobStateUpdate{ID: j.ID, State: state, WorkerName: w.name, Time: t}
+	rep, err := w.client.PostJobState(&update, j.Repository)
+	if err != nil {
+		Log.Error().Err(err).Str("job_id", j.ID.String()).Msg("could not post job state")
+		return nil
+	}
+	if rep.Status != "ok" {
+		Log.Warn().
+			Str("job_id", j.ID.String()).
+			Str("state", state).
+			Str("reason", rep.Reason).
+			Msg("job state update rejected")
+		if rep.Reason == errJobNotPending.Error() {
+			return errJobNotPending
+		}
+	}
+	return nil
+}
+
+// streamJobLog periodically uploads the new output of a job to the server. The returned
+// function stops the uploads
+func (w *Worker) streamJobLog(j *UnprocessedJob, l *jobLog) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if chunk := l.pending(j.ID); len(chunk.Data) > 0 {
+					w.postJobLog(j, l)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// postJobLog uploads the output of a job which was not yet uploaded to the server.
+// Failures are only logged, so that a missing log does not prevent recording the job
+// status; the output is uploaded again on the next attempt
+func (w *Worker) postJobLog(j *UnprocessedJob, l *jobLog) {
+	chunk := l.pending(j.ID)
+	rep, err := w.client.PostJobLog(&chunk, j.Repository)
+	if err != nil {
+		Log.Error().Err(err).Str("job_id", j.ID.String()).Msg("could not post job log")
+		return
+	}
+	if rep.Status != "ok" {
+		Log.Warn().
+			Str("job_id", j.ID.String()).
+			Str("reason", rep.Reason).
+			Msg("job log upload rejected")
+		return
+	}
+	l.setFlushed(chunk.Offset + int64(len(chunk.Data)))
+}
+
+// getJobStatus queries the server for the state and the priority of a job. A zero
+// status is returned if the state could not be retrieved
+func (w *Worker) getJobStatus(j *UnprocessedJob) JobStatus {
+	quit := make(chan struct{})
+	rep, err := w.client.GetJobStatus([]string{j.ID.String()}, false, quit)
+	if err != nil || rep.Status != "ok" || len(rep.IDs) == 0 {
+		Log.Warn().Err(err).Str("job_id", j.ID.String()).Msg("could not query job state")
+		return JobStatus{}
+	}
+	return rep.IDs[0]
+}
+
+func (w *Worker) setCurrentJob(id uuid.UUID, cancel context.CancelFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.currentJob = id
+	w.cancelJob = cancel
+}
+
+// cancel stops the processing of a job, if it is the current job of the worker. The
+// transaction script is killed and the transaction aborted
+func (w *Worker) cancel(id uuid.UUID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cancelJob != nil && w.currentJob == id {
+		Log.Info().Str("job_id", id.String()).Msg("cancelling job")
+		w.cancelJob()
+	}
+}
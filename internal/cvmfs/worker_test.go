@@ -0,0 +1,98 @@
+package cvmfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// testAcknowledger records the acknowledgements of a job message
+type testAcknowledger struct {
+	acked, nacked, rejected bool
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.rejected = true
+	return nil
+}
+
+// testJobServer answers the requests of a worker for a single job, in the given state.
+// The job state updates are rejected as if the job was finished, and the paths of the
+// POST requests are recorded
+type testJobServer struct {
+	mu    sync.Mutex
+	posts []string
+}
+
+func (s *testJobServer) handler(id uuid.UUID, state string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var reply interface{}
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/jobs/complete":
+			reply = GetJobStatusReply{
+				BasicReply: BasicReply{Status: "ok"},
+				IDs:        []JobStatus{{ID: id, State: state}}}
+		case req.URL.Path == "/jobs/state":
+			reply = PostJobStateReply{BasicReply{Status: "error", Reason: errJobNotPending.Error()}}
+		default:
+			reply = BasicReply{Status: "ok"}
+		}
+		if req.Method == "POST" {
+			s.mu.Lock()
+			s.posts = append(s.posts, req.URL.Path)
+			s.mu.Unlock()
+		}
+		json.NewEncoder(w).Encode(reply)
+	}
+}
+
+func TestWorkerSkipsJobCancelledBeforeStart(t *testing.T) {
+	id := uuid.New()
+	server := &testJobServer{}
+	// The job is cancelled after the worker queried its state, before it is marked as
+	// running
+	srv := httptest.NewServer(server.handler(id, JobStateSubmitted))
+	defer srv.Close()
+
+	keys, err := newKeyStore(&Config{SharedKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		name: "w1", tempDir: "/nonexistent",
+		client: &JobClient{keys: keys, endpoints: HTTPEndpoints{srv.URL}}}
+
+	body, err := json.Marshal(&UnprocessedJob{
+		ID: id, JobSpecification: JobSpecification{Repository: "sft.cern.ch", LeasePath: "/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &testAcknowledger{}
+	msg := amqp.Delivery{Acknowledger: ack, Body: body}
+
+	if err := w.handle(&msg); err != nil {
+		t.Fatalf("job not skipped: %v", err)
+	}
+	if !ack.acked || ack.nacked || ack.rejected {
+		t.Errorf("job message not acknowledged: %+v", ack)
+	}
+	// No status is reported for the job
+	if len(server.posts) != 1 || server.posts[0] != "/jobs/state" {
+		t.Errorf("unexpected requests: %v", server.posts)
+	}
+}
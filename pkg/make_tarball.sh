@@ -45,7 +45,6 @@ mkdir -p ${PKG_WS}
 
 cp -v ${BUILD_LOCATION}/conveyor ${PKG_WS}/
 cp -v ${BUILD_LOCATION}/config/config.toml ${PKG_WS}/config.toml.example
-cp -v ${BUILD_LOCATION}/config/create_schema_postgres.sql ${PKG_WS}/
 cp -v ${BUILD_LOCATION}/pkg/*.service ${PKG_WS}/
 
 cd ${PKG_WS}